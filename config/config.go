@@ -1,7 +1,11 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
@@ -9,37 +13,331 @@ import (
 type Config struct {
 	Server         string
 	Address        string
+	Address6       string
 	DefaultGateway string
-	MTU            int
+	MTU            int `toml:"-"`
 	TTL            int
 	User           string
 	Pass           string
+	Salt           string
 	HostHeader     string
 	Incognito      bool
 
+	// MTU is either a number or "auto"
+	RawMTU  interface{} `toml:"MTU"`
+	AutoMTU bool        `toml:"-"`
+
+	// Networks are more networks of the clients besides Address and
+	// Address6 (server)
+	Networks []string
+
+	MaxQueueBytes        int
+	MaxSessionQueueBytes int
+	QueuePolicy          string
+
+	UpScript   string
+	DownScript string
+
+	TunReaders int
+
+	DNS string
+
+	// DNSOnly tunnels only the DNS queries, to DNS
+	DNSOnly bool
+
+	ReportPublicIP string
+	NotFoundPolicy string
+
+	LogFile   string
+	LogAppend bool
+
+	// LogTarget is "syslog" to log to SyslogAddr, default the local daemon
+	LogTarget  string
+	SyslogAddr string
+
+	StatsAddr    string
+	StatsTLSCert string
+	StatsTLSKey  string
+	StatsToken   string
+
+	AuthWebhook      string
+	AuthWebhookToken string
+
+	OTLPEndpoint string
+	OTLPHeaders  map[string]string
+	OTLPInterval int
+
+	Cgroup string
+
+	RunAsUser string
+
+	ResolveInterval int
+
+	ProbeTarget   string
+	ProbeInterval int
+	ProbeFailures int
+
+	// DNSRetries is how many times the server name is looked up again at
+	// startup, waiting DNSRetryDelay seconds at first and doubling, negative
+	// disables it
+	DNSRetries    int
+	DNSRetryDelay int
+
+	MaxConcurrentAuth int
+
+	TopTalkers int
+
+	Paranoid bool
+
+	AdminAddr   string
+	PauseRoutes bool
+
+	PadBuckets []int
+
+	// users without Ipaddress get one of Pool, except ReservedIPs
+	Pool        string
+	ReservedIPs []string
+	// seconds the address of a disconnected user is kept for it
+	LeaseGrace int
+
+	AllowedPorts []int
+
+	MaxReconnectDuration int
+
+	ReconnectDelay    int
+	ReconnectMaxDelay int
+	MaxReconnectTries int
+
+	DSCP int
+
+	MaxSessionLifetime int
+
+	MaxClockSkew int
+
+	QuotaFile  string
+	QuotaReset string
+
+	Disguise string
+
+	MOTD string
+
+	BatchWindow int
+
+	Compress bool
+
+	CompressEncrypted bool
+
+	MTUDiagnostic bool
+
+	// Transport "cdn" is a preset of the knobs below for a server behind
+	// a CDN
+	Transport      string
+	Path           string
+	KeepAlive      int
+	ClientIPHeader string
+
+	DeadTimeout int
+
+	ProtocolMagic string
+
+	AllowedSources []string
+
+	TLS       bool
+	TLSCert   string
+	TLSKey    string
+	ACME      bool
+	ACMEDir   string
+	ACMEEmail string
+
+	// PublicServer is the host:port the clients connect to, for GenClient
+	// when Server is only the listen address of the server
+	PublicServer string
+
 	Whitelist []string
 	Blacklist []string
 
+	WhitelistFile string
+	BlacklistFile string
+
 	Users []struct {
-		Username  string
-		Password  string
-		Ipaddress string
+		Username   string
+		Password   string
+		Salt       string
+		Ipaddress  string
+		Ipaddress6 string
+		Routes     []string
+		Group      string
+		NAT64      bool
+		Quota      int64
+		MTU        int
+		Rate       string
+
+		AllowedPorts []int
+		Subnets      []string
+	}
+
+	// Groups get a tun device each, MyNIC1, MyNIC2... in this order
+	Groups []struct {
+		Name    string
+		Address string
 	}
 }
 
+// Load reads the config at path, an encrypted config is decrypted with the
+// master key in MASTER_KEY_ENV.
 func Load(path string) (Config, error) {
+	return LoadWithKey(path, os.Getenv(MASTER_KEY_ENV))
+}
+
+// LoadWithKey reads the config at path over the Embedded one, path may
+// then be missing.
+func LoadWithKey(path, masterKey string) (Config, error) {
 	var config Config
-	if _, err := toml.DecodeFile(path, &config); err != nil {
+	logAppend := false
+	if len(Embedded) > 0 {
+		data, err := embeddedConfig(masterKey)
+		if err != nil {
+			return config, fmt.Errorf("could not load embedded config: %v", err)
+		}
+		meta, err := toml.Decode(string(data), &config)
+		if err != nil {
+			return config, fmt.Errorf("could not load embedded config: %v", err)
+		}
+		logAppend = meta.IsDefined("LogAppend")
+	}
+
+	data, err := readConfig(path, masterKey)
+	if err != nil && !(len(Embedded) > 0 && errors.Is(err, os.ErrNotExist)) {
 		return config, fmt.Errorf("could not load config: %v", err)
 	}
 
+	if err == nil {
+		meta, err := toml.Decode(string(data), &config)
+		if err != nil {
+			return config, fmt.Errorf("could not load config: %v", err)
+		}
+		logAppend = logAppend || meta.IsDefined("LogAppend")
+	}
+
+	if !logAppend {
+		config.LogAppend = true
+	}
+
 	if config.TTL <= 0 {
 		config.TTL = 30
 	}
 
+	if config.ResolveInterval == 0 {
+		config.ResolveInterval = 300
+	}
+
+	if config.ProbeInterval == 0 {
+		config.ProbeInterval = 60
+	}
+
+	if config.DNSRetries == 0 {
+		config.DNSRetries = 5
+	}
+
+	if config.DNSRetryDelay <= 0 {
+		config.DNSRetryDelay = 1
+	}
+
+	if config.MaxConcurrentAuth == 0 {
+		config.MaxConcurrentAuth = 16
+	}
+
+	switch mtu := config.RawMTU.(type) {
+	case nil:
+	case int64:
+		config.MTU = int(mtu)
+	case string:
+		if mtu != "auto" {
+			return config, fmt.Errorf("invalid MTU: %q", mtu)
+		}
+		config.AutoMTU = true
+	default:
+		return config, fmt.Errorf("invalid MTU: %v", mtu)
+	}
+
 	if config.MTU <= 0 {
 		config.MTU = 1500
 	}
 
 	return config, nil
 }
+
+// GenClient builds the config file of a client from the server config. The
+// result is a regular config.toml so it can be loaded with Load as is. The
+// user must have a Salt, see AddSalt.
+func (c Config) GenClient(username string) (string, error) {
+	for _, u := range c.Users {
+		if u.Username != username {
+			continue
+		}
+		if len(u.Salt) < 1 {
+			return "", fmt.Errorf("user %s has no Salt", username)
+		}
+
+		gateway := c.Address
+		if idx := strings.Index(gateway, "/"); idx >= 0 {
+			gateway = gateway[:idx]
+		}
+
+		server, err := c.publicServer()
+		if err != nil {
+			return "", err
+		}
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "Server         = %q\n", server)
+		if len(u.Ipaddress) > 0 {
+			fmt.Fprintf(&b, "Address        = %q\n", u.Ipaddress)
+		}
+		if len(u.Ipaddress6) > 0 {
+			fmt.Fprintf(&b, "Address6       = %q\n", u.Ipaddress6)
+		}
+		fmt.Fprintf(&b, "DefaultGateway = %q\n", gateway)
+		mtu := c.MTU
+		if u.MTU > 0 {
+			mtu = u.MTU
+		}
+		fmt.Fprintf(&b, "MTU            = %d\n", mtu)
+		fmt.Fprintf(&b, "TTL            = %d\n", c.TTL)
+		fmt.Fprintf(&b, "User           = %q\n", u.Username)
+		fmt.Fprintf(&b, "Pass           = %q\n", u.Password)
+		fmt.Fprintf(&b, "Salt           = %q\n", u.Salt)
+		if len(c.HostHeader) > 0 {
+			fmt.Fprintf(&b, "HostHeader     = %q\n", c.HostHeader)
+		}
+		if len(c.TLSCert) > 0 || c.ACME {
+			fmt.Fprintf(&b, "TLS            = true\n")
+		}
+		if len(c.Transport) > 0 {
+			fmt.Fprintf(&b, "Transport      = %q\n", c.Transport)
+		}
+		if len(c.Path) > 0 {
+			fmt.Fprintf(&b, "Path           = %q\n", c.Path)
+		}
+		if len(c.ProtocolMagic) > 0 {
+			fmt.Fprintf(&b, "ProtocolMagic  = %q\n", c.ProtocolMagic)
+		}
+		return b.String(), nil
+	}
+
+	return "", fmt.Errorf("user %s not found", username)
+}
+
+// publicServer is the address of the server for its clients: PublicServer,
+// or Server when it is not a wildcard or a bare port.
+func (c Config) publicServer() (string, error) {
+	if len(c.PublicServer) > 0 {
+		return c.PublicServer, nil
+	}
+
+	host, _, err := net.SplitHostPort(c.Server)
+	if err != nil || len(host) < 1 || net.ParseIP(host).IsUnspecified() {
+		return "", fmt.Errorf("Server %q is not an address the clients can reach, set PublicServer", c.Server)
+	}
+	return c.Server, nil
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func testServerConfig(t *testing.T, server string) Config {
+	var c Config
+	_, err := toml.Decode(`
+Address = "172.16.0.1/24"
+TTL     = 30
+Users   = [{Username = "user", Password = "password", Salt = "0123456789abcdef", Ipaddress = "172.16.0.13/24"}]
+`, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Server, c.MTU = server, 1500
+	return c
+}
+
+func TestGenClientServer(t *testing.T) {
+	for _, server := range []string{"0.0.0.0:443", "[::]:443", ":443"} {
+		c := testServerConfig(t, server)
+		if _, err := c.GenClient("user"); err == nil {
+			t.Errorf("Server %q given to the client", server)
+		}
+
+		c.PublicServer = "vpn.example.com:443"
+		conf, err := c.GenClient("user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(conf, `Server         = "vpn.example.com:443"`) {
+			t.Errorf("PublicServer not used:\n%s", conf)
+		}
+	}
+
+	conf, err := testServerConfig(t, "10.10.10.10:443").GenClient("user")
+	if err != nil || !strings.Contains(conf, `Server         = "10.10.10.10:443"`) {
+		t.Errorf("Server not used: %v\n%s", err, conf)
+	}
+}
+
+func TestGenClientTLS(t *testing.T) {
+	c := testServerConfig(t, "10.10.10.10:443")
+	conf, _ := c.GenClient("user")
+	if strings.Contains(conf, "TLS") {
+		t.Errorf("TLS without a certificate:\n%s", conf)
+	}
+
+	c.ACME = true
+	conf, _ = c.GenClient("user")
+	if !strings.Contains(conf, "TLS            = true") {
+		t.Errorf("no TLS with ACME:\n%s", conf)
+	}
+
+	c.ACME, c.TLSCert = false, "server.crt"
+	conf, _ = c.GenClient("user")
+	if !strings.Contains(conf, "TLS            = true") {
+		t.Errorf("no TLS with TLSCert:\n%s", conf)
+	}
+}
+
+func TestEncryptConfig(t *testing.T) {
+	plain := []byte("Server = \"vpn.example.com:443\"\n")
+	data, err := EncryptConfig(plain, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decodeConfig(append([]byte{}, data...), "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(plain) {
+		t.Errorf("decoded %q, want %q", got, plain)
+	}
+
+	if _, err := decodeConfig(append([]byte{}, data...), "wrong"); err == nil {
+		t.Error("config decrypted with a wrong master key")
+	}
+
+	data[len(data)-1] ^= 1
+	if _, err := decodeConfig(data, "master"); err == nil {
+		t.Error("changed config decrypted")
+	}
+
+	again, err := EncryptConfig(plain, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := data[len(CONFIG_MAGIC) : len(CONFIG_MAGIC)+CONFIG_SALT_LEN]
+	if bytes.Equal(salt, again[len(CONFIG_MAGIC):len(CONFIG_MAGIC)+CONFIG_SALT_LEN]) {
+		t.Error("same salt for two encryptions")
+	}
+}
+
+func TestAddSalt(t *testing.T) {
+	const SALT = "0123456789abcdef0123456789abcdef"
+	for name, content := range map[string]string{
+		"inline": `Users = [
+	# {Username = "user", Password = "old"},
+	{Username = "user", Password = "password"},
+	{Username = "other", Password = "password"},
+]
+`,
+		"table": `[[Users]]
+  Username = "user"
+  Password = "password"
+
+[[Users]]
+  Username = "other"
+  Password = "password"
+`,
+	} {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := AddSalt(path, "user", SALT); err != nil {
+			t.Fatal(name, err)
+		}
+
+		var c Config
+		if _, err := toml.DecodeFile(path, &c); err != nil {
+			t.Fatal(name, err)
+		}
+		if len(c.Users) != 2 || c.Users[0].Salt != SALT || len(c.Users[1].Salt) > 0 {
+			t.Errorf("%s: users after AddSalt %+v", name, c.Users)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml.enc")
+	data, err := EncryptConfig([]byte(`Users = [{Username = "user"}]`), "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, data, 0600)
+	if err := AddSalt(path, "user", SALT); err == nil {
+		t.Error("salt written into an encrypted config")
+	}
+}
+
+func TestGenClientNeedsSalt(t *testing.T) {
+	c := testServerConfig(t, "vpn.example.com:443")
+	c.Users[0].Salt = ""
+	if _, err := c.GenClient("user"); err == nil {
+		t.Error("client config without a Salt")
+	}
+}
@@ -0,0 +1,21 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// Embedded is a config built into the binary, used when there is no config
+// file and overridden by the settings of the file otherwise. It is the
+// base64 of a config in any format Load reads, e.g.
+//
+//	go build -ldflags "-X hivpn/config.Embedded=$(gzip -c client.toml | base64 -w0)"
+var Embedded string
+
+func embeddedConfig(masterKey string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(Embedded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %v", err)
+	}
+	return decodeConfig(data, masterKey)
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// AddSalt writes Salt = salt into the entry of username in the config file
+// at path, right after its Username, for an inline table as well as for a
+// [[Users]] one. Only a plain toml file can be edited, an encrypted or a
+// compressed one is an error.
+func AddSalt(path, username, salt string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(data, []byte(CONFIG_MAGIC)) || bytes.HasPrefix(data, gzipMagic) {
+		return fmt.Errorf("%s is encrypted or compressed, add Salt = %q to user %s yourself", path, salt, username)
+	}
+
+	// the commented out users are skipped
+	re := regexp.MustCompile(`(?m)^([^\n#]*)\bUsername\s*=\s*"` + regexp.QuoteMeta(username) + `"`)
+	found := re.FindAllSubmatchIndex(data, -1)
+	if len(found) != 1 {
+		return fmt.Errorf("user %s is %d times in %s, add Salt = %q to it yourself", username, len(found), path, salt)
+	}
+
+	at, prefix := found[0][1], data[found[0][2]:found[0][3]]
+	entry := ", Salt = " + strconv.Quote(salt)
+	if !bytes.Contains(prefix, []byte("{")) {
+		indent := prefix[:len(prefix)-len(bytes.TrimLeft(prefix, " \t"))]
+		entry = "\n" + string(indent) + "Salt = " + strconv.Quote(salt)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	out := append(append(append([]byte{}, data[:at]...), entry...), data[at:]...)
+	return os.WriteFile(path, out, info.Mode().Perm())
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"fmt"
+	"hivpn/crypto"
+	"io"
+	"os"
+)
+
+// A config file may be stored compressed and/or encrypted, Load detects it
+// from the first bytes:
+//
+//	gzip:      the gzip stream of the toml file (starts with 0x1f 0x8b)
+//	encrypted: CONFIG_MAGIC, then a CONFIG_SALT_LEN bytes random salt, then
+//	           the plain or gzipped file as a crypto.AESEncrypt message. The
+//	           key is crypto.DeriveKey of the master key and the salt.
+//
+// An encrypted file is produced with hivpn -encrypt-config. A wrong master
+// key or a changed file fails the GCM tag check.
+const (
+	CONFIG_MAGIC    = "HIVPNENC"
+	CONFIG_SALT_LEN = 16
+	MASTER_KEY_ENV  = "HIVPN_MASTER_KEY"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// readConfig returns the toml content of path, decrypted and decompressed
+// in memory.
+func readConfig(path, masterKey string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeConfig(data, masterKey)
+}
+
+// decodeConfig decrypts and decompresses the content of a config file.
+func decodeConfig(data []byte, masterKey string) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte(CONFIG_MAGIC)) {
+		if len(masterKey) < 1 {
+			return nil, fmt.Errorf("config is encrypted, set the master key with -master-key or %s", MASTER_KEY_ENV)
+		}
+		data = data[len(CONFIG_MAGIC):]
+		if len(data) < CONFIG_SALT_LEN {
+			return nil, fmt.Errorf("decrypt config error: file too short")
+		}
+		key, err := crypto.DeriveKey(masterKey, string(data[:CONFIG_SALT_LEN]))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt config error: %v", err)
+		}
+		data, err = crypto.AESDecrypt(key, data[CONFIG_SALT_LEN:])
+		if err != nil {
+			return nil, fmt.Errorf("decrypt config error: wrong master key or damaged file")
+		}
+	}
+
+	if bytes.HasPrefix(data, gzipMagic) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("decompress config error: %v", err)
+		}
+		data, err = io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("decompress config error: %v", err)
+		}
+	}
+
+	return data, nil
+}
+
+// EncryptConfig compresses and encrypts a toml config with the master key in
+// the format read by Load.
+func EncryptConfig(data []byte, masterKey string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, CONFIG_SALT_LEN)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := crypto.DeriveKey(masterKey, string(salt))
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := crypto.AESEncrypt(key, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(CONFIG_MAGIC), salt...)
+	return append(out, encrypted...), nil
+}
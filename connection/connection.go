@@ -1,42 +1,208 @@
 package connection
 
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hivpn/crypto"
+	"hivpn/utils"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
 type TUN struct {
-	Addr              string
-	HostHeader        string
-	TryNumber         int
-	Run               func() error
-	FuncWriteTunToDev func(key, data []byte)
-	FuncWriteDevToTun func(conn interface{}, data []byte) error
-	FuncAuthenConn    func(token string, conn interface{}) (string, []byte, func(id string))
+	Addr                 string
+	HostHeader           string
+	PublicIP             string
+	TryNumber            int
+	MaxQueueBytes        int
+	MaxSessionQueueBytes int
+	QueuePolicy          int
+	Run                  func() error
+	FuncWriteTunToDev    func(key *crypto.Session, data []byte)
+	FuncWriteDevToTun    func(conn interface{}, data []byte) error
+	FuncAuthenConn       func(token string, conn interface{}) (string, *crypto.Session, func(id string))
+
+	// FuncHandshake is called by the server with the token of a client, the
+	// result is sent back to it and ends up in Handshake on the client. ok
+	// is false when the token is refused.
+	FuncHandshake func(token string) (string, bool)
+	Handshake     string
+	// ServerTime is the clock of the server when the client connected,
+	// zero when unknown
+	ServerTime time.Time
+
+	// TLS makes the client dial wss, TLSConfig makes the server listen
+	// with it
+	TLS       bool
+	TLSConfig *tls.Config
+
+	// DSCP marks the packets of the transport itself, 0 leaves them alone
+	DSCP int
+
+	// Path is the url path of the tunnel, WEBSOCKET_PATH when empty
+	Path string
+
+	// Magic is sent with the version of the protocol ahead of the rest
+	// (see PROTOCOL_HEADER), DEFAULT_MAGIC when empty
+	Magic string
+
+	// KeepAlive pings the other side of an idle session, 0 never does
+	KeepAlive time.Duration
+	// DeadTimeout closes a session the other side said nothing on, not
+	// even a pong, for this long. KEEPALIVE_DEAD_INTERVALS keepalives when
+	// 0, never without KeepAlive on websockets
+	DeadTimeout time.Duration
+
+	// ClientIPHeader is the header a reverse proxy in front of the server
+	// puts the address of the client in, RemoteAddr is then the proxy's
+	ClientIPHeader string
+
+	// AllowedSources are the networks the server accepts connections
+	// from, any when empty
+	AllowedSources []*net.IPNet
+
+	// Disguise answers the requests of the server that are not a websocket
+	// upgrade, see DisguiseHandler
+	Disguise http.Handler
+
+	// Clock drives the keepalives, the idle and dial timeouts, nil is
+	// utils.RealClock. The deadlines of the sockets stay on the real clock.
+	Clock utils.Clock
+
+	queued   int64
+	queuesMu sync.Mutex
+	queues   map[*sessionQueue]bool
+	shutdown func() error
 }
 
 const (
 	CONNECTION_TYPE_WEBSOCKET   = 1
+	CONNECTION_TYPE_MEMORY      = 2
+	CONNECTION_TYPE_UDP         = 3
 	ERROR_AUTHENTICATION_FAILED = "Authentication failed"
 )
 
+// srcConn is what a transport hands to Connect, the conn given to
+// FuncAuthenConn is the one WriteDevToTun writes to.
+type srcConn interface {
+	OnFuncWriteTunToDev(f func(key *crypto.Session, data []byte))
+	OnAuthen(f func(id string, conn interface{}) (string, *crypto.Session, func(id string)))
+	OnHandshake(f func(token string) (string, bool))
+	WriteDevToTun(conn interface{}, data []byte) error
+}
+
+// Close codes of a session (RFC 6455 and the private 4000-4999 range). The
+// client gives up on CLOSE_AUTH_FAILED and CLOSE_POLICY_VIOLATION, the
+// others are worth a reconnect.
+const (
+	CLOSE_GOING_AWAY       = 1001
+	CLOSE_POLICY_VIOLATION = 1008
+	CLOSE_TRY_AGAIN_LATER  = 1013
+	CLOSE_AUTH_FAILED      = 4001
+	CLOSE_SESSION_EXPIRED  = 4002
+	CLOSE_QUEUE_FULL       = 4003
+)
+
+// CloseError is how the server ended the session of the client. Unsigned
+// is set when nothing proves the server sent it (a plain close over UDP),
+// it is then worth a reconnect whatever its code.
+type CloseError struct {
+	Code     int
+	Reason   string
+	Unsigned bool
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("session closed by the server: %d %s", e.Code, e.Reason)
+}
+
+// Retryable tells whether the client should connect again after Run
+// returned err.
+func Retryable(err error) bool {
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) {
+		return true
+	}
+	return closeErr.Unsigned || (closeErr.Code != CLOSE_AUTH_FAILED && closeErr.Code != CLOSE_POLICY_VIOLATION)
+}
+
 func (self *TUN) Connect(token string, connectType int) error {
+	var src srcConn
+	var runFunc func() error
 	switch connectType {
 	case CONNECTION_TYPE_WEBSOCKET:
 		self.TryNumber++
-		srcConn, runFunc, err := self.createWebSocket(self.Addr, token)
+		ws, run, err := self.createWebSocket(self.Addr, token)
 		if err != nil {
 			return err
 		}
-
-		srcConn.OnFuncWriteTunToDev(self.FuncWriteTunToDev)
-		srcConn.OnAuthen(self.FuncAuthenConn)
-		self.FuncWriteDevToTun = func(conn interface{}, data []byte) error {
-			self.TryNumber = 0
-			return srcConn.WriteDevToTun(conn, data)
+		src, runFunc = ws, run
+	case CONNECTION_TYPE_MEMORY:
+		self.TryNumber++
+		mem, run, err := self.createMemory(self.Addr, token)
+		if err != nil {
+			return err
 		}
-
-		self.onRun(runFunc)
+		src, runFunc = mem, run
+	case CONNECTION_TYPE_UDP:
+		self.TryNumber++
+		udp, run, err := self.createUDP(self.Addr, token)
+		if err != nil {
+			return err
+		}
+		src, runFunc = udp, run
 	default:
+		return fmt.Errorf("unknown connection type %d", connectType)
 	}
+
+	src.OnFuncWriteTunToDev(self.FuncWriteTunToDev)
+	src.OnAuthen(self.FuncAuthenConn)
+	src.OnHandshake(self.FuncHandshake)
+	self.FuncWriteDevToTun = func(conn interface{}, data []byte) error {
+		self.TryNumber = 0
+		return src.WriteDevToTun(conn, data)
+	}
+
+	self.onRun(runFunc)
 	return nil
 }
 
+func (t *TUN) clock() utils.Clock {
+	if t.Clock == nil {
+		return utils.RealClock
+	}
+	return t.Clock
+}
+
+func (t *TUN) path() string {
+	if len(t.Path) > 0 {
+		return t.Path
+	}
+	return WEBSOCKET_PATH
+}
+
 func (t *TUN) onRun(f func() error) {
 	t.Run = f
 }
+
+func (t *TUN) onShutdown(f func() error) {
+	t.queuesMu.Lock()
+	t.shutdown = f
+	t.queuesMu.Unlock()
+}
+
+// Shutdown stops the listener of the server and closes every session, Run
+// then returns.
+func (t *TUN) Shutdown() {
+	t.queuesMu.Lock()
+	shutdown := t.shutdown
+	t.queuesMu.Unlock()
+
+	if shutdown != nil {
+		shutdown()
+	}
+	t.Disconnect()
+}
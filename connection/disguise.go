@@ -0,0 +1,39 @@
+package connection
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// DisguiseHandler answers the requests that are not a tunnel: target is an
+// html file served as is, or an http(s) url the requests are proxied to.
+func DisguiseHandler(target string) (http.Handler, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid disguise url: %v", err)
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			// the site would not answer for our own name
+			r.Host = u.Host
+		}
+		return proxy, nil
+	}
+
+	page, err := os.ReadFile(target)
+	if err != nil {
+		return nil, fmt.Errorf("read disguise page error: %v", err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	}), nil
+}
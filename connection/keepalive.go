@@ -0,0 +1,92 @@
+package connection
+
+import (
+	"hivpn/log"
+	"net"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// KEEPALIVE_DEAD_INTERVALS is how many keepalives without a word from the
+// other side make a session dead when DeadTimeout is 0.
+const KEEPALIVE_DEAD_INTERVALS = 3
+
+// keepAlive pings the other side every t.KeepAlive until the returned func
+// is called, so the proxies in between do not close an idle session.
+func (t *TUN) keepAlive(c *websocket.Conn) func() {
+	if t.KeepAlive <= 0 {
+		return func() {}
+	}
+
+	clock := t.clock()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-clock.After(t.KeepAlive):
+				err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(CLOSE_TIMEOUT))
+				if err != nil {
+					log.Debug("keepalive ping error:", err)
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// deadTimeout is how long a session may stay silent, pongs included,
+// before it is closed. 0 when it is never: without the pings of KeepAlive
+// an idle session would look dead.
+func (t *TUN) deadTimeout() time.Duration {
+	if t.KeepAlive <= 0 {
+		return 0
+	}
+	if t.DeadTimeout > 0 {
+		return t.DeadTimeout
+	}
+	return t.KeepAlive * KEEPALIVE_DEAD_INTERVALS
+}
+
+// watchDead makes the reads of c fail once nothing came from the other side
+// for deadTimeout, the frames and the pings and pongs push it back. The
+// returned func is for the frames, call it after each.
+func (t *TUN) watchDead(c *websocket.Conn) func() {
+	dead := t.deadTimeout()
+	if dead <= 0 {
+		return func() {}
+	}
+
+	alive := func() {
+		c.SetReadDeadline(time.Now().Add(dead))
+	}
+	c.SetPongHandler(func(string) error {
+		alive()
+		return nil
+	})
+	c.SetPingHandler(func(data string) error {
+		alive()
+		// what the default handler does
+		err := c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(CLOSE_TIMEOUT))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil
+		}
+		return err
+	})
+	alive()
+	return alive
+}
+
+// isDead tells whether a read failed because of watchDead.
+func isDead(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
@@ -0,0 +1,75 @@
+package connection
+
+import (
+	"hivpn/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+func TestKeepAlivePingsOnClock(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	tun := &TUN{Clock: clock, KeepAlive: time.Minute}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		defer tun.keepAlive(c)()
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[len("http"):], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	pings := make(chan struct{}, 1)
+	c.SetPingHandler(func(string) error {
+		pings <- struct{}{}
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	waitFor(t, clock)
+	clock.Advance(time.Minute - time.Second)
+	select {
+	case <-pings:
+		t.Fatal("ping before KeepAlive")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-pings:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ping after KeepAlive")
+	}
+}
+
+// waitFor returns once the code under test waits on clock.
+func waitFor(t *testing.T, clock *utils.FakeClock) {
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Waiters() < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("nothing waits on the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
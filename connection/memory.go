@@ -0,0 +1,262 @@
+package connection
+
+import (
+	"fmt"
+	"hivpn/crypto"
+	"hivpn/log"
+	"sync"
+	"time"
+)
+
+// MEMORY_DIAL_TIMEOUT is how long a client waits for the server to listen
+// and take its connection, so a test does not have to order them. It looks
+// for the listener every MEMORY_DIAL_RETRY.
+const (
+	MEMORY_DIAL_TIMEOUT = 5 * time.Second
+	MEMORY_DIAL_RETRY   = 10 * time.Millisecond
+)
+
+// memoryListeners are the servers of the memory transport by address, it
+// works like the websocket one over channels and within the process, for
+// the tests of the vpn without sockets.
+var memoryListeners = struct {
+	mu sync.Mutex
+	m  map[string]*memoryListener
+}{m: make(map[string]*memoryListener, 0)}
+
+type memoryListener struct {
+	accept chan *memoryPipe
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *memoryListener) close() {
+	l.once.Do(func() {
+		close(l.done)
+	})
+}
+
+// memoryPipe is a connection between a client and a server, closed by
+// either side with a close code like a websocket.
+type memoryPipe struct {
+	protocol   string
+	token      string
+	publicIP   string
+	clientTime time.Time
+	handshake  chan string
+
+	up   chan []byte // client to server
+	down chan []byte // server to client
+
+	once     sync.Once
+	done     chan struct{}
+	closeErr *CloseError
+	byServer bool
+}
+
+func newMemoryPipe(protocol, token, publicIP string, clientTime time.Time) *memoryPipe {
+	return &memoryPipe{
+		protocol:   protocol,
+		token:      token,
+		publicIP:   publicIP,
+		clientTime: clientTime,
+		handshake:  make(chan string, 1),
+		up:         make(chan []byte, QUEUE_MAX_FRAMES),
+		down:       make(chan []byte, QUEUE_MAX_FRAMES),
+		done:       make(chan struct{}),
+	}
+}
+
+func (p *memoryPipe) close(code int, reason string, byServer bool) {
+	p.once.Do(func() {
+		p.closeErr = &CloseError{Code: code, Reason: reason}
+		p.byServer = byServer
+		close(p.done)
+	})
+}
+
+func (p *memoryPipe) write(ch chan []byte, data []byte) error {
+	frame := make([]byte, len(data))
+	copy(frame, data)
+	select {
+	case ch <- frame:
+		return nil
+	case <-p.done:
+		return fmt.Errorf("memory connection closed")
+	}
+}
+
+func (p *memoryPipe) read(ch chan []byte) ([]byte, bool) {
+	select {
+	case data := <-ch:
+		return data, true
+	case <-p.done:
+		return nil, false
+	}
+}
+
+type tunMemory struct {
+	parent        *TUN
+	writeTunToDev func(key *crypto.Session, data []byte)
+	authen        func(id string, conn interface{}) (string, *crypto.Session, func(id string))
+	handshake     func(token string) (string, bool)
+}
+
+func (self *tunMemory) OnFuncWriteTunToDev(f func(key *crypto.Session, data []byte)) {
+	self.writeTunToDev = f
+}
+
+func (self *tunMemory) WriteDevToTun(conn interface{}, data []byte) error {
+	return conn.(*sessionQueue).push(data)
+}
+
+func (self *tunMemory) OnAuthen(f func(id string, conn interface{}) (string, *crypto.Session, func(id string))) {
+	self.authen = f
+}
+
+func (self *tunMemory) OnHandshake(f func(token string) (string, bool)) {
+	self.handshake = f
+}
+
+func (t *tunMemory) handlerClient(p *memoryPipe) {
+	if status, reason := t.parent.checkProtocol(p.protocol); status != 0 {
+		log.Info("Refused memory client with", reason)
+		p.handshake <- ""
+		p.close(CLOSE_POLICY_VIOLATION, reason, true)
+		return
+	}
+
+	var handshake string
+	if t.handshake != nil {
+		handshake, _ = t.handshake(p.token)
+	}
+	p.handshake <- handshake
+
+	q := t.parent.newSessionQueue(func(data []byte) error {
+		return p.write(p.down, data)
+	}, func(code int, reason string) error {
+		p.close(code, reason, true)
+		return nil
+	})
+	defer q.close()
+	q.remoteAddr = "memory"
+	q.publicIP = p.publicIP
+	q.clientTime = p.clientTime
+
+	idRequest, key, cancel := t.authen(p.token, q)
+	if len(idRequest) < 1 {
+		q.Close(CLOSE_AUTH_FAILED, ERROR_AUTHENTICATION_FAILED)
+		return
+	}
+	q.setID(idRequest)
+
+	for {
+		frame, ok := p.read(p.up)
+		if !ok {
+			break
+		}
+		t.writeTunToDev(key, frame)
+	}
+	cancel(idRequest)
+}
+
+func (t *tunMemory) handlerServer(p *memoryPipe) error {
+	q := t.parent.newSessionQueue(func(data []byte) error {
+		return p.write(p.up, data)
+	}, func(code int, reason string) error {
+		p.close(code, reason, false)
+		return nil
+	})
+	defer q.close()
+
+	idReq, key, cancel := t.authen(p.token, q)
+	q.setID(idReq)
+
+	for {
+		message, ok := p.read(p.down)
+		if !ok {
+			break
+		}
+		t.writeTunToDev(key, message)
+	}
+	cancel(idReq)
+
+	if p.byServer {
+		log.Error(p.closeErr)
+		return p.closeErr
+	}
+	return nil
+}
+
+// createMemory is createWebSocket over a memoryPipe, the server takes addr
+// right away and serves it while running.
+func (t *TUN) createMemory(addr, token string) (newTun *tunMemory, runFunc func() error, err error) {
+	newTun = &tunMemory{parent: t}
+	if token == "" {
+		l := &memoryListener{
+			accept: make(chan *memoryPipe),
+			done:   make(chan struct{}),
+		}
+
+		memoryListeners.mu.Lock()
+		if _, found := memoryListeners.m[addr]; found {
+			memoryListeners.mu.Unlock()
+			return nil, nil, fmt.Errorf("listen memory %s: address already in use", addr)
+		}
+		memoryListeners.m[addr] = l
+		memoryListeners.mu.Unlock()
+
+		runFunc = func() error {
+			log.Info("Server listening on memory", addr)
+			t.onShutdown(func() error {
+				memoryListeners.mu.Lock()
+				delete(memoryListeners.m, addr)
+				memoryListeners.mu.Unlock()
+				l.close()
+				return nil
+			})
+			for {
+				select {
+				case p := <-l.accept:
+					go newTun.handlerClient(p)
+				case <-l.done:
+					return fmt.Errorf("memory server %s closed", addr)
+				}
+			}
+		}
+		return
+	}
+
+	log.Info("Connecting to memory", addr, "...")
+	clock := t.clock()
+	deadline := clock.Now().Add(MEMORY_DIAL_TIMEOUT)
+	var l *memoryListener
+	for {
+		memoryListeners.mu.Lock()
+		l = memoryListeners.m[addr]
+		memoryListeners.mu.Unlock()
+		if l != nil {
+			break
+		}
+		if clock.Now().After(deadline) {
+			return nil, nil, fmt.Errorf("dial memory %s error: connection refused", addr)
+		}
+		clock.Sleep(MEMORY_DIAL_RETRY)
+	}
+
+	p := newMemoryPipe(t.protocol(), token, t.PublicIP, clock.Now())
+	select {
+	case l.accept <- p:
+	case <-l.done:
+		return nil, nil, fmt.Errorf("dial memory %s error: connection refused", addr)
+	case <-clock.After(deadline.Sub(clock.Now())):
+		return nil, nil, fmt.Errorf("dial memory %s error: timeout", addr)
+	}
+	t.Handshake = <-p.handshake
+	t.ServerTime = clock.Now()
+
+	runFunc = func() error {
+		return newTun.handlerServer(p)
+	}
+	return
+}
@@ -0,0 +1,35 @@
+package connection
+
+import (
+	"hivpn/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryDialTimeout(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	tun := &TUN{Clock: clock}
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := tun.createMemory("nobody listens here", "token")
+		result <- err
+	}()
+
+	waitFor(t, clock)
+	select {
+	case err := <-result:
+		t.Fatalf("dial ended before its timeout: %v", err)
+	default:
+	}
+
+	clock.Advance(MEMORY_DIAL_TIMEOUT + MEMORY_DIAL_RETRY)
+	select {
+	case err := <-result:
+		if err == nil || !strings.Contains(err.Error(), "connection refused") {
+			t.Errorf("dial error %v, want connection refused", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial still waiting after its timeout")
+	}
+}
@@ -0,0 +1,44 @@
+package connection
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PROTOCOL_HEADER carries "<magic>/<version>" from the client, the
+	// server checks it first so what is not one of its clients costs no
+	// crypto. Version 2 encrypts with AES-GCM instead of AES-CFB, with the
+	// session key id as additional data, 3 derives the keys of the users
+	// with scrypt.
+	PROTOCOL_HEADER  = "Protocol"
+	PROTOCOL_VERSION = 3
+	DEFAULT_MAGIC    = "hivpn"
+)
+
+func (t *TUN) protocol() string {
+	magic := t.Magic
+	if len(magic) < 1 {
+		magic = DEFAULT_MAGIC
+	}
+	return fmt.Sprintf("%s/%d", magic, PROTOCOL_VERSION)
+}
+
+// checkProtocol returns why the protocol p of a client is refused, 0 and
+// empty when it is ours. A wrong magic is http.StatusNotFound, the client
+// is no hivpn one and gets the same as for any other path, another
+// version is http.StatusUpgradeRequired.
+func (t *TUN) checkProtocol(p string) (int, string) {
+	want := t.protocol()
+	if p == want {
+		return 0, ""
+	}
+
+	i := strings.LastIndexByte(p, '/')
+	if i < 0 || p[:i] != want[:strings.LastIndexByte(want, '/')] {
+		return http.StatusNotFound, "unknown protocol " + strconv.Quote(p)
+	}
+	return http.StatusUpgradeRequired, fmt.Sprintf("protocol version %s, the server speaks %d", p[i+1:], PROTOCOL_VERSION)
+}
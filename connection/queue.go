@@ -0,0 +1,196 @@
+package connection
+
+import (
+	"fmt"
+	"hivpn/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	QUEUE_POLICY_DROP       = 0
+	QUEUE_POLICY_DISCONNECT = 1
+
+	QUEUE_MAX_FRAMES = 1024
+)
+
+// sessionQueue serializes writes to a single connection so a slow peer
+// only backs up its own frames instead of blocking the tun reader.
+type sessionQueue struct {
+	parent    *TUN
+	idMu      sync.Mutex
+	id        string
+	frames    chan []byte
+	bytes     int64
+	done      chan struct{}
+	closeOnce sync.Once
+	write     func(data []byte) error
+	closeConn func(code int, reason string) error
+
+	remoteAddr string
+	publicIP   string
+	clientTime time.Time
+}
+
+// Peer describes the remote side of a session as seen by the transport,
+// the conn handed to FuncAuthenConn implements it.
+type Peer interface {
+	RemoteAddr() string
+	PublicIP() string
+	// ClientTime is the clock of the client when it connected, zero when
+	// it did not tell
+	ClientTime() time.Time
+
+	// Close ends the session telling the peer why, its read loop returns
+	Close(code int, reason string)
+}
+
+func (t *TUN) newSessionQueue(write func(data []byte) error, closeConn func(code int, reason string) error) *sessionQueue {
+	q := &sessionQueue{
+		parent:    t,
+		frames:    make(chan []byte, QUEUE_MAX_FRAMES),
+		done:      make(chan struct{}),
+		write:     write,
+		closeConn: closeConn,
+	}
+
+	t.queuesMu.Lock()
+	if t.queues == nil {
+		t.queues = make(map[*sessionQueue]bool, 0)
+	}
+	t.queues[q] = true
+	t.queuesMu.Unlock()
+
+	go q.run()
+	return q
+}
+
+// setID names the session once authenticated, its queue may already be in
+// use by then.
+func (q *sessionQueue) setID(id string) {
+	q.idMu.Lock()
+	q.id = id
+	q.idMu.Unlock()
+}
+
+func (q *sessionQueue) sessionID() string {
+	q.idMu.Lock()
+	defer q.idMu.Unlock()
+	return q.id
+}
+
+func (q *sessionQueue) RemoteAddr() string {
+	return q.remoteAddr
+}
+
+func (q *sessionQueue) PublicIP() string {
+	return q.publicIP
+}
+
+func (q *sessionQueue) ClientTime() time.Time {
+	return q.clientTime
+}
+
+func (q *sessionQueue) push(data []byte) error {
+	size := int64(len(data))
+	t := q.parent
+	if (t.MaxSessionQueueBytes > 0 && atomic.LoadInt64(&q.bytes)+size > int64(t.MaxSessionQueueBytes)) ||
+		(t.MaxQueueBytes > 0 && atomic.LoadInt64(&t.queued)+size > int64(t.MaxQueueBytes)) {
+		return q.overflow()
+	}
+
+	atomic.AddInt64(&q.bytes, size)
+	atomic.AddInt64(&t.queued, size)
+	select {
+	case q.frames <- data:
+		return nil
+	case <-q.done:
+		q.release(size)
+		return fmt.Errorf("session %s closed", q.sessionID())
+	default:
+		q.release(size)
+		return q.overflow()
+	}
+}
+
+func (q *sessionQueue) overflow() error {
+	if q.parent.QueuePolicy == QUEUE_POLICY_DISCONNECT {
+		log.Info("Queue of session", q.sessionID(), "is full, disconnect")
+		q.Close(CLOSE_QUEUE_FULL, "queue full")
+		return fmt.Errorf("session %s queue full, disconnected", q.sessionID())
+	}
+	return fmt.Errorf("session %s queue full, drop packet", q.sessionID())
+}
+
+func (q *sessionQueue) release(size int64) {
+	atomic.AddInt64(&q.bytes, -size)
+	atomic.AddInt64(&q.parent.queued, -size)
+}
+
+func (q *sessionQueue) run() {
+	for {
+		select {
+		case data := <-q.frames:
+			q.release(int64(len(data)))
+			if err := q.write(data); err != nil {
+				log.Debug("write frame to session", q.sessionID(), "error:", err)
+			}
+		case <-q.done:
+			for {
+				select {
+				case data := <-q.frames:
+					q.release(int64(len(data)))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *sessionQueue) Close(code int, reason string) {
+	q.closeOnce.Do(func() {
+		close(q.done)
+		q.parent.queuesMu.Lock()
+		delete(q.parent.queues, q)
+		q.parent.queuesMu.Unlock()
+		if q.closeConn != nil {
+			q.closeConn(code, reason)
+		}
+	})
+}
+
+func (q *sessionQueue) close() {
+	q.Close(CLOSE_GOING_AWAY, "")
+}
+
+// QueuedBytes returns the number of bytes waiting in all session queues.
+func (t *TUN) QueuedBytes() int64 {
+	return atomic.LoadInt64(&t.queued)
+}
+
+// QueueDepths returns the queued bytes of every live session keyed by its id.
+func (t *TUN) QueueDepths() map[string]int64 {
+	t.queuesMu.Lock()
+	defer t.queuesMu.Unlock()
+	depths := make(map[string]int64, len(t.queues))
+	for q := range t.queues {
+		depths[q.sessionID()] += atomic.LoadInt64(&q.bytes)
+	}
+	return depths
+}
+
+// Disconnect closes every live session so their read loops return.
+func (t *TUN) Disconnect() {
+	t.queuesMu.Lock()
+	var list []*sessionQueue
+	for q := range t.queues {
+		list = append(list, q)
+	}
+	t.queuesMu.Unlock()
+
+	for _, q := range list {
+		q.close()
+	}
+}
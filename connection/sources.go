@@ -0,0 +1,49 @@
+package connection
+
+import (
+	"hivpn/log"
+	"net"
+)
+
+// sourceListener closes the connections from outside of allowed as soon
+// as they are accepted, before tls or http.
+type sourceListener struct {
+	net.Listener
+	allowed []*net.IPNet
+}
+
+func (l *sourceListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allow(c.RemoteAddr()) {
+			return c, nil
+		}
+		log.Debug("Dropped connection from", c.RemoteAddr(), "not in AllowedSources")
+		c.Close()
+	}
+}
+
+func (l *sourceListener) allow(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	return allowSource(l.allowed, tcpAddr.IP)
+}
+
+func allowSource(allowed []*net.IPNet, ip net.IP) bool {
+	for _, n := range allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowSource tells whether a datagram of ip is looked at.
+func (t *TUN) allowSource(ip net.IP) bool {
+	return len(t.AllowedSources) < 1 || allowSource(t.AllowedSources, ip)
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package connection
+
+import "syscall"
+
+func setTOS(network string, c syscall.RawConn, tos int) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+			return
+		}
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
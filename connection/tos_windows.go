@@ -0,0 +1,20 @@
+package connection
+
+import "syscall"
+
+// setTOS only marks IPv4, windows applies it only when allowed by its QoS
+// policy.
+func setTOS(network string, c syscall.RawConn, tos int) error {
+	if network == "tcp6" {
+		return nil
+	}
+
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,598 @@
+package connection
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hivpn/crypto"
+	"hivpn/log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Over UDP every datagram starts with its type:
+//
+//	UDP_HELLO   | length (2 bytes) | udpHello json | zeros up to UDP_HELLO_MIN
+//	UDP_WELCOME | udpWelcome json
+//	UDP_DATA    | frame
+//	UDP_PING, UDP_PONG
+//	UDP_CLOSE   | code (2 bytes) | reason
+//	UDP_SEALED_CLOSE | code and reason encrypted with the session key
+//
+// The frames are the ones of the websocket, already encrypted, a lost one
+// is a lost packet for the traffic inside. Their nonce counts them, so a
+// UDP_DATA played again fails to decrypt (see crypto.REPLAY_WINDOW).
+//
+// A session is the address of the client, from its hello until a close or
+// DeadTimeout (UDP_IDLE_TIMEOUTS keepalives) without a datagram.
+//
+// A close is sealed once the session has a key. A plain one may come from
+// anyone knowing the addresses: the server ignores it for an authenticated
+// session, the client takes it as a reason to connect again, never to give
+// up (see CloseError.Unsigned).
+const (
+	UDP_HELLO        = 1
+	UDP_WELCOME      = 2
+	UDP_DATA         = 3
+	UDP_PING         = 4
+	UDP_PONG         = 5
+	UDP_CLOSE        = 6
+	UDP_SEALED_CLOSE = 7
+
+	// UDP_HELLO_MIN pads the hello, the server only answers ones at least
+	// this large so a spoofed source does not get more than it sent
+	UDP_HELLO_MIN    = 1200
+	UDP_HELLO_RETRY  = time.Second
+	UDP_DIAL_TIMEOUT = 10 * time.Second
+
+	// UDP_KEEPALIVE is used when TUN.KeepAlive is 0, the NATs on the way
+	// forget an idle binding quickly
+	UDP_KEEPALIVE     = 10 * time.Second
+	UDP_IDLE_TIMEOUTS = 3
+
+	UDP_MAX_DATAGRAM = 65535
+)
+
+type udpHello struct {
+	Protocol   string `json:"protocol"`
+	Token      string `json:"token"`
+	PublicIP   string `json:"public_ip,omitempty"`
+	ClientTime int64  `json:"client_time"`
+}
+
+type udpWelcome struct {
+	Handshake  string `json:"handshake,omitempty"`
+	ServerTime int64  `json:"server_time"`
+}
+
+func udpFrame(kind byte, data []byte) []byte {
+	frame := make([]byte, 1+len(data))
+	frame[0] = kind
+	copy(frame[1:], data)
+	return frame
+}
+
+// udpCloseFrame is a close sealed with key, or a plain one without it.
+func udpCloseFrame(key *crypto.Session, code int, reason string) []byte {
+	body := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(body, uint16(code))
+	copy(body[2:], reason)
+	if key != nil {
+		sealed, err := key.Encrypt(body)
+		if err == nil {
+			return udpFrame(UDP_SEALED_CLOSE, sealed)
+		}
+	}
+	return udpFrame(UDP_CLOSE, body)
+}
+
+// readUDPClose reads a close frame, nil for a sealed one key does not open.
+func readUDPClose(frame []byte, key *crypto.Session) *CloseError {
+	body := frame[1:]
+	sealed := frame[0] == UDP_SEALED_CLOSE
+	if sealed {
+		if key == nil {
+			return nil
+		}
+		var err error
+		body, err = key.Decrypt(body)
+		if err != nil {
+			return nil
+		}
+	}
+	if len(body) < 2 {
+		return &CloseError{Code: CLOSE_GOING_AWAY, Unsigned: !sealed}
+	}
+	return &CloseError{Code: int(binary.BigEndian.Uint16(body)), Reason: string(body[2:]), Unsigned: !sealed}
+}
+
+func (t *TUN) udpKeepAlive() time.Duration {
+	if t.KeepAlive > 0 {
+		return t.KeepAlive
+	}
+	return UDP_KEEPALIVE
+}
+
+// udpDeadTimeout is deadTimeout with the keepalive of UDP, always on.
+func (t *TUN) udpDeadTimeout() time.Duration {
+	if t.DeadTimeout > 0 {
+		return t.DeadTimeout
+	}
+	return t.udpKeepAlive() * UDP_IDLE_TIMEOUTS
+}
+
+type tunUDP struct {
+	parent        *TUN
+	writeTunToDev func(key *crypto.Session, data []byte)
+	authen        func(id string, conn interface{}) (string, *crypto.Session, func(id string))
+	handshake     func(token string) (string, bool)
+
+	// server
+	conn     *net.UDPConn
+	done     chan struct{}
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+func (self *tunUDP) OnFuncWriteTunToDev(f func(key *crypto.Session, data []byte)) {
+	self.writeTunToDev = f
+}
+
+func (self *tunUDP) WriteDevToTun(conn interface{}, data []byte) error {
+	return conn.(*sessionQueue).push(data)
+}
+
+func (self *tunUDP) OnAuthen(f func(id string, conn interface{}) (string, *crypto.Session, func(id string))) {
+	self.authen = f
+}
+
+func (self *tunUDP) OnHandshake(f func(token string) (string, bool)) {
+	self.handshake = f
+}
+
+// udpSession is a client of the server, ready once authenticated.
+type udpSession struct {
+	addr     *net.UDPAddr
+	hello    string
+	welcome  []byte
+	key      *crypto.Session
+	ready    int32
+	lastSeen int64
+
+	mu      sync.Mutex
+	q       *sessionQueue
+	cancel  func(id string)
+	ended   bool
+	endOnce sync.Once
+}
+
+func (s *udpSession) seen(now time.Time) {
+	atomic.StoreInt64(&s.lastSeen, now.UnixNano())
+}
+
+func (t *tunUDP) send(addr *net.UDPAddr, frame []byte) error {
+	_, err := t.conn.WriteToUDP(frame, addr)
+	return err
+}
+
+// serve reads the datagrams of every client until the socket is closed.
+func (t *tunUDP) serve() error {
+	go t.reapIdle()
+	defer t.endAll()
+	defer close(t.done)
+
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	for {
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("udp server closed")
+			}
+			log.Debug("read udp error:", err)
+			continue
+		}
+		if n < 1 || !t.parent.allowSource(addr.IP) {
+			continue
+		}
+		frame := make([]byte, n)
+		copy(frame, buf[:n])
+		t.dispatch(addr, frame)
+	}
+}
+
+func (t *tunUDP) dispatch(addr *net.UDPAddr, frame []byte) {
+	t.mu.Lock()
+	s := t.sessions[addr.String()]
+	t.mu.Unlock()
+
+	if frame[0] == UDP_HELLO {
+		t.hello(s, addr, frame)
+		return
+	}
+	if s == nil {
+		// a server restart, the client connects again at once. Only data
+		// as large as a hello is answered, so a spoofed source gets less
+		// than it sent, the others find out with DeadTimeout
+		if frame[0] == UDP_DATA && len(frame) >= UDP_HELLO_MIN {
+			t.send(addr, udpCloseFrame(nil, CLOSE_TRY_AGAIN_LATER, "no session"))
+		}
+		return
+	}
+	if atomic.LoadInt32(&s.ready) == 0 {
+		// still authenticating
+		return
+	}
+
+	s.seen(t.parent.clock().Now())
+	switch frame[0] {
+	case UDP_DATA:
+		t.writeTunToDev(s.key, frame[1:])
+	case UDP_PING:
+		t.send(addr, []byte{UDP_PONG})
+	case UDP_CLOSE:
+		log.Debug("Ignored an unsealed close for the udp session of", addr)
+	case UDP_SEALED_CLOSE:
+		if readUDPClose(frame, s.key) != nil {
+			t.end(s, 0, "")
+		}
+	}
+}
+
+func (t *tunUDP) hello(s *udpSession, addr *net.UDPAddr, frame []byte) {
+	if len(frame) < UDP_HELLO_MIN || len(frame) < 3 {
+		return
+	}
+	if s != nil {
+		if s.hello == string(frame) {
+			// the welcome got lost, or the hello is still authenticating
+			if atomic.LoadInt32(&s.ready) == 1 {
+				t.send(addr, s.welcome)
+			}
+			return
+		}
+		// the client connects again from the same address
+		t.end(s, CLOSE_GOING_AWAY, "")
+	}
+
+	size := int(binary.BigEndian.Uint16(frame[1:]))
+	if 3+size > len(frame) {
+		return
+	}
+	var h udpHello
+	if json.Unmarshal(frame[3:3+size], &h) != nil {
+		return
+	}
+	status, reason := t.parent.checkProtocol(h.Protocol)
+	if status != 0 {
+		log.Debug("Refused udp client", addr, "with", reason)
+		if status != http.StatusNotFound {
+			t.send(addr, udpCloseFrame(nil, CLOSE_POLICY_VIOLATION, reason))
+		}
+		return
+	}
+
+	s = &udpSession{addr: addr, hello: string(frame)}
+	s.seen(t.parent.clock().Now())
+	t.mu.Lock()
+	t.sessions[addr.String()] = s
+	t.mu.Unlock()
+	go t.authenticate(s, h)
+}
+
+func (t *tunUDP) authenticate(s *udpSession, h udpHello) {
+	var welcome udpWelcome
+	if t.handshake != nil {
+		welcome.Handshake, _ = t.handshake(h.Token)
+	}
+	welcome.ServerTime = t.parent.clock().Now().Unix()
+	data, _ := json.Marshal(welcome)
+	s.welcome = udpFrame(UDP_WELCOME, data)
+
+	q := t.parent.newSessionQueue(func(data []byte) error {
+		return t.send(s.addr, udpFrame(UDP_DATA, data))
+	}, func(code int, reason string) error {
+		t.finish(s, code, reason)
+		return nil
+	})
+	s.mu.Lock()
+	s.q = q
+	s.mu.Unlock()
+	q.remoteAddr = s.addr.String()
+	q.publicIP = h.PublicIP
+	if h.ClientTime > 0 {
+		q.clientTime = time.Unix(h.ClientTime, 0)
+	}
+	t.send(s.addr, s.welcome)
+
+	idRequest, key, cancel := t.authen(h.Token, q)
+	if len(idRequest) < 1 {
+		// unless authen said why
+		q.Close(CLOSE_AUTH_FAILED, ERROR_AUTHENTICATION_FAILED)
+		return
+	}
+	q.setID(idRequest)
+
+	s.mu.Lock()
+	if s.ended {
+		// closed while authenticating
+		s.mu.Unlock()
+		cancel(idRequest)
+		return
+	}
+	s.key = key
+	s.cancel = cancel
+	atomic.StoreInt32(&s.ready, 1)
+	s.mu.Unlock()
+}
+
+// end closes the session of a client through its queue, telling the
+// client why unless code is 0.
+func (t *tunUDP) end(s *udpSession, code int, reason string) {
+	s.mu.Lock()
+	q := s.q
+	s.mu.Unlock()
+	if q != nil {
+		q.Close(code, reason)
+		return
+	}
+	t.finish(s, code, reason)
+}
+
+// finish forgets a closed session, once.
+func (t *tunUDP) finish(s *udpSession, code int, reason string) {
+	s.endOnce.Do(func() {
+		t.mu.Lock()
+		if t.sessions[s.addr.String()] == s {
+			delete(t.sessions, s.addr.String())
+		}
+		t.mu.Unlock()
+
+		s.mu.Lock()
+		s.ended = true
+		key := s.key
+		cancel := s.cancel
+		s.mu.Unlock()
+
+		if code != 0 {
+			t.send(s.addr, udpCloseFrame(key, code, reason))
+		}
+		if cancel != nil {
+			cancel(s.q.sessionID())
+		}
+	})
+}
+
+func (t *tunUDP) endAll() {
+	t.mu.Lock()
+	var list []*udpSession
+	for _, s := range t.sessions {
+		list = append(list, s)
+	}
+	t.mu.Unlock()
+
+	for _, s := range list {
+		t.end(s, CLOSE_GOING_AWAY, "")
+	}
+}
+
+// reapIdle ends the sessions of the clients gone silent, until the socket
+// is closed.
+func (t *tunUDP) reapIdle() {
+	clock := t.parent.clock()
+	for {
+		select {
+		case <-clock.After(t.parent.udpKeepAlive()):
+		case <-t.done:
+			return
+		}
+		idle := clock.Now().Add(-t.parent.udpDeadTimeout()).UnixNano()
+
+		t.mu.Lock()
+		var list []*udpSession
+		for _, s := range t.sessions {
+			if atomic.LoadInt64(&s.lastSeen) < idle {
+				list = append(list, s)
+			}
+		}
+		t.mu.Unlock()
+
+		for _, s := range list {
+			log.Debug("Udp session of", s.addr, "idle, close it")
+			t.end(s, CLOSE_GOING_AWAY, "idle")
+		}
+	}
+}
+
+// dial sends the hello until the server welcomes it.
+func (t *tunUDP) dial(c *net.UDPConn, token string) error {
+	data, err := json.Marshal(udpHello{
+		Protocol:   t.parent.protocol(),
+		Token:      token,
+		PublicIP:   t.parent.PublicIP,
+		ClientTime: t.parent.clock().Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	size := 3 + len(data)
+	if size < UDP_HELLO_MIN {
+		size = UDP_HELLO_MIN
+	}
+	hello := make([]byte, size)
+	hello[0] = UDP_HELLO
+	binary.BigEndian.PutUint16(hello[1:], uint16(len(data)))
+	copy(hello[3:], data)
+
+	// until the server listens the hello may come back as a refused
+	// connection, tried again like a lost one
+	var lastErr error = fmt.Errorf("timeout")
+	clock := t.parent.clock()
+	deadline := clock.Now().Add(UDP_DIAL_TIMEOUT)
+	for clock.Now().Before(deadline) {
+		retry := clock.After(UDP_HELLO_RETRY)
+		welcomed, err := t.sendHello(c, hello, UDP_HELLO_RETRY)
+		if welcomed || err != nil {
+			var closeErr *CloseError
+			if welcomed || errors.As(err, &closeErr) {
+				return err
+			}
+			lastErr = err
+		}
+		<-retry
+	}
+	return lastErr
+}
+
+// sendHello sends the hello once and reads the answer for wait.
+func (t *tunUDP) sendHello(c *net.UDPConn, hello []byte, wait time.Duration) (bool, error) {
+	_, err := c.Write(hello)
+	if err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	c.SetReadDeadline(time.Now().Add(wait))
+	defer c.SetReadDeadline(time.Time{})
+	for {
+		n, err := c.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if n < 1 {
+			continue
+		}
+		switch buf[0] {
+		case UDP_WELCOME:
+			var w udpWelcome
+			if json.Unmarshal(buf[1:n], &w) == nil {
+				t.parent.Handshake = w.Handshake
+				t.parent.ServerTime = time.Unix(w.ServerTime, 0)
+			}
+			return true, nil
+		case UDP_CLOSE:
+			return false, readUDPClose(buf[:n], nil)
+		}
+	}
+}
+
+func (t *tunUDP) handlerServer(token string, c *net.UDPConn) error {
+	defer c.Close()
+
+	var keyMu sync.Mutex
+	var key *crypto.Session
+	q := t.parent.newSessionQueue(func(data []byte) error {
+		_, err := c.Write(udpFrame(UDP_DATA, data))
+		return err
+	}, func(code int, reason string) error {
+		keyMu.Lock()
+		sealWith := key
+		keyMu.Unlock()
+		c.Write(udpCloseFrame(sealWith, code, reason))
+		return c.Close()
+	})
+	defer q.close()
+
+	idReq, sessionKey, cancel := t.authen(token, q)
+	q.setID(idReq)
+	keyMu.Lock()
+	key = sessionKey
+	keyMu.Unlock()
+
+	every := t.parent.udpKeepAlive()
+	clock := t.parent.clock()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-clock.After(every):
+				c.Write([]byte{UDP_PING})
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var closeErr error
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	for {
+		c.SetReadDeadline(time.Now().Add(t.parent.udpDeadTimeout()))
+		n, err := c.Read(buf)
+		if err != nil {
+			log.Error("Cannot reach the server !", err)
+			break
+		}
+		if n < 1 {
+			continue
+		}
+		if buf[0] == UDP_CLOSE || buf[0] == UDP_SEALED_CLOSE {
+			e := readUDPClose(buf[:n], key)
+			if e == nil {
+				// not sealed with our key
+				continue
+			}
+			closeErr = e
+			log.Error(closeErr)
+			break
+		}
+		if buf[0] == UDP_DATA {
+			frame := make([]byte, n-1)
+			copy(frame, buf[1:n])
+			t.writeTunToDev(key, frame)
+		}
+	}
+	cancel(idReq)
+	return closeErr
+}
+
+// createUDP is createWebSocket over UDP datagrams, see UDP_HELLO.
+func (t *TUN) createUDP(addr, token string) (newTun *tunUDP, runFunc func() error, err error) {
+	newTun = &tunUDP{parent: t, done: make(chan struct{}), sessions: make(map[string]*udpSession, 0)}
+	if token == "" {
+		lc := net.ListenConfig{Control: t.markSocket}
+		var pc net.PacketConn
+		pc, err = lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			return
+		}
+		newTun.conn = pc.(*net.UDPConn)
+
+		runFunc = func() error {
+			log.Info("Server listening on udp", addr)
+			t.onShutdown(newTun.conn.Close)
+			return newTun.serve()
+		}
+		return
+	}
+
+	log.Info("Connecting to udp", addr, "...")
+	dialer := net.Dialer{Control: t.markSocket}
+	var c net.Conn
+	c, err = dialer.Dial("udp", addr)
+	if err != nil {
+		return
+	}
+	err = newTun.dial(c.(*net.UDPConn), token)
+	if err != nil {
+		c.Close()
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) {
+			err = fmt.Errorf("dial udp %s error: %v", addr, err)
+		}
+		return
+	}
+
+	runFunc = func() error {
+		return newTun.handlerServer(token, c.(*net.UDPConn))
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package connection
+
+import (
+	"hivpn/crypto"
+	"net"
+	"testing"
+	"time"
+)
+
+func testSession(t *testing.T, key string) *crypto.Session {
+	s, err := crypto.NewSession([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestUDPCloseSealed(t *testing.T) {
+	key := testSession(t, "0123456789abcdef0123456789abcdef")
+	other := testSession(t, "fedcba9876543210fedcba9876543210")
+
+	e := readUDPClose(udpCloseFrame(key, CLOSE_AUTH_FAILED, "bye"), key)
+	if e == nil || e.Code != CLOSE_AUTH_FAILED || e.Reason != "bye" || e.Unsigned || Retryable(e) {
+		t.Errorf("sealed close read as %+v", e)
+	}
+	if e := readUDPClose(udpCloseFrame(key, CLOSE_AUTH_FAILED, "bye"), other); e != nil {
+		t.Errorf("close sealed with another key read as %+v", e)
+	}
+
+	// what anyone knowing the addresses can send
+	e = readUDPClose(udpCloseFrame(nil, CLOSE_AUTH_FAILED, "bye"), key)
+	if e == nil || !e.Unsigned || !Retryable(e) {
+		t.Errorf("plain close read as %+v, the client would give up", e)
+	}
+}
+
+// testUDPServer is a udp server without its read loop, dispatch is called
+// directly, and the socket of a client to see what it answers.
+func testUDPServer(t *testing.T) (*tunUDP, *net.UDPConn) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		client.Close()
+	})
+	return &tunUDP{parent: &TUN{}, conn: conn, done: make(chan struct{}), sessions: make(map[string]*udpSession, 0)}, client
+}
+
+// answered returns the first byte of what client got within a while, 0 for
+// nothing.
+func answered(client *net.UDPConn) byte {
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := client.Read(buf)
+	if err != nil || n < 1 {
+		return 0
+	}
+	return buf[0]
+}
+
+func TestUDPUnsealedCloseIgnored(t *testing.T) {
+	server, client := testUDPServer(t)
+	addr := client.LocalAddr().(*net.UDPAddr)
+	key := testSession(t, "0123456789abcdef0123456789abcdef")
+
+	s := &udpSession{addr: addr, key: key, ready: 1}
+	s.q = server.parent.newSessionQueue(func(data []byte) error { return nil }, func(code int, reason string) error {
+		server.finish(s, code, reason)
+		return nil
+	})
+	server.sessions[addr.String()] = s
+
+	server.dispatch(addr, udpCloseFrame(nil, CLOSE_GOING_AWAY, ""))
+	server.dispatch(addr, udpCloseFrame(testSession(t, "fedcba9876543210fedcba9876543210"), CLOSE_GOING_AWAY, ""))
+	if server.sessions[addr.String()] != s {
+		t.Fatal("session ended by a close not sealed with its key")
+	}
+
+	server.dispatch(addr, udpCloseFrame(key, CLOSE_GOING_AWAY, ""))
+	if server.sessions[addr.String()] != nil {
+		t.Fatal("session not ended by its sealed close")
+	}
+}
+
+func TestUDPNoReflection(t *testing.T) {
+	server, client := testUDPServer(t)
+	addr := client.LocalAddr().(*net.UDPAddr)
+
+	for _, frame := range [][]byte{{UDP_PING}, udpFrame(UDP_DATA, make([]byte, 100)), udpCloseFrame(nil, CLOSE_GOING_AWAY, "")} {
+		server.dispatch(addr, frame)
+		if kind := answered(client); kind != 0 {
+			t.Errorf("datagram %d of %d bytes from an unknown source answered with %d", frame[0], len(frame), kind)
+		}
+	}
+
+	// a client of the server before its restart, told to connect again
+	server.dispatch(addr, udpFrame(UDP_DATA, make([]byte, UDP_HELLO_MIN)))
+	if kind := answered(client); kind != UDP_CLOSE {
+		t.Errorf("full datagram from an unknown source answered with %d, want a close", kind)
+	}
+}
@@ -1,106 +1,271 @@
 package connection
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"hivpn/crypto"
 	"hivpn/log"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/fasthttp/websocket"
 )
 
 const (
-	WEBSOCKET_PATH = "/tunnel"
-	AUTHEN_HEADER  = "User"
+	WEBSOCKET_PATH   = "/tunnel"
+	AUTHEN_HEADER    = "User"
+	PUBLIC_IP_HEADER = "Public-Ip"
+	HANDSHAKE_HEADER = "Handshake"
+
+	// CLIENT_TIME_HEADER is the unix time of the client when it connects,
+	// for the server to see how far their clocks are
+	CLIENT_TIME_HEADER = "Client-Time"
+
+	CLOSE_TIMEOUT = time.Second
 )
 
 var upgrader = websocket.Upgrader{}
 
 type tunWebsocket struct {
-	writeTunToDev func(key, data []byte)
-	authen        func(id string, conn interface{}) (string, []byte, func(id string))
+	parent        *TUN
+	writeTunToDev func(key *crypto.Session, data []byte)
+	authen        func(id string, conn interface{}) (string, *crypto.Session, func(id string))
+	handshake     func(token string) (string, bool)
 }
 
-func (self *tunWebsocket) OnFuncWriteTunToDev(f func(key, data []byte)) {
+func (self *tunWebsocket) OnFuncWriteTunToDev(f func(key *crypto.Session, data []byte)) {
 	self.writeTunToDev = f
 }
 
 func (self *tunWebsocket) WriteDevToTun(conn interface{}, data []byte) error {
-	return conn.(*websocket.Conn).WriteMessage(websocket.BinaryMessage, data)
+	return conn.(*sessionQueue).push(data)
 }
 
-func (self *tunWebsocket) OnAuthen(f func(id string, conn interface{}) (string, []byte, func(id string))) {
+func (self *tunWebsocket) OnAuthen(f func(id string, conn interface{}) (string, *crypto.Session, func(id string))) {
 	self.authen = f
 }
 
+func (self *tunWebsocket) OnHandshake(f func(token string) (string, bool)) {
+	self.handshake = f
+}
+
+// ServeHTTP hands the websocket upgrades to the tunnel, anything else gets
+// the disguise, or a plain 404.
+func (t *tunWebsocket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == t.parent.path() && websocket.IsWebSocketUpgrade(r) {
+		status, reason := t.parent.checkProtocol(r.Header.Get(PROTOCOL_HEADER))
+		switch status {
+		case 0:
+			t.handlerClient(w, r)
+			return
+		case http.StatusUpgradeRequired:
+			log.Info("Refused client", r.RemoteAddr, "with", reason)
+			http.Error(w, reason, status)
+			return
+		}
+		log.Debug("Refused connection from", r.RemoteAddr, "with", reason)
+	}
+	t.serveDisguise(w, r)
+}
+
+func (t *tunWebsocket) serveDisguise(w http.ResponseWriter, r *http.Request) {
+	if t.parent.Disguise != nil {
+		t.parent.Disguise.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// handlerClient checks the token before the upgrade. The magic already told
+// a hivpn client, a refused token is upgraded and closed with
+// CLOSE_AUTH_FAILED so the client gives up instead of retrying.
 func (t *tunWebsocket) handlerClient(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+	token := r.Header.Get(AUTHEN_HEADER)
+
+	var headerResp http.Header
+	ok := true
+	if t.handshake != nil {
+		var handshake string
+		handshake, ok = t.handshake(token)
+		if !ok {
+			log.Debug("Refused token from", r.RemoteAddr)
+		} else if len(handshake) > 0 {
+			headerResp = http.Header{HANDSHAKE_HEADER: []string{handshake}}
+		}
+	}
+
+	c, err := upgrader.Upgrade(w, r, headerResp)
 	if err != nil {
 		log.Debug("Upgrade socket error:", err)
 		return
 	}
 	defer c.Close()
 
-	token := r.Header.Get(AUTHEN_HEADER)
-	idRequest, key, cancel := t.authen(token, c)
+	q := t.newQueue(c)
+	defer q.close()
+	if !ok {
+		q.Close(CLOSE_AUTH_FAILED, ERROR_AUTHENTICATION_FAILED)
+		return
+	}
+	q.remoteAddr = c.RemoteAddr().String()
+	if len(t.parent.ClientIPHeader) > 0 {
+		if ip := net.ParseIP(r.Header.Get(t.parent.ClientIPHeader)); ip != nil {
+			q.remoteAddr = net.JoinHostPort(ip.String(), "0")
+		}
+	}
+	q.publicIP = r.Header.Get(PUBLIC_IP_HEADER)
+	if sec, err := strconv.ParseInt(r.Header.Get(CLIENT_TIME_HEADER), 10, 64); err == nil {
+		q.clientTime = time.Unix(sec, 0)
+	}
+
+	idRequest, key, cancel := t.authen(token, q)
 
 	if len(idRequest) < 1 {
+		// unless authen said why
+		q.Close(CLOSE_AUTH_FAILED, ERROR_AUTHENTICATION_FAILED)
 		return
 	}
+	q.setID(idRequest)
 
+	stopKeepAlive := t.parent.keepAlive(c)
+	defer stopKeepAlive()
+	alive := t.parent.watchDead(c)
 	for {
 		_, frame, err := c.ReadMessage()
 		if err != nil {
-			log.Debug("read message err:", err)
+			if isDead(err) {
+				log.Info("Session of", idRequest, "from", q.remoteAddr, "dead, silent for", t.parent.deadTimeout())
+			} else {
+				log.Debug("read message err:", err)
+			}
 			break
 		}
+		alive()
 
 		t.writeTunToDev(key, frame)
 	}
 	cancel(idRequest)
 }
 
-func (t *tunWebsocket) handlerServer(token string, c *websocket.Conn) {
+func (t *tunWebsocket) handlerServer(token string, c *websocket.Conn) error {
 	defer c.Close()
-	idReq, key, cancel := t.authen(token, c)
 
+	q := t.newQueue(c)
+	defer q.close()
+
+	idReq, key, cancel := t.authen(token, q)
+	q.setID(idReq)
+
+	stopKeepAlive := t.parent.keepAlive(c)
+	defer stopKeepAlive()
+	alive := t.parent.watchDead(c)
+	var closeErr error
 	for {
 		_, message, err := c.ReadMessage()
 		if err != nil {
-			log.Error("Authentication failed Or Cannot connect to the server !", err)
+			var wsErr *websocket.CloseError
+			if isDead(err) {
+				log.Error("Cannot reach the server ! Silent for", t.parent.deadTimeout())
+			} else if errors.As(err, &wsErr) && wsErr.Code != websocket.CloseAbnormalClosure {
+				closeErr = &CloseError{Code: wsErr.Code, Reason: wsErr.Text}
+				log.Error(closeErr)
+			} else {
+				log.Error("Authentication failed Or Cannot connect to the server !", err)
+			}
 			break
 		}
+		alive()
 
 		t.writeTunToDev(key, message)
 	}
 	cancel(idReq)
+	return closeErr
+}
+
+func (t *tunWebsocket) newQueue(c *websocket.Conn) *sessionQueue {
+	return t.parent.newSessionQueue(func(data []byte) error {
+		return c.WriteMessage(websocket.BinaryMessage, data)
+	}, func(code int, reason string) error {
+		msg := websocket.FormatCloseMessage(code, reason)
+		c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(CLOSE_TIMEOUT))
+		return c.Close()
+	})
+}
+
+// markSocket sets the DSCP of a socket of the transport, the accepted
+// connections inherit it from the listener.
+func (t *TUN) markSocket(network, address string, c syscall.RawConn) error {
+	if t.DSCP == 0 {
+		return nil
+	}
+
+	err := setTOS(network, c, t.DSCP<<2)
+	if err != nil {
+		log.Error("set dscp error:", err)
+	}
+	return nil
 }
 
 func (t *TUN) createWebSocket(addr, token string) (newTun *tunWebsocket, runFunc func() error, err error) {
-	newTun = new(tunWebsocket)
+	newTun = &tunWebsocket{parent: t}
 	if token == "" {
-		http.HandleFunc(WEBSOCKET_PATH, newTun.handlerClient)
+
+		// bound right away so the port is taken while the process may
+		// still be privileged
+		var ln net.Listener
+		lc := net.ListenConfig{Control: t.markSocket}
+		ln, err = lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return
+		}
+		if len(t.AllowedSources) > 0 {
+			ln = &sourceListener{Listener: ln, allowed: t.AllowedSources}
+		}
 
 		runFunc = func() error {
 			log.Info("Server listening on", addr)
-			return http.ListenAndServe(addr, nil)
+			srv := &http.Server{Addr: addr, Handler: newTun, TLSConfig: t.TLSConfig}
+			t.onShutdown(srv.Close)
+			if t.TLSConfig != nil {
+				return srv.ServeTLS(ln, "", "")
+			}
+			return srv.Serve(ln)
 		}
 	} else {
 		log.Info("Connecting to", addr, "...")
 		var c *websocket.Conn
 		var resp *http.Response
-		u := url.URL{Scheme: "ws", Host: addr, Path: WEBSOCKET_PATH}
+		u := url.URL{Scheme: "ws", Host: addr, Path: t.path()}
+		dialer := *websocket.DefaultDialer
+		dialer.NetDialContext = (&net.Dialer{Control: t.markSocket}).DialContext
+		if t.TLS {
+			u.Scheme = "wss"
+			// addr is the resolved ip, the certificate is for the name
+			dialer.TLSClientConfig = &tls.Config{ServerName: t.HostHeader}
+		}
 
 		headerReq := http.Header{
-			AUTHEN_HEADER: []string{token},
+			PROTOCOL_HEADER: []string{t.protocol()},
+			AUTHEN_HEADER:   []string{token},
 		}
 
 		if len(t.HostHeader) > 0 {
 			headerReq["Host"] = []string{t.HostHeader}
 		}
 
-		c, resp, err = websocket.DefaultDialer.Dial(u.String(), headerReq)
+		if len(t.PublicIP) > 0 {
+			headerReq[PUBLIC_IP_HEADER] = []string{t.PublicIP}
+		}
+		headerReq[CLIENT_TIME_HEADER] = []string{strconv.FormatInt(t.clock().Now().Unix(), 10)}
+
+		c, resp, err = dialer.Dial(u.String(), headerReq)
 		if err != nil {
 			var b []byte
 			if resp != nil {
@@ -112,10 +277,13 @@ func (t *TUN) createWebSocket(addr, token string) (newTun *tunWebsocket, runFunc
 			err = fmt.Errorf("dial %s error: %s \n%s", u.String(), err.Error(), string(b))
 			return
 		}
+		t.Handshake = resp.Header.Get(HANDSHAKE_HEADER)
+		if serverTime, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+			t.ServerTime = serverTime
+		}
 
 		runFunc = func() error {
-			newTun.handlerServer(token, c)
-			return nil
+			return newTun.handlerServer(token, c)
 		}
 
 	}
@@ -0,0 +1,59 @@
+package connection
+
+import (
+	"errors"
+	"hivpn/crypto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+)
+
+func TestWebsocketBadToken(t *testing.T) {
+	parent := &TUN{Disguise: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "just a web site")
+	})}
+	tun := &tunWebsocket{parent: parent}
+	tun.OnHandshake(func(token string) (string, bool) {
+		return "", token == "good"
+	})
+	tun.OnAuthen(func(token string, conn interface{}) (string, *crypto.Session, func(id string)) {
+		t.Fatal("refused token authenticated")
+		return "", nil, nil
+	})
+
+	server := httptest.NewServer(tun)
+	defer server.Close()
+	url := "ws" + server.URL[len("http"):] + parent.path()
+
+	// a client with a wrong password is told so and gives up
+	c, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		PROTOCOL_HEADER: []string{parent.protocol()},
+		AUTHEN_HEADER:   []string{"bad"},
+	})
+	if err != nil {
+		t.Fatal("refused token not upgraded:", err)
+	}
+	_, _, err = c.ReadMessage()
+	c.Close()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CLOSE_AUTH_FAILED {
+		t.Fatalf("refused token read %v, want close %d", err, CLOSE_AUTH_FAILED)
+	}
+
+	// without the magic it is no hivpn client and gets the disguise
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{
+		PROTOCOL_HEADER: []string{"other/1"},
+		AUTHEN_HEADER:   []string{"bad"},
+	})
+	if err == nil {
+		t.Fatal("websocket upgraded without the magic")
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "just a web site" {
+		t.Errorf("unknown protocol got %d %q, not the disguise", resp.StatusCode, body)
+	}
+}
@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -8,40 +9,86 @@ import (
 	"io"
 )
 
-func AESEncrypt(key []byte, plaintext []byte) ([]byte, error) {
+// A message of AESEncrypt is
+//
+//	nonce (GCM_NONCE_LEN bytes) | ciphertext | tag (GCM_TAG_LEN bytes)
+//
+// with AES-GCM and a random nonce, AESDecrypt fails on any change to it.
+// The packets of a Session use a counter instead, see NONCE_PREFIX_LEN.
+const (
+	GCM_NONCE_LEN = 12
+	GCM_TAG_LEN   = 16
+)
+
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+func AESEncrypt(key []byte, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
 		return nil, err
 	}
 
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], plaintext)
+	return seal(aead, nil, plaintext)
+}
 
-	return ciphertext, nil
+// seal encrypts plaintext with a random nonce and authenticates it along
+// with ad.
+func seal(aead cipher.AEAD, ad, plaintext []byte) ([]byte, error) {
+	ciphertext := make([]byte, GCM_NONCE_LEN, GCM_NONCE_LEN+len(plaintext)+GCM_TAG_LEN)
+	if _, err := io.ReadFull(rand.Reader, ciphertext); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(ciphertext, ciphertext, plaintext, ad), nil
 }
 
+// AESDecrypt opens a message of AESEncrypt in place.
 func AESDecrypt(key []byte, cryptoText []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+	aead, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
+	return open(aead, nil, cryptoText)
+}
 
-	if len(cryptoText) < aes.BlockSize {
+// open is the reverse of seal, in place.
+func open(aead cipher.AEAD, ad, cryptoText []byte) ([]byte, error) {
+	if len(cryptoText) < GCM_NONCE_LEN+GCM_TAG_LEN {
 		return nil, fmt.Errorf("message error")
 	}
 
-	iv := cryptoText[:aes.BlockSize]
-	cryptoText = cryptoText[aes.BlockSize:]
+	nonce := cryptoText[:GCM_NONCE_LEN]
+	cryptoText = cryptoText[GCM_NONCE_LEN:]
+
+	plaintext, err := aead.Open(cryptoText[:0], nonce, cryptoText, ad)
+	if err != nil {
+		return nil, fmt.Errorf("message authentication failed")
+	}
+	return plaintext, nil
+}
 
-	stream := cipher.NewCFBDecrypter(block, iv)
+// SelfTest encrypts and decrypts a known vector with key to catch a broken
+// key or cipher before any traffic goes through it.
+func SelfTest(key []byte) error {
+	vector := []byte("hivpn self-test vector")
+	cryptoText, err := AESEncrypt(key, vector)
+	if err != nil {
+		return err
+	}
 
-	stream.XORKeyStream(cryptoText, cryptoText)
+	plainText, err := AESDecrypt(key, cryptoText)
+	if err != nil {
+		return err
+	}
 
-	return cryptoText, nil
+	if !bytes.Equal(plainText, vector) {
+		return fmt.Errorf("decrypted data does not match")
+	}
+	return nil
 }
@@ -0,0 +1,101 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzAESRoundTrip(f *testing.F) {
+	f.Add([]byte("0123456789abcdef0123456789abcdef"), []byte("hello"))
+	f.Add([]byte("0123456789abcdef"), []byte{})
+	f.Add([]byte("0123456789abcdef01234567"), bytes.Repeat([]byte{0x45}, 1500))
+	f.Fuzz(func(t *testing.T, key, plaintext []byte) {
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			if _, err := AESEncrypt(key, plaintext); err == nil {
+				t.Fatalf("key of %d bytes accepted", len(key))
+			}
+			return
+		}
+
+		cryptoText, err := AESEncrypt(key, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cryptoText) != GCM_NONCE_LEN+len(plaintext)+GCM_TAG_LEN {
+			t.Fatalf("%d bytes of ciphertext for %d of plaintext", len(cryptoText), len(plaintext))
+		}
+
+		tampered := append([]byte(nil), cryptoText...)
+		tampered[len(tampered)-1] ^= 1
+
+		decrypted, err := AESDecrypt(key, cryptoText)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("round trip changed the data")
+		}
+
+		if _, err := AESDecrypt(key, tampered); err == nil {
+			t.Fatal("tampered message accepted")
+		}
+	})
+}
+
+// FuzzAESDecrypt feeds peer data to AESDecrypt, which must fail without
+// panicking on anything it did not encrypt.
+func FuzzAESDecrypt(f *testing.F) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	valid, _ := AESEncrypt(key, []byte("hello"))
+	f.Add(valid)
+	f.Add([]byte{})
+	f.Add(make([]byte, GCM_NONCE_LEN+GCM_TAG_LEN-1))
+	f.Fuzz(func(t *testing.T, cryptoText []byte) {
+		AESDecrypt(key, cryptoText)
+	})
+}
+
+func TestAESDecrypt(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	plaintext := []byte("a packet going through the tunnel")
+	valid, err := AESEncrypt(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := func(i int) []byte {
+		tampered := append([]byte(nil), valid...)
+		tampered[i] ^= 1
+		return tampered
+	}
+
+	tests := []struct {
+		name       string
+		key        []byte
+		cryptoText []byte
+		ok         bool
+	}{
+		{"round trip", key, valid, true},
+		{"tampered nonce", key, change(0), false},
+		{"tampered ciphertext", key, change(GCM_NONCE_LEN), false},
+		{"tampered tag", key, change(len(valid) - 1), false},
+		{"truncated nonce", key, valid[:GCM_NONCE_LEN-1], false},
+		{"truncated tag", key, valid[:len(valid)-1], false},
+		{"nonce and tag only", key, valid[:GCM_NONCE_LEN+GCM_TAG_LEN], false},
+		{"empty", key, nil, false},
+		{"other key", []byte("fedcba9876543210fedcba9876543210"), valid, false},
+	}
+	for _, test := range tests {
+		got, err := AESDecrypt(test.key, append([]byte(nil), test.cryptoText...))
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: decrypted to %q", test.name, got)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("%s: got %q, %v, want %q", test.name, got, err, plaintext)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The AES key of a user is derived from its password with scrypt, so a
+// token seen on the wire costs KDF_N rounds per guessed password instead
+// of one AES key. The salt, SALT_LEN random bytes per user, makes the same
+// password give another key for another user and another server.
+const (
+	KEY_LEN  = 32
+	SALT_LEN = 16
+	KDF_N    = 1 << 15
+	KDF_R    = 8
+	KDF_P    = 1
+)
+
+// NewSalt returns SALT_LEN random bytes in hex.
+func NewSalt() (string, error) {
+	salt := make([]byte, SALT_LEN)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+// DeriveKey returns the KEY_LEN bytes key of password and salt.
+func DeriveKey(password, salt string) ([]byte, error) {
+	return scrypt.Key([]byte(password), []byte(salt), KDF_N, KDF_R, KDF_P, KEY_LEN)
+}
@@ -0,0 +1,53 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A padded packet is sent as
+//
+//	PAD_MARKER | length (2 bytes, big endian) | packet | zeros
+//
+// filled up to the smallest bucket the packet fits in. An IP packet never
+// starts with PAD_MARKER, so a receiver can tell padded and plain packets
+// apart whatever the sender is configured with. The overhead is PAD_HEADER
+// bytes plus the padding, packets above the largest bucket only get the
+// header.
+const (
+	PAD_MARKER = 0x00
+	PAD_HEADER = 3
+)
+
+// Pad wraps data and pads it to one of buckets, which must be sorted.
+func Pad(data []byte, buckets []int) []byte {
+	size := PAD_HEADER + len(data)
+	for _, b := range buckets {
+		if size <= b {
+			size = b
+			break
+		}
+	}
+
+	padded := make([]byte, size)
+	padded[0] = PAD_MARKER
+	binary.BigEndian.PutUint16(padded[1:], uint16(len(data)))
+	copy(padded[PAD_HEADER:], data)
+	return padded
+}
+
+// Unpad returns the packet inside data, data itself when it is not padded.
+func Unpad(data []byte) ([]byte, error) {
+	if len(data) < 1 || data[0] != PAD_MARKER {
+		return data, nil
+	}
+
+	if len(data) < PAD_HEADER {
+		return nil, fmt.Errorf("padded packet too short")
+	}
+	length := int(binary.BigEndian.Uint16(data[1:]))
+	if PAD_HEADER+length > len(data) {
+		return nil, fmt.Errorf("padded packet length %d out of range", length)
+	}
+	return data[PAD_HEADER : PAD_HEADER+length], nil
+}
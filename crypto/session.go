@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// KEY_ID_LEN bytes of the hash of the session key are the additional data
+// of every packet, a packet opened with the key of another session then fails
+// instead of turning into garbage that would be forwarded.
+const KEY_ID_LEN = 4
+
+// The nonce of a session packet is
+//
+//	prefix (NONCE_PREFIX_LEN bytes) | counter (8 bytes)
+//
+// The prefix is random for each Session, as a client keeps its key across
+// reconnects, and the counter counts the packets it sent from 1. Decrypt
+// takes the prefix of the first packet as the one of the peer and drops
+// the counters it already opened, or older than REPLAY_WINDOW, so a
+// captured datagram cannot be played again.
+const (
+	NONCE_PREFIX_LEN = GCM_NONCE_LEN - 8
+	REPLAY_WINDOW    = 1024
+)
+
+func KeyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:KEY_ID_LEN]
+}
+
+// A Session encrypts the packets of one session. The cipher and the key id
+// are made once by NewSession, not for every packet. It is safe for
+// concurrent use.
+type Session struct {
+	Key  []byte
+	ID   []byte
+	aead cipher.AEAD
+
+	prefix  [NONCE_PREFIX_LEN]byte
+	counter uint64
+
+	mu     sync.Mutex
+	peer   []byte
+	window replayWindow
+}
+
+func NewSession(key []byte) (*Session, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{Key: key, ID: KeyID(key), aead: aead}
+	if _, err := io.ReadFull(rand.Reader, s.prefix[:]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Encrypt encrypts a packet of the session, in the format of AESEncrypt
+// with the nonce of the next counter.
+func (s *Session) Encrypt(plaintext []byte) ([]byte, error) {
+	ciphertext := make([]byte, GCM_NONCE_LEN, GCM_NONCE_LEN+len(plaintext)+GCM_TAG_LEN)
+	copy(ciphertext, s.prefix[:])
+	binary.BigEndian.PutUint64(ciphertext[NONCE_PREFIX_LEN:], atomic.AddUint64(&s.counter, 1))
+	return s.aead.Seal(ciphertext, ciphertext, plaintext, s.ID), nil
+}
+
+// Decrypt decrypts a packet in place and checks it belongs to the session
+// and was not opened before.
+func (s *Session) Decrypt(cryptoText []byte) ([]byte, error) {
+	plaintext, err := open(s.aead, s.ID, cryptoText)
+	if err != nil {
+		return nil, err
+	}
+
+	// authenticated with the packet, open left it in place
+	prefix := cryptoText[:NONCE_PREFIX_LEN]
+	counter := binary.BigEndian.Uint64(cryptoText[NONCE_PREFIX_LEN:GCM_NONCE_LEN])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peer == nil {
+		s.peer = append([]byte{}, prefix...)
+	}
+	if string(prefix) != string(s.peer) || !s.window.accept(counter) {
+		return nil, fmt.Errorf("replayed message")
+	}
+	return plaintext, nil
+}
+
+// replayWindow remembers the last REPLAY_WINDOW counters below the highest
+// one, a bit each.
+type replayWindow struct {
+	top  uint64
+	bits [REPLAY_WINDOW / 64]uint64
+}
+
+// accept tells whether counter is new and marks it seen. Counters start at
+// 1, 0 is never sent.
+func (w *replayWindow) accept(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	if counter > w.top {
+		// forget the counters sliding out of the window
+		for c := w.top + 1; c <= counter && c-w.top <= REPLAY_WINDOW; c++ {
+			w.bits[c%REPLAY_WINDOW/64] &^= 1 << (c % 64)
+		}
+		w.top = counter
+	} else if w.top-counter >= REPLAY_WINDOW {
+		return false
+	}
+
+	i := counter % REPLAY_WINDOW
+	if w.bits[i/64]&(1<<(i%64)) != 0 {
+		return false
+	}
+	w.bits[i/64] |= 1 << (i % 64)
+	return true
+}
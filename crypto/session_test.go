@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testSession(t *testing.T, key string) *Session {
+	s, err := NewSession([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSessionWrongKey(t *testing.T) {
+	s := testSession(t, "0123456789abcdef0123456789abcdef")
+	other := testSession(t, "fedcba9876543210fedcba9876543210")
+
+	packet := []byte("a packet of the session")
+	cryptoText, err := s.Encrypt(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cryptoText) != GCM_NONCE_LEN+len(packet)+GCM_TAG_LEN {
+		t.Errorf("%d bytes for a %d bytes packet", len(cryptoText), len(packet))
+	}
+
+	if _, err := other.Decrypt(append([]byte{}, cryptoText...)); err == nil {
+		t.Error("packet decrypted with the key of another session")
+	}
+	if _, err := AESDecrypt(s.Key, append([]byte{}, cryptoText...)); err == nil {
+		t.Error("packet decrypted without the key id")
+	}
+
+	plaintext, err := s.Decrypt(cryptoText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, packet) {
+		t.Errorf("decrypted %q, want %q", plaintext, packet)
+	}
+}
+
+func TestSessionReplay(t *testing.T) {
+	const key = "0123456789abcdef0123456789abcdef"
+	sender, receiver := testSession(t, key), testSession(t, key)
+
+	var packets [][]byte
+	for i := 0; i < REPLAY_WINDOW+10; i++ {
+		cryptoText, err := sender.Encrypt([]byte("packet"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, cryptoText)
+	}
+	open := func(i int) error {
+		_, err := receiver.Decrypt(append([]byte{}, packets[i]...))
+		return err
+	}
+
+	// out of order within the window is fine, twice is not
+	for _, i := range []int{1, 0, 5, 3} {
+		if err := open(i); err != nil {
+			t.Fatalf("packet %d refused: %v", i, err)
+		}
+	}
+	for _, i := range []int{0, 1, 3, 5} {
+		if open(i) == nil {
+			t.Errorf("packet %d opened twice", i)
+		}
+	}
+
+	// once the window moved on, the old ones are refused unseen
+	if err := open(REPLAY_WINDOW + 9); err != nil {
+		t.Fatal(err)
+	}
+	if open(2) == nil {
+		t.Error("packet older than the window opened")
+	}
+	if err := open(REPLAY_WINDOW + 8); err != nil {
+		t.Errorf("packet within the window refused: %v", err)
+	}
+
+	// the same key in another session, e.g. before a reconnect
+	other := testSession(t, key)
+	cryptoText, _ := other.Encrypt([]byte("packet"))
+	if _, err := receiver.Decrypt(cryptoText); err == nil {
+		t.Error("packet of another session opened")
+	}
+}
@@ -0,0 +1,166 @@
+// Command loopback runs a server and a client in one process over
+// 127.0.0.1 with in-memory tun devices and pushes a packet through the
+// tunnel in both directions. It needs no root and no real device, use it
+// as a smoke test or as the base of an integration test:
+//
+//	go run ./example/loopback
+//
+// with -memory the tunnel itself goes over channels instead of a socket,
+// with -udp over UDP datagrams instead of a websocket,
+// -mtu 9000 checks that jumbo frames make it through: a packet of the full
+// MTU is pushed after the small ones.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hivpn/crypto"
+	"hivpn/log"
+	"hivpn/tun"
+	"hivpn/vpn"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	SERVER_ADDR = "127.0.0.1:18080"
+	TIMEOUT     = 10 * time.Second
+	// IPv4 and UDP headers of udpPacket
+	UDP_HEADERS = 28
+)
+
+var user = vpn.User{Name: "user", Pass: "password", IP: "172.16.0.2/24"}
+
+func main() {
+	memory := flag.Bool("memory", false, "connect over the memory transport")
+	udp := flag.Bool("udp", false, "connect over the udp transport")
+	mtu := flag.Int("mtu", 1500, "MTU of the devices, a packet of this size goes through too")
+	flag.Parse()
+
+	log.SetLevel(log.LevelError)
+	// a real user gets its Salt from hivpn -gen-client on the server
+	salt, err := crypto.NewSalt()
+	if err != nil {
+		fmt.Println("FAIL:", err)
+		os.Exit(1)
+	}
+	user.Salt = salt
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transport := ""
+	if *memory {
+		transport = vpn.TRANSPORT_MEMORY
+	}
+	if *udp {
+		transport = vpn.TRANSPORT_UDP
+	}
+
+	serverDev := tun.CreateMemoryTUN("server", *mtu)
+	go vpn.CreateWithContext(ctx, vpn.Config{
+		MTU:        *mtu,
+		ServerAddr: SERVER_ADDR,
+		LocalAddr:  "172.16.0.1/24",
+		IsServer:   true,
+		Users:      []vpn.User{user},
+		Device:     serverDev,
+		Transport:  transport,
+	})
+	if transport == "" {
+		waitListening(SERVER_ADDR)
+	}
+
+	clientDev := tun.CreateMemoryTUN("client", *mtu)
+	go vpn.CreateWithContext(ctx, vpn.Config{
+		MTU:        *mtu,
+		ServerAddr: SERVER_ADDR,
+		LocalAddr:  user.IP,
+		Users:      []vpn.User{user},
+		Device:     clientDev,
+		Transport:  transport,
+	})
+
+	client, internet := net.IP{172, 16, 0, 2}, net.IP{8, 8, 8, 8}
+	err = roundTrip(clientDev, serverDev, udpPacket(client, internet, []byte("ping")))
+	if err == nil {
+		err = roundTrip(serverDev, clientDev, udpPacket(internet, client, []byte("pong")))
+	}
+	if err == nil {
+		err = roundTrip(clientDev, serverDev, udpPacket(client, internet, bytes.Repeat([]byte{0xAA}, *mtu-UDP_HEADERS)))
+	}
+	if err != nil {
+		fmt.Println("FAIL:", err)
+		os.Exit(1)
+	}
+	fmt.Println("OK: packets went through the tunnel both ways, up to", *mtu, "bytes")
+}
+
+func waitListening(addr string) {
+	deadline := time.Now().Add(TIMEOUT)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// roundTrip injects packet into from until it comes out of to, packets are
+// dropped while the client is still connecting. The copies of the previous
+// packets still on their way (over udp) are skipped.
+func roundTrip(from, to *tun.MemoryDevice, packet []byte) error {
+	deadline := time.After(TIMEOUT)
+	for {
+		err := from.Inject(packet)
+		if err != nil {
+			return err
+		}
+
+		retry := time.After(200 * time.Millisecond)
+	wait:
+		for {
+			select {
+			case got := <-to.Received():
+				if bytes.Equal(got, packet) {
+					return nil
+				}
+			case <-retry:
+				break wait
+			case <-deadline:
+				return fmt.Errorf("packet did not go through the tunnel")
+			}
+		}
+	}
+}
+
+func udpPacket(src, dst net.IP, payload []byte) []byte {
+	packet := make([]byte, UDP_HEADERS+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:16], src.To4())
+	copy(packet[16:20], dst.To4())
+
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	binary.BigEndian.PutUint16(packet[10:], ^uint16(sum))
+
+	binary.BigEndian.PutUint16(packet[20:], 40000)
+	binary.BigEndian.PutUint16(packet[22:], 53)
+	binary.BigEndian.PutUint16(packet[24:], uint16(8+len(payload)))
+	copy(packet[28:], payload)
+	return packet
+}
@@ -1,7 +1,9 @@
 package log
 
 import (
+	"fmt"
 	"log"
+	"os"
 )
 
 const (
@@ -13,24 +15,54 @@ const (
 
 var level = LevelDebug
 
+// output replaces the standard logger when set, e.g. by SetSyslog
+var output func(level int, msg string)
+
 func SetLevel(l int) {
 	level = l
 }
 
+// SetOutputFile writes the logs to path, appending to it or starting from
+// an empty file.
+func SetOutputFile(path string, append bool) error {
+	flags := os.O_CREATE | os.O_WRONLY
+	if append {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	log.SetOutput(f)
+	return nil
+}
+
+func write(l int, prefix string, v []interface{}) {
+	if output != nil {
+		output(l, fmt.Sprintln(v...))
+		return
+	}
+	log.Println(append([]interface{}{prefix}, v...)...)
+}
+
 func Debug(v ...interface{}) {
 	if level <= LevelDebug {
-		log.Println(append([]interface{}{"[DEBUG]"}, v...)...)
+		write(LevelDebug, "[DEBUG]", v)
 	}
 }
 
 func Info(v ...interface{}) {
 	if level <= LevelInfo {
-		log.Println(append([]interface{}{"[INFO]"}, v...)...)
+		write(LevelInfo, "[INFO]", v)
 	}
 }
 
 func Error(v ...interface{}) {
 	if level <= LevelError {
-		log.Println(append([]interface{}{"[ERROR]"}, v...)...)
+		write(LevelError, "[ERROR]", v)
 	}
 }
@@ -0,0 +1,108 @@
+package log
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SYSLOG_FACILITY_DAEMON = 3
+	SYSLOG_APP_NAME        = "hivpn"
+)
+
+// severity of every level, RFC 5424 section 6.2.1
+var syslogSeverity = map[int]int{
+	LevelDebug:   7,
+	LevelInfo:    6,
+	LevelWarning: 4,
+	LevelError:   3,
+}
+
+var localSyslogPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+type syslogWriter struct {
+	mu       sync.Mutex
+	network  string
+	addr     string
+	conn     net.Conn
+	hostname string
+}
+
+// SetSyslog sends the logs to syslog in the RFC 5424 format: to the local
+// daemon when addr is empty, otherwise to "udp://host:port" or
+// "tcp://host:port".
+func SetSyslog(addr string) error {
+	w := &syslogWriter{}
+	w.hostname, _ = os.Hostname()
+	if len(w.hostname) < 1 {
+		w.hostname = "-"
+	}
+
+	if len(addr) > 0 {
+		parts := strings.SplitN(addr, "://", 2)
+		if len(parts) != 2 || (parts[0] != "udp" && parts[0] != "tcp") {
+			return fmt.Errorf("invalid syslog address %s, use udp://host:port or tcp://host:port", addr)
+		}
+		w.network, w.addr = parts[0], parts[1]
+	}
+
+	err := w.connect()
+	if err != nil {
+		return err
+	}
+
+	output = w.write
+	return nil
+}
+
+func (w *syslogWriter) connect() error {
+	if len(w.addr) > 0 {
+		conn, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+		if err != nil {
+			return fmt.Errorf("connect syslog error: %v", err)
+		}
+		w.conn = conn
+		return nil
+	}
+
+	for _, path := range localSyslogPaths {
+		for _, network := range []string{"unixgram", "unix"} {
+			conn, err := net.Dial(network, path)
+			if err == nil {
+				w.network = network
+				w.conn = conn
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no local syslog daemon found")
+}
+
+func (w *syslogWriter) write(level int, msg string) {
+	pri := SYSLOG_FACILITY_DAEMON*8 + syslogSeverity[level]
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", pri, time.Now().Format(time.RFC3339Nano),
+		w.hostname, SYSLOG_APP_NAME, os.Getpid(), strings.TrimRight(msg, "\n"))
+	if w.network == "tcp" {
+		// octet counting framing, RFC 6587
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for try := 0; try < 2; try++ {
+		if w.conn == nil && w.connect() != nil {
+			break
+		}
+		_, err := w.conn.Write([]byte(line))
+		if err == nil {
+			return
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	fmt.Fprint(os.Stderr, msg)
+}
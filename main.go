@@ -1,49 +1,162 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"hivpn/config"
+	"hivpn/crypto"
 	"hivpn/log"
 	"hivpn/utils"
 	"hivpn/vpn"
+	"io"
+	"net/url"
 	"os"
 	"runtime"
+	"time"
+
+	"github.com/skip2/go-qrcode"
 )
 
 var (
 	configPath string
 	logLevel   int
 	ServerMode bool
+	genClient  string
+	genQR      bool
+	genQRPNG   string
+	publicSrv  string
+	runCgroup  string
+	masterKey  string
+	encryptTo  string
+	admin      string
+	printChg   bool
+	eventsJSON bool
+	eventsFD   int
+	keyLog     string
+	keyLogRisk bool
 )
 
 func init() {
 	flag.StringVar(&configPath, "config", "config.toml", "location of the config file")
 	flag.BoolVar(&ServerMode, "S", false, "server mode")
 	flag.IntVar(&logLevel, "l", log.LevelInfo, "log level: [0-DEBUG 1-INFO 2-ERROR]")
+	flag.StringVar(&genClient, "gen-client", "", "print the client config of this user from the server config")
+	flag.BoolVar(&genQR, "qr", false, "with -gen-client: print the client config as a QR code")
+	flag.StringVar(&genQRPNG, "qr-png", "", "with -gen-client: write the client config as a QR code PNG to this file")
+	flag.StringVar(&publicSrv, "public-server", "", "with -gen-client: host:port the client connects to, default PublicServer of the config")
+	flag.StringVar(&masterKey, "master-key", "", "master key of an encrypted config file, default from $"+config.MASTER_KEY_ENV)
+	flag.StringVar(&encryptTo, "encrypt-config", "", "write the config file compressed and encrypted with the master key to this file")
+	flag.StringVar(&admin, "admin", "", "send a command to the running server or client through AdminAddr: [rekey <user>|pause|resume]")
+	flag.BoolVar(&printChg, "print-changes", false, "print the routes, firewall rules and files the running server or client changed, through AdminAddr")
+	flag.BoolVar(&eventsJSON, "events-json", false, "client: write connection events as JSON lines to -events-fd")
+	flag.IntVar(&eventsFD, "events-fd", 1, "with -events-json: file descriptor the events are written to, 1 is stdout")
+	flag.StringVar(&keyLog, "keylog", "", "DEBUG ONLY: append the session keys to this file, anyone reading it can decrypt the traffic")
+	flag.BoolVar(&keyLogRisk, "keylog-i-understand-the-risk", false, "required with -keylog")
+	flag.StringVar(&runCgroup, "run-in-cgroup", "", "run the command given after the flags inside this cgroup (see Cgroup)")
 	runtime.GOMAXPROCS(runtime.NumCPU())
 }
 
 func main() {
 	flag.Parse()
 	log.SetLevel(logLevel)
+
+	if len(runCgroup) > 0 {
+		if flag.NArg() < 1 {
+			log.Error("-run-in-cgroup needs a command")
+			os.Exit(1)
+		}
+		code, err := vpn.RunInCgroup(runCgroup, flag.Arg(0), flag.Args()[1:]...)
+		if err != nil {
+			log.Error(err)
+		}
+		os.Exit(code)
+	}
+
+	if len(masterKey) < 1 {
+		masterKey = os.Getenv(config.MASTER_KEY_ENV)
+	}
+
+	if len(encryptTo) > 0 {
+		err := encryptConfig()
+		if err != nil {
+			log.Error("encrypt config error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Debug("Load Config from", configPath)
-	conf, err := config.Load(configPath)
+	conf, err := config.LoadWithKey(configPath, masterKey)
 	if err != nil {
 		log.Error("start error:", err)
 		os.Exit(1)
 	}
 
+	if conf.LogTarget == "syslog" {
+		err = log.SetSyslog(conf.SyslogAddr)
+		if err != nil {
+			log.Error("open syslog error:", err)
+			os.Exit(1)
+		}
+	} else if len(conf.LogFile) > 0 {
+		err = log.SetOutputFile(conf.LogFile, conf.LogAppend)
+		if err != nil {
+			log.Error("open log file error:", err)
+			os.Exit(1)
+		}
+	}
+
+	if printChg {
+		err = printChanges(conf)
+		if err != nil {
+			log.Error("print changes error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(admin) > 0 {
+		err = adminCommand(conf)
+		if err != nil {
+			log.Error("admin error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(genClient) > 0 {
+		err = generateClient(conf)
+		if err != nil {
+			log.Error("gen client error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var usersAuthen []vpn.User
+	var groups []vpn.Group
+	var serverHost string
+	var reloadUsers func() ([]vpn.User, error)
 	if ServerMode {
-		for _, u := range conf.Users {
-			usersAuthen = append(usersAuthen, vpn.User{
-				IP:   u.Ipaddress,
-				Name: u.Username,
-				Pass: u.Password,
+		usersAuthen = serverUsers(conf)
+		reloadUsers = func() ([]vpn.User, error) {
+			conf, err := config.LoadWithKey(configPath, masterKey)
+			if err != nil {
+				return nil, err
+			}
+			return serverUsers(conf), nil
+		}
+		for _, g := range conf.Groups {
+			groups = append(groups, vpn.Group{
+				Name:      g.Name,
+				LocalAddr: g.Address,
 			})
 		}
 	} else {
-		newDomain, newHost, err := utils.ValidServer(conf.Server)
+		serverHost = conf.Server
+		retryDelay := time.Duration(conf.DNSRetryDelay) * time.Second
+		newDomain, newHost, err := utils.ValidServerRetry(conf.Server, conf.DNSRetries, retryDelay, utils.RealClock)
 		if err != nil {
 			log.Error(err)
 			os.Exit(1)
@@ -55,23 +168,310 @@ func main() {
 		usersAuthen = append(usersAuthen, vpn.User{
 			Name: conf.User,
 			Pass: conf.Pass,
+			Salt: conf.Salt,
 			IP:   conf.Address,
+			IP6:  conf.Address6,
 		})
 	}
 
+	if len(keyLog) > 0 && !keyLogRisk {
+		log.Error("-keylog exposes the session keys, add -keylog-i-understand-the-risk to use it")
+		os.Exit(1)
+	}
+
+	var events io.Writer
+	if eventsJSON {
+		events = os.NewFile(uintptr(eventsFD), "events")
+	}
+
 	_, err = vpn.Create(vpn.Config{
 		MTU:            conf.MTU,
 		ServerAddr:     conf.Server,
+		ServerHost:     serverHost,
 		LocalAddr:      conf.Address,
+		LocalAddr6:     conf.Address6,
 		HostHeader:     conf.HostHeader,
 		DefaultGateway: conf.DefaultGateway,
 		IsServer:       ServerMode,
 		Users:          usersAuthen,
 		Whitelist:      conf.Whitelist,
 		Blacklist:      conf.Blacklist,
+
+		Groups: groups,
+
+		WhitelistFile: conf.WhitelistFile,
+		BlacklistFile: conf.BlacklistFile,
+
+		ResolveInterval: conf.ResolveInterval,
+
+		ProbeTarget:   conf.ProbeTarget,
+		ProbeInterval: conf.ProbeInterval,
+		ProbeFailures: conf.ProbeFailures,
+
+		AutoMTU: conf.AutoMTU,
+
+		Networks: conf.Networks,
+
+		MaxConcurrentAuth: conf.MaxConcurrentAuth,
+
+		TopTalkers: conf.TopTalkers,
+
+		Paranoid: conf.Paranoid,
+
+		AdminAddr:   conf.AdminAddr,
+		PauseRoutes: conf.PauseRoutes,
+
+		PadBuckets: conf.PadBuckets,
+
+		Pool:        conf.Pool,
+		ReservedIPs: conf.ReservedIPs,
+		LeaseGrace:  conf.LeaseGrace,
+
+		AllowedPorts: conf.AllowedPorts,
+
+		MaxReconnectDuration: conf.MaxReconnectDuration,
+
+		ReconnectDelay:    conf.ReconnectDelay,
+		ReconnectMaxDelay: conf.ReconnectMaxDelay,
+		MaxReconnectTries: conf.MaxReconnectTries,
+
+		DSCP: conf.DSCP,
+
+		MaxSessionLifetime: conf.MaxSessionLifetime,
+
+		MaxClockSkew: conf.MaxClockSkew,
+
+		QuotaFile:  conf.QuotaFile,
+		QuotaReset: conf.QuotaReset,
+
+		Disguise: conf.Disguise,
+
+		MOTD: conf.MOTD,
+
+		BatchWindow: conf.BatchWindow,
+
+		Compress: conf.Compress,
+
+		CompressEncrypted: conf.CompressEncrypted,
+
+		MTUDiagnostic: conf.MTUDiagnostic,
+
+		Transport:      conf.Transport,
+		Path:           conf.Path,
+		KeepAlive:      conf.KeepAlive,
+		ClientIPHeader: conf.ClientIPHeader,
+
+		DeadTimeout: conf.DeadTimeout,
+
+		ProtocolMagic: conf.ProtocolMagic,
+
+		AllowedSources: conf.AllowedSources,
+
+		TLS:       conf.TLS,
+		TLSCert:   conf.TLSCert,
+		TLSKey:    conf.TLSKey,
+		ACME:      conf.ACME,
+		ACMEDir:   conf.ACMEDir,
+		ACMEEmail: conf.ACMEEmail,
+
+		MaxQueueBytes:        conf.MaxQueueBytes,
+		MaxSessionQueueBytes: conf.MaxSessionQueueBytes,
+		QueuePolicy:          conf.QueuePolicy,
+
+		UpScript:   conf.UpScript,
+		DownScript: conf.DownScript,
+
+		TunReaders: conf.TunReaders,
+
+		DNS:     conf.DNS,
+		DNSOnly: conf.DNSOnly,
+
+		ReportPublicIP: conf.ReportPublicIP,
+		NotFoundPolicy: conf.NotFoundPolicy,
+
+		StatsAddr:    conf.StatsAddr,
+		StatsTLSCert: conf.StatsTLSCert,
+		StatsTLSKey:  conf.StatsTLSKey,
+		StatsToken:   conf.StatsToken,
+
+		AuthWebhook:      conf.AuthWebhook,
+		AuthWebhookToken: conf.AuthWebhookToken,
+
+		ReloadUsers: reloadUsers,
+
+		OTLPEndpoint: conf.OTLPEndpoint,
+		OTLPHeaders:  conf.OTLPHeaders,
+		OTLPInterval: conf.OTLPInterval,
+
+		Cgroup: conf.Cgroup,
+
+		RunAsUser: conf.RunAsUser,
+
+		Events: events,
+		KeyLog: keyLog,
 	})
 	if err != nil {
 		log.Error("Cannot start tunnel vpn:", err)
 	}
 
 }
+
+// serverUsers are the Users of a server config.
+func serverUsers(conf config.Config) []vpn.User {
+	var users []vpn.User
+	for _, u := range conf.Users {
+		users = append(users, vpn.User{
+			IP:     u.Ipaddress,
+			IP6:    u.Ipaddress6,
+			Name:   u.Username,
+			Pass:   u.Password,
+			Salt:   u.Salt,
+			Routes: u.Routes,
+			Group:  u.Group,
+			NAT64:  u.NAT64,
+			Quota:  u.Quota,
+			MTU:    u.MTU,
+			Rate:   u.Rate,
+
+			AllowedPorts: u.AllowedPorts,
+			Subnets:      u.Subnets,
+		})
+	}
+	return users
+}
+
+func generateClient(conf config.Config) error {
+	conf, err := saltUser(conf, genClient)
+	if err != nil {
+		return err
+	}
+	if len(publicSrv) > 0 {
+		conf.PublicServer = publicSrv
+	}
+	clientConf, err := conf.GenClient(genClient)
+	if err != nil {
+		return err
+	}
+
+	if len(genQRPNG) > 0 {
+		return qrcode.WriteFile(clientConf, qrcode.Medium, 512, genQRPNG)
+	}
+
+	if genQR {
+		qr, err := qrcode.New(clientConf, qrcode.Medium)
+		if err != nil {
+			return err
+		}
+		fmt.Print(qr.ToSmallString(false))
+		return nil
+	}
+
+	fmt.Print(clientConf)
+	return nil
+}
+
+// saltUser gives user a random Salt in the config file when it has none, and
+// returns the config read again with it.
+func saltUser(conf config.Config, user string) (config.Config, error) {
+	unsalted := false
+	for _, u := range conf.Users {
+		if u.Username == user {
+			unsalted = len(u.Salt) < 1
+			break
+		}
+	}
+	if !unsalted {
+		// salted already, or GenClient tells it is no user
+		return conf, nil
+	}
+
+	salt, err := crypto.NewSalt()
+	if err != nil {
+		return conf, err
+	}
+	err = config.AddSalt(configPath, user, salt)
+	if err != nil {
+		return conf, err
+	}
+	log.Info("Salt of user", user, "written to", configPath+", restart the server or kill -HUP it")
+	return config.LoadWithKey(configPath, masterKey)
+}
+
+func encryptConfig() error {
+	if len(masterKey) < 1 {
+		return fmt.Errorf("no master key, use -master-key or $%s", config.MASTER_KEY_ENV)
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := config.EncryptConfig(data, masterKey)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(encryptTo, encrypted, 0600)
+}
+
+func adminCommand(conf config.Config) error {
+	if len(conf.AdminAddr) < 1 {
+		return fmt.Errorf("AdminAddr is not set in %s", configPath)
+	}
+
+	switch admin {
+	case "rekey":
+		if flag.NArg() < 1 {
+			return fmt.Errorf("rekey needs a user")
+		}
+		user := flag.Arg(0)
+		password, err := utils.Request(conf.AdminAddr, conf.StatsToken, "/rekey?user="+url.QueryEscape(user))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("New password of %s: %s", user, password)
+		fmt.Println("The old password works for a while, update Users in the config file so the new one survives a restart.")
+		return nil
+	case "pause", "resume":
+		state, err := utils.Request(conf.AdminAddr, conf.StatsToken, "/"+admin)
+		if err != nil {
+			return err
+		}
+		fmt.Print(state)
+		return nil
+	default:
+		return fmt.Errorf("unknown admin command: %s", admin)
+	}
+}
+
+// printChanges lists what the running instance changed in the system, the
+// reverted changes included, in order.
+func printChanges(conf config.Config) error {
+	if len(conf.AdminAddr) < 1 {
+		return fmt.Errorf("AdminAddr is not set in %s", configPath)
+	}
+
+	data, err := utils.Request(conf.AdminAddr, conf.StatsToken, "/changes")
+	if err != nil {
+		return err
+	}
+	var changes []vpn.SystemChange
+	err = json.Unmarshal([]byte(data), &changes)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		state := "done"
+		switch {
+		case len(c.Error) > 0:
+			state = "failed: " + c.Error
+		case c.Reverted:
+			state = "reverted"
+		case len(c.Undo) > 0:
+			state = "active, undo: " + c.Undo
+		}
+		fmt.Printf("%s  %s  (%s)\n", c.Time.Format(time.RFC3339), c.Change, state)
+	}
+	return nil
+}
@@ -1,16 +1,20 @@
 package network
 
 import (
+	"hivpn/crypto"
 	"sync"
 )
 
 type ARPRecord struct {
-	Conn interface{}
-	Key  []byte
+	Conn     interface{}
+	Key      *crypto.Session
+	PublicIP string
+	// Compress tells whether the peer takes compressed frames
+	Compress bool
 }
 
 type ARP struct {
-	mu    sync.Mutex
+	mu    sync.RWMutex
 	Table map[string]ARPRecord
 }
 
@@ -23,8 +27,8 @@ func NewARP() (arp *ARP) {
 }
 
 func (arp *ARP) QueryOne(ip string) ARPRecord {
-	// arp.mu.Lock()
-	// defer arp.mu.Unlock()
+	arp.mu.RLock()
+	defer arp.mu.RUnlock()
 	for _, v := range arp.Table {
 		return v
 	}
@@ -33,8 +37,8 @@ func (arp *ARP) QueryOne(ip string) ARPRecord {
 }
 
 func (arp *ARP) Query(ip string) ARPRecord {
-	// arp.mu.Lock()
-	// defer arp.mu.Unlock()
+	arp.mu.RLock()
+	defer arp.mu.RUnlock()
 	conn, found := arp.Table[ip]
 	if !found {
 		return ARPRecord{}
@@ -49,7 +53,7 @@ func (arp *ARP) Delete(id string) {
 	delete(arp.Table, id)
 }
 
-func (arp *ARP) Update(id string, conn interface{}, key []byte) bool {
+func (arp *ARP) Update(id string, conn interface{}, key *crypto.Session) bool {
 	arp.mu.Lock()
 	defer arp.mu.Unlock()
 	_, found := arp.Table[id]
@@ -57,6 +61,42 @@ func (arp *ARP) Update(id string, conn interface{}, key []byte) bool {
 		return found
 	}
 
-	arp.Table[id] = ARPRecord{conn, key}
+	arp.Table[id] = ARPRecord{Conn: conn, Key: key}
 	return found
 }
+
+func (arp *ARP) SetPublicIP(id string, ip string) {
+	arp.mu.Lock()
+	defer arp.mu.Unlock()
+	r, found := arp.Table[id]
+	if !found {
+		return
+	}
+
+	r.PublicIP = ip
+	arp.Table[id] = r
+}
+
+func (arp *ARP) SetCompress(id string, compress bool) {
+	arp.mu.Lock()
+	defer arp.mu.Unlock()
+	r, found := arp.Table[id]
+	if !found {
+		return
+	}
+
+	r.Compress = compress
+	arp.Table[id] = r
+}
+
+// Sessions returns how many connections are in the table, a connection
+// may have an IPv4 and an IPv6 record.
+func (arp *ARP) Sessions() int {
+	arp.mu.RLock()
+	defer arp.mu.RUnlock()
+	conns := make(map[interface{}]bool, len(arp.Table))
+	for _, r := range arp.Table {
+		conns[r.Conn] = true
+	}
+	return len(conns)
+}
@@ -0,0 +1,61 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A batch carries several packets in one frame of the tunnel:
+//
+//	BATCH_MARKER | length (2 bytes, big endian) | packet | length | packet...
+//
+// An IP packet never starts with BATCH_MARKER (nor with the PAD_MARKER of
+// crypto.Pad or COMPRESS_MARKER), so a receiver can tell batches and plain packets apart
+// whatever the sender is configured with.
+const (
+	BATCH_MARKER = 0x01
+	BATCH_HEADER = 1
+	BATCH_LENGTH = 2
+)
+
+// Batch joins packets into one frame.
+func Batch(packets [][]byte) []byte {
+	size := BATCH_HEADER
+	for _, p := range packets {
+		size += BATCH_LENGTH + len(p)
+	}
+
+	batch := make([]byte, size)
+	batch[0] = BATCH_MARKER
+	offset := BATCH_HEADER
+	for _, p := range packets {
+		binary.BigEndian.PutUint16(batch[offset:], uint16(len(p)))
+		offset += BATCH_LENGTH
+		offset += copy(batch[offset:], p)
+	}
+	return batch
+}
+
+func IsBatch(data []byte) bool {
+	return len(data) > 0 && data[0] == BATCH_MARKER
+}
+
+// Unbatch splits a frame made by Batch into its packets, they share the
+// memory of data.
+func Unbatch(data []byte) ([][]byte, error) {
+	var packets [][]byte
+	offset := BATCH_HEADER
+	for offset < len(data) {
+		if offset+BATCH_LENGTH > len(data) {
+			return nil, fmt.Errorf("batch truncated at %d", offset)
+		}
+		length := int(binary.BigEndian.Uint16(data[offset:]))
+		offset += BATCH_LENGTH
+		if length < 1 || offset+length > len(data) {
+			return nil, fmt.Errorf("batched packet length %d out of range", length)
+		}
+		packets = append(packets, data[offset:offset+length])
+		offset += length
+	}
+	return packets, nil
+}
@@ -0,0 +1,84 @@
+package network
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A compressed frame of the tunnel is
+//
+//	COMPRESS_MARKER | deflate stream
+//
+// of a packet or a batch. Like batches it is told apart from plain packets
+// by its first byte, Compress sends the ones that do not shrink as they are.
+const (
+	COMPRESS_MARKER = 0x02
+	// COMPRESS_MIN is the smallest frame worth compressing, below the
+	// stream costs about what it saves
+	COMPRESS_MIN = 64
+)
+
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+var flateReaders = sync.Pool{New: func() interface{} {
+	return flate.NewReader(nil)
+}}
+
+// Compress returns data compressed behind COMPRESS_MARKER, or data itself
+// when that is not smaller.
+func Compress(data []byte) []byte {
+	if len(data) < COMPRESS_MIN {
+		return data
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	buf.WriteByte(COMPRESS_MARKER)
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil || buf.Len() >= len(data) {
+		return data
+	}
+	return buf.Bytes()
+}
+
+func IsCompressed(data []byte) bool {
+	return len(data) > 0 && data[0] == COMPRESS_MARKER
+}
+
+// Decompress returns the frame inside data, data itself when it is not
+// compressed. A frame growing past max bytes is an error, whatever the
+// stream claims.
+func Decompress(data []byte, max int) ([]byte, error) {
+	if !IsCompressed(data) {
+		return data, nil
+	}
+
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	err := r.(flate.Resetter).Reset(bytes.NewReader(data[1:]), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %v", err)
+	}
+	if n > int64(max) {
+		return nil, fmt.Errorf("decompressed frame larger than %d bytes", max)
+	}
+	return buf.Bytes(), nil
+}
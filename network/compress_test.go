@@ -0,0 +1,40 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n"), 32)[:1400]
+	random := make([]byte, 1400)
+	rand.Read(random)
+
+	frame := Compress(text)
+	if !IsCompressed(frame) || len(frame) >= len(text) {
+		t.Fatalf("%d bytes of text compressed to %d", len(text), len(frame))
+	}
+	got, err := Decompress(frame, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, text) {
+		t.Error("round trip changed the data")
+	}
+
+	if frame := Compress(random); !bytes.Equal(frame, random) {
+		t.Error("random data not sent as it is")
+	}
+	if frame := Compress(text[:COMPRESS_MIN-1]); IsCompressed(frame) {
+		t.Error("frame under COMPRESS_MIN compressed")
+	}
+
+	bomb := Compress(make([]byte, 60000))
+	if _, err := Decompress(bomb, 1500); err == nil {
+		t.Errorf("%d bytes inflated past the limit", len(bomb))
+	}
+	if _, err := Decompress([]byte{COMPRESS_MARKER, 0xff, 0xff, 0xff}, 1500); err == nil {
+		t.Error("garbage stream decompressed")
+	}
+}
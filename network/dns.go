@@ -0,0 +1,286 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	DNS_LOCAL_ADDR   = "127.0.0.1:53"
+	DNS_TIMEOUT      = 5 * time.Second
+	DNS_MAX_MSG_SIZE = 4096
+	// DNS_MAX_INFLIGHT caps the queries and tcp clients forwarded at once,
+	// the udp queries past it are dropped and the resolver asks again
+	DNS_MAX_INFLIGHT = 256
+	RESOLV_CONF      = "/etc/resolv.conf"
+	NETWORKSETUP     = "/usr/sbin/networksetup"
+)
+
+// DNSForwarder relays queries received on the loopback to an upstream
+// resolver. The upstream is reached through the default route, that is
+// through the tunnel. It listens on udp and on tcp, where resolvers ask
+// again for the answers too large for udp.
+type DNSForwarder struct {
+	Upstream string
+	conn     net.PacketConn
+	listener net.Listener
+	// inflight holds a slot per query or tcp client being forwarded
+	inflight chan struct{}
+}
+
+func NewDNSForwarder(upstream string) (*DNSForwarder, error) {
+	return newDNSForwarder(DNS_LOCAL_ADDR, upstream)
+}
+
+func newDNSForwarder(local, upstream string) (*DNSForwarder, error) {
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+
+	conn, err := net.ListenPacket("udp", local)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", local)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	f := &DNSForwarder{
+		Upstream: upstream,
+		conn:     conn,
+		listener: listener,
+		inflight: make(chan struct{}, DNS_MAX_INFLIGHT),
+	}
+	go f.serve()
+	go f.serveTCP()
+	return f, nil
+}
+
+// acquire takes a slot, false when DNS_MAX_INFLIGHT are taken.
+func (f *DNSForwarder) acquire() bool {
+	select {
+	case f.inflight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *DNSForwarder) release() {
+	<-f.inflight
+}
+
+func (f *DNSForwarder) serve() {
+	buf := make([]byte, DNS_MAX_MSG_SIZE)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !f.acquire() {
+			continue
+		}
+
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			defer f.release()
+			f.forward(query, addr)
+		}()
+	}
+}
+
+func (f *DNSForwarder) forward(query []byte, addr net.Addr) {
+	upstream, err := net.DialTimeout("udp", f.Upstream, DNS_TIMEOUT)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	upstream.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+	if _, err = upstream.Write(query); err != nil {
+		return
+	}
+
+	resp := make([]byte, DNS_MAX_MSG_SIZE)
+	n, err := upstream.Read(resp)
+	if err != nil {
+		return
+	}
+
+	f.conn.WriteTo(resp[:n], addr)
+}
+
+func (f *DNSForwarder) serveTCP() {
+	for {
+		c, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !f.acquire() {
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer f.release()
+			f.forwardTCP(c)
+		}()
+	}
+}
+
+// forwardTCP relays the queries of a tcp client over tcp, one at a time,
+// until it stays quiet for DNS_TIMEOUT.
+func (f *DNSForwarder) forwardTCP(c net.Conn) {
+	defer c.Close()
+
+	var upstream net.Conn
+	defer func() {
+		if upstream != nil {
+			upstream.Close()
+		}
+	}()
+	for {
+		c.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+		query, err := readTCPMessage(c)
+		if err != nil {
+			return
+		}
+
+		if upstream == nil {
+			upstream, err = net.DialTimeout("tcp", f.Upstream, DNS_TIMEOUT)
+			if err != nil {
+				return
+			}
+		}
+		upstream.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+		if writeTCPMessage(upstream, query) != nil {
+			return
+		}
+		resp, err := readTCPMessage(upstream)
+		if err != nil {
+			return
+		}
+
+		if writeTCPMessage(c, resp) != nil {
+			return
+		}
+	}
+}
+
+// Over tcp a dns message is preceded by its length, 2 bytes.
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+func (f *DNSForwarder) Close() error {
+	f.listener.Close()
+	return f.conn.Close()
+}
+
+// SetResolvConf points the system resolver to the local forwarder and
+// returns the previous content so it can be restored.
+func SetResolvConf() ([]byte, error) {
+	old, err := os.ReadFile(RESOLV_CONF)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(DNS_LOCAL_ADDR)
+	err = os.WriteFile(RESOLV_CONF, []byte("nameserver "+host+"\n"), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+func RestoreResolvConf(old []byte) error {
+	return os.WriteFile(RESOLV_CONF, old, 0644)
+}
+
+// SetDarwinDNS points the network service of the device iface (en0...) to
+// the local forwarder and returns the service and its previous servers for
+// RestoreDarwinDNS.
+func SetDarwinDNS(iface string) (string, []string, error) {
+	output, err := exec.Command(NETWORKSETUP, "-listallhardwareports").Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("list hardware ports error: %v", err)
+	}
+	service := darwinService(string(output), iface)
+	if len(service) < 1 {
+		return "", nil, fmt.Errorf("no network service uses %s", iface)
+	}
+
+	output, err = exec.Command(NETWORKSETUP, "-getdnsservers", service).Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("get dns servers of %s error: %v", service, err)
+	}
+	old := darwinDNSServers(string(output))
+
+	host, _, _ := net.SplitHostPort(DNS_LOCAL_ADDR)
+	err = exec.Command(NETWORKSETUP, "-setdnsservers", service, host).Run()
+	if err != nil {
+		return "", nil, fmt.Errorf("set dns servers of %s error: %v", service, err)
+	}
+	return service, old, nil
+}
+
+func RestoreDarwinDNS(service string, old []string) error {
+	return exec.Command(NETWORKSETUP, append([]string{"-setdnsservers", service}, old...)...).Run()
+}
+
+// darwinService finds the service of the device iface in the output of
+// networksetup -listallhardwareports:
+//
+//	Hardware Port: Wi-Fi
+//	Device: en0
+func darwinService(output, iface string) string {
+	port := ""
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Hardware Port: ") {
+			port = strings.TrimPrefix(line, "Hardware Port: ")
+		} else if line == "Device: "+iface {
+			return port
+		}
+	}
+	return ""
+}
+
+// darwinDNSServers reads the output of networksetup -getdnsservers, a
+// sentence when the service has none, which is set back with "Empty".
+func darwinDNSServers(output string) []string {
+	var servers []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if net.ParseIP(line) != nil {
+			servers = append(servers, line)
+		}
+	}
+	if len(servers) < 1 {
+		return []string{"Empty"}
+	}
+	return servers
+}
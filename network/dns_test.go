@@ -0,0 +1,158 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDarwinService(t *testing.T) {
+	output := `
+Hardware Port: Ethernet
+Device: en1
+Ethernet Address: 00:00:00:00:00:01
+
+Hardware Port: Wi-Fi
+Device: en0
+Ethernet Address: 00:00:00:00:00:02
+`
+	for iface, want := range map[string]string{"en0": "Wi-Fi", "en1": "Ethernet", "en10": ""} {
+		if got := darwinService(output, iface); got != want {
+			t.Errorf("service of %s is %q, want %q", iface, got, want)
+		}
+	}
+}
+
+func TestDarwinDNSServers(t *testing.T) {
+	tests := []struct {
+		output string
+		want   []string
+	}{
+		{"There aren't any DNS Servers set on Wi-Fi.\n", []string{"Empty"}},
+		{"1.1.1.1\n2606:4700:4700::1111\n", []string{"1.1.1.1", "2606:4700:4700::1111"}},
+	}
+	for _, test := range tests {
+		if got := darwinDNSServers(test.output); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("servers of %q are %v, want %v", test.output, got, test.want)
+		}
+	}
+}
+
+// testDNSAddr is a free loopback address, the same port for udp and tcp.
+func testDNSAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestDNSForwarderTCP(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	// the upstream answers each query with itself reversed
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					query, err := readTCPMessage(c)
+					if err != nil {
+						return
+					}
+					for i, j := 0, len(query)-1; i < j; i, j = i+1, j-1 {
+						query[i], query[j] = query[j], query[i]
+					}
+					writeTCPMessage(c, query)
+				}
+			}()
+		}
+	}()
+
+	f, err := newDNSForwarder(testDNSAddr(t), upstream.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	c, err := net.Dial("tcp", f.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+	// larger than DNS_MAX_MSG_SIZE, what udp could not carry
+	query := bytes.Repeat([]byte("ab"), DNS_MAX_MSG_SIZE)
+	want := bytes.Repeat([]byte("ba"), DNS_MAX_MSG_SIZE)
+	for i := 0; i < 2; i++ {
+		if err := writeTCPMessage(c, query); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := readTCPMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(resp, want) {
+			t.Fatalf("answer %d of %d bytes is not the upstream one", i, len(resp))
+		}
+	}
+}
+
+func TestDNSForwarderInFlight(t *testing.T) {
+	// the upstream never answers
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	var received int64
+	go func() {
+		buf := make([]byte, DNS_MAX_MSG_SIZE)
+		for {
+			if _, _, err := upstream.ReadFrom(buf); err != nil {
+				return
+			}
+			atomic.AddInt64(&received, 1)
+		}
+	}()
+
+	f, err := newDNSForwarder(testDNSAddr(t), upstream.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	c, err := net.Dial("udp", f.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 2*DNS_MAX_INFLIGHT; i++ {
+		c.Write([]byte("query"))
+		time.Sleep(100 * time.Microsecond)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	if n := atomic.LoadInt64(&received); n != DNS_MAX_INFLIGHT {
+		t.Errorf("%d queries forwarded at once, want %d", n, DNS_MAX_INFLIGHT)
+	}
+	if c, err := net.Dial("tcp", f.listener.Addr().String()); err == nil {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("tcp client past the limit not closed: %v", err)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,108 @@
+package network
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// A packet looks encrypted when a port of its flow is one of an encrypted
+// protocol, or when ENTROPY_SAMPLE bytes of its payload are about as random
+// as bytes get. Compressing those costs CPU for nothing.
+const (
+	ESP_PROTOCOL = 50
+
+	ENTROPY_SAMPLE = 256
+	// ENTROPY_MIN_BITS per byte, random bytes give about 7.2 on a sample
+	// of ENTROPY_SAMPLE, text and headers 4 to 5
+	ENTROPY_MIN_BITS = 6.5
+)
+
+// encryptedPorts are those of TLS (https, imaps, pop3s, smtps, ldaps,
+// dns over tls or quic, sip tls), ssh and wireguard.
+var encryptedPorts = map[uint16]bool{
+	22:    true,
+	443:   true,
+	465:   true,
+	636:   true,
+	853:   true,
+	993:   true,
+	995:   true,
+	5061:  true,
+	8443:  true,
+	51820: true,
+}
+
+// LooksEncrypted tells whether packet belongs to a flow that is already
+// encrypted, by its ports or by the entropy of its payload.
+func LooksEncrypted(packet []byte) bool {
+	proto, offset := transport(packet)
+	switch proto {
+	case ESP_PROTOCOL:
+		return true
+	case TCP_PROTOCOL:
+		if len(packet) < offset+20 {
+			return false
+		}
+		src, dst := binary.BigEndian.Uint16(packet[offset:]), binary.BigEndian.Uint16(packet[offset+2:])
+		if encryptedPorts[src] || encryptedPorts[dst] {
+			return true
+		}
+		dataOffset := int(packet[offset+12]>>4) * 4
+		if dataOffset < 20 || len(packet) < offset+dataOffset {
+			return false
+		}
+		return highEntropy(packet[offset+dataOffset:])
+	case UDP_PROTOCOL:
+		if len(packet) < offset+8 {
+			return false
+		}
+		src, dst := binary.BigEndian.Uint16(packet[offset:]), binary.BigEndian.Uint16(packet[offset+2:])
+		if encryptedPorts[src] || encryptedPorts[dst] {
+			return true
+		}
+		return highEntropy(packet[offset+8:])
+	}
+	return false
+}
+
+// transport returns the protocol of packet and where its header starts, 0
+// for what is not IP.
+func transport(packet []byte) (byte, int) {
+	if len(packet) < 1 {
+		return 0, 0
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < IPV4_HEADER_LEN {
+			return 0, 0
+		}
+		return packet[9], int(packet[0]&0x0F) * 4
+	case 6:
+		if len(packet) < IPV6_HEADER_LEN {
+			return 0, 0
+		}
+		return packet[6], IPV6_HEADER_LEN
+	}
+	return 0, 0
+}
+
+// highEntropy tells whether the first ENTROPY_SAMPLE bytes of payload look
+// random, a shorter payload never does.
+func highEntropy(payload []byte) bool {
+	if len(payload) < ENTROPY_SAMPLE {
+		return false
+	}
+
+	var counts [256]int
+	for _, c := range payload[:ENTROPY_SAMPLE] {
+		counts[c]++
+	}
+	bits := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / ENTROPY_SAMPLE
+			bits -= p * math.Log2(p)
+		}
+	}
+	return bits >= ENTROPY_MIN_BITS
+}
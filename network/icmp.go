@@ -0,0 +1,109 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	ICMP_PROTOCOL   = 1
+	ICMPV6_PROTOCOL = 58
+
+	ICMP_DEST_UNREACHABLE    = 3
+	ICMP_HOST_UNREACHABLE    = 1
+	ICMPV6_DEST_UNREACHABLE  = 1
+	ICMPV6_ADDR_UNREACHABLE  = 3
+	ICMPV6_MAX_QUOTED_PACKET = 1232
+)
+
+// ICMPUnreachable builds the "host unreachable" answer sent by from to the
+// source of packet. It returns nil for packets that must not be answered.
+func ICMPUnreachable(packet []byte, from net.IP) []byte {
+	header := ParseHeaderPacket(packet)
+	if from == nil || header.IPSrc == nil || header.IPSrc.IsUnspecified() || header.IPSrc.IsMulticast() {
+		return nil
+	}
+
+	if header.IsIPv6 {
+		if packet[6] == ICMPV6_PROTOCOL || from.To4() != nil {
+			return nil
+		}
+		return icmpv6Unreachable(packet, header, from)
+	}
+
+	from = from.To4()
+	if packet[9] == ICMP_PROTOCOL || from == nil {
+		return nil
+	}
+	return icmpv4Unreachable(packet, header, from)
+}
+
+func icmpv4Unreachable(packet []byte, header PacketHeader, from net.IP) []byte {
+	quoted := int(packet[0]&0x0F)*4 + 8
+	if quoted > len(packet) {
+		quoted = len(packet)
+	}
+
+	icmp := make([]byte, 8+quoted)
+	icmp[0] = ICMP_DEST_UNREACHABLE
+	icmp[1] = ICMP_HOST_UNREACHABLE
+	copy(icmp[8:], packet[:quoted])
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, 0))
+
+	ip := make([]byte, IPV4_HEADER_LEN, IPV4_HEADER_LEN+len(icmp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(IPV4_HEADER_LEN+len(icmp)))
+	ip[8] = 64
+	ip[9] = ICMP_PROTOCOL
+	copy(ip[12:16], from)
+	copy(ip[16:20], header.IPSrc.To4())
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	return append(ip, icmp...)
+}
+
+func icmpv6Unreachable(packet []byte, header PacketHeader, from net.IP) []byte {
+	quoted := len(packet)
+	if quoted > ICMPV6_MAX_QUOTED_PACKET {
+		quoted = ICMPV6_MAX_QUOTED_PACKET
+	}
+
+	icmp := make([]byte, 8+quoted)
+	icmp[0] = ICMPV6_DEST_UNREACHABLE
+	icmp[1] = ICMPV6_ADDR_UNREACHABLE
+	copy(icmp[8:], packet[:quoted])
+
+	ip := make([]byte, IPV6_HEADER_LEN, IPV6_HEADER_LEN+len(icmp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(icmp)))
+	ip[6] = ICMPV6_PROTOCOL
+	ip[7] = 64
+	copy(ip[8:24], from.To16())
+	copy(ip[24:40], header.IPSrc.To16())
+
+	// pseudo header: addresses, upper layer length and next header
+	var sum uint32
+	sum = sum16(ip[8:40], sum)
+	sum += uint32(len(icmp)) + ICMPV6_PROTOCOL
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, sum))
+
+	return append(ip, icmp...)
+}
+
+func sum16(b []byte, sum uint32) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+func checksum(b []byte, initial uint32) uint16 {
+	sum := sum16(b, initial)
+	for sum>>16 != 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,39 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ReadList reads a file with one ip or CIDR per line, "#" starts a
+// comment.
+func ReadList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []string
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) < 1 {
+			continue
+		}
+
+		_, _, err := net.ParseCIDR(line)
+		if err != nil && net.ParseIP(line) == nil {
+			return nil, fmt.Errorf("%s:%d: invalid ip or CIDR %q", path, lineNo, line)
+		}
+		list = append(list, line)
+	}
+	return list, scanner.Err()
+}
@@ -0,0 +1,171 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// NAT64_PREFIX is the well-known prefix of RFC 6052, the IPv4 address is in
+// its last 32 bits. DNS64 resolvers synthesize their AAAA answers with it.
+const NAT64_PREFIX = "64:ff9b::/96"
+
+const (
+	ICMP_ECHO_REPLY     = 0
+	ICMP_ECHO_REQUEST   = 8
+	ICMPV6_ECHO_REQUEST = 128
+	ICMPV6_ECHO_REPLY   = 129
+)
+
+var nat64Prefix = func() *net.IPNet {
+	_, prefix, _ := net.ParseCIDR(NAT64_PREFIX)
+	return prefix
+}()
+
+// IsNAT64 tells whether ip is an IPv4 address embedded in NAT64_PREFIX.
+func IsNAT64(ip net.IP) bool {
+	return len(ip) == net.IPv6len && nat64Prefix.Contains(ip)
+}
+
+// NAT64To4 translates an IPv6 packet sent to a NAT64_PREFIX address into an
+// IPv4 one from src (RFC 7915). Only TCP, UDP and ICMP echo without
+// extension headers are translated, nil is returned for anything else.
+func NAT64To4(packet []byte, src net.IP) []byte {
+	src = src.To4()
+	if src == nil || len(packet) < IPV6_HEADER_LEN || packet[0]>>4 != 6 {
+		return nil
+	}
+	payload := packet[IPV6_HEADER_LEN:]
+	if int(binary.BigEndian.Uint16(packet[4:])) != len(payload) {
+		return nil
+	}
+
+	proto := packet[6]
+	switch proto {
+	case TCP_PROTOCOL, UDP_PROTOCOL:
+	case ICMPV6_PROTOCOL:
+		proto = ICMP_PROTOCOL
+	default:
+		return nil
+	}
+
+	out := make([]byte, IPV4_HEADER_LEN+len(payload))
+	ip := out[:IPV4_HEADER_LEN]
+	ip[0] = 0x45
+	ip[1] = packet[0]<<4 | packet[1]>>4
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(out)))
+	ip[6] = 0x40 // don't fragment
+	ip[8] = packet[7]
+	ip[9] = proto
+	copy(ip[12:16], src)
+	copy(ip[16:20], packet[36:40])
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	body := out[IPV4_HEADER_LEN:]
+	copy(body, payload)
+	if !translateL4(body, proto, ip[12:20]) {
+		return nil
+	}
+	return out
+}
+
+// NAT64To6 translates an IPv4 packet into an IPv6 one to dst, its source
+// becoming the NAT64_PREFIX address of the IPv4 source. Fragments and what
+// NAT64To4 would not translate are dropped with nil.
+func NAT64To6(packet []byte, dst net.IP) []byte {
+	dst = dst.To16()
+	if dst == nil || len(packet) < IPV4_HEADER_LEN || packet[0]>>4 != 4 {
+		return nil
+	}
+	headerLen := int(packet[0]&0x0F) * 4
+	total := int(binary.BigEndian.Uint16(packet[2:]))
+	if headerLen < IPV4_HEADER_LEN || total < headerLen || total > len(packet) {
+		return nil
+	}
+	if binary.BigEndian.Uint16(packet[6:])&0x3FFF != 0 {
+		// more fragments or an offset
+		return nil
+	}
+
+	proto := packet[9]
+	switch proto {
+	case TCP_PROTOCOL, UDP_PROTOCOL:
+	case ICMP_PROTOCOL:
+		proto = ICMPV6_PROTOCOL
+	default:
+		return nil
+	}
+
+	payload := packet[headerLen:total]
+	out := make([]byte, IPV6_HEADER_LEN+len(payload))
+	ip := out[:IPV6_HEADER_LEN]
+	ip[0] = 0x60 | packet[1]>>4
+	ip[1] = packet[1] << 4
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(payload)))
+	ip[6] = proto
+	ip[7] = packet[8]
+	copy(ip[8:24], nat64Prefix.IP)
+	copy(ip[20:24], packet[12:16])
+	copy(ip[24:40], dst)
+
+	body := out[IPV6_HEADER_LEN:]
+	copy(body, payload)
+	if !translateL4(body, proto, ip[8:40]) {
+		return nil
+	}
+	return out
+}
+
+// translateL4 rewrites the ICMP echo type of body and computes its
+// checksum again, addrs are the source and destination of the new header.
+func translateL4(body []byte, proto byte, addrs []byte) bool {
+	var sum uint32
+	offset := 0
+	switch proto {
+	case TCP_PROTOCOL:
+		offset = 16
+	case UDP_PROTOCOL:
+		offset = 6
+	case ICMP_PROTOCOL:
+		if len(body) < 8 {
+			return false
+		}
+		switch body[0] {
+		case ICMPV6_ECHO_REQUEST:
+			body[0] = ICMP_ECHO_REQUEST
+		case ICMPV6_ECHO_REPLY:
+			body[0] = ICMP_ECHO_REPLY
+		default:
+			return false
+		}
+		body[2], body[3] = 0, 0
+		binary.BigEndian.PutUint16(body[2:], checksum(body, 0))
+		return true
+	case ICMPV6_PROTOCOL:
+		if len(body) < 8 {
+			return false
+		}
+		switch body[0] {
+		case ICMP_ECHO_REQUEST:
+			body[0] = ICMPV6_ECHO_REQUEST
+		case ICMP_ECHO_REPLY:
+			body[0] = ICMPV6_ECHO_REPLY
+		default:
+			return false
+		}
+		offset = 2
+	}
+	if len(body) < offset+2 {
+		return false
+	}
+
+	// pseudo header: addresses, upper layer length and protocol
+	sum = sum16(addrs, sum)
+	sum += uint32(len(body)) + uint32(proto)
+	body[offset], body[offset+1] = 0, 0
+	c := checksum(body, sum)
+	if proto == UDP_PROTOCOL && c == 0 {
+		c = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(body[offset:], c)
+	return true
+}
@@ -0,0 +1,80 @@
+package network
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	NETWATCH_DEBOUNCE = 2 * time.Second
+)
+
+// WatchNetwork calls onChange whenever the addresses of the physical
+// interfaces change, e.g. when a laptop moves to another network. The
+// interface named ignore (the tun device) is not taken into account. It
+// stops watching when ctx is done.
+func WatchNetwork(ctx context.Context, ignore string, onChange func()) error {
+	events, err := netChangeEvents(ctx)
+	if err != nil {
+		return err
+	}
+
+	last := networkFingerprint(ignore)
+	go func() {
+		for range events {
+			select {
+			case <-time.After(NETWATCH_DEBOUNCE):
+			case <-ctx.Done():
+				return
+			}
+			drainEvents(events)
+
+			current := networkFingerprint(ignore)
+			if current == last {
+				continue
+			}
+			last = current
+			onChange()
+		}
+	}()
+	return nil
+}
+
+func drainEvents(events <-chan struct{}) {
+	for {
+		select {
+		case <-events:
+		default:
+			return
+		}
+	}
+}
+
+func networkFingerprint(ignore string) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	var list []string
+	for _, i := range ifaces {
+		if i.Name == ignore || i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			list = append(list, i.Name+"="+addr.String())
+		}
+	}
+
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
@@ -0,0 +1,55 @@
+package network
+
+import (
+	"context"
+
+	"golang.org/x/sys/unix"
+)
+
+// netChangeEvents listens on a netlink socket for link and address changes
+// until ctx is done.
+func netChangeEvents(ctx context.Context) (<-chan struct{}, error) {
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+
+	saddr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}
+	err = unix.Bind(sock, saddr)
+	if err != nil {
+		unix.Close(sock)
+		return nil, err
+	}
+
+	// closing the socket does not wake up Recvfrom, time out to see ctx
+	err = unix.SetsockoptTimeval(sock, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1})
+	if err != nil {
+		unix.Close(sock)
+		return nil, err
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		defer unix.Close(sock)
+		defer close(events)
+		msg := make([]byte, 1<<16)
+		for ctx.Err() == nil {
+			_, _, err := unix.Recvfrom(sock, msg, 0)
+			if err != nil {
+				if err == unix.EINTR || err == unix.EAGAIN {
+					continue
+				}
+				return
+			}
+
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
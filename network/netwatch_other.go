@@ -0,0 +1,36 @@
+//go:build !linux && !windows
+
+package network
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	NETWATCH_POLL_INTERVAL = 5 * time.Second
+)
+
+// netChangeEvents has no native notification here, the interfaces are
+// polled until ctx is done instead and WatchNetwork compares the result.
+func netChangeEvents(ctx context.Context) (<-chan struct{}, error) {
+	events := make(chan struct{}, 1)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(NETWATCH_POLL_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
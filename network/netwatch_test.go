@@ -0,0 +1,30 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNetChangeEventsStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := netChangeEvents(ctx)
+	if err != nil {
+		t.Skip("no network notification here:", err)
+	}
+	// let it wait for a change first
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	timeout := time.After(NETWATCH_DEBOUNCE + 2*time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("still watching once ctx is done")
+		}
+	}
+}
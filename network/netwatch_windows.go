@@ -0,0 +1,42 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	iphlpapi                    = windows.NewLazySystemDLL("iphlpapi.dll")
+	procNotifyIpInterfaceChange = iphlpapi.NewProc("NotifyIpInterfaceChange")
+	procCancelMibChangeNotify2  = iphlpapi.NewProc("CancelMibChangeNotify2")
+)
+
+// netChangeEvents has Windows call back on every interface change until ctx
+// is done.
+func netChangeEvents(ctx context.Context) (<-chan struct{}, error) {
+	events := make(chan struct{}, 1)
+	callback := windows.NewCallback(func(callerContext, row, notificationType uintptr) uintptr {
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+		return 0
+	})
+
+	var handle windows.Handle
+	r, _, _ := procNotifyIpInterfaceChange.Call(windows.AF_UNSPEC, callback, 0, 0, uintptr(unsafe.Pointer(&handle)))
+	if r != 0 {
+		return nil, fmt.Errorf("NotifyIpInterfaceChange: %v", windows.Errno(r))
+	}
+
+	go func() {
+		<-ctx.Done()
+		// returns once the running callbacks are done, none comes after
+		procCancelMibChangeNotify2.Call(uintptr(handle))
+		close(events)
+	}()
+	return events, nil
+}
@@ -20,6 +20,16 @@ type WindowsRouter struct {
 	Metric      string
 }
 
+type LinuxRouter struct {
+	Gateway   string
+	Interface string
+}
+
+type DarwinRouter struct {
+	Gateway   string
+	Interface string
+}
+
 type PacketHeader struct {
 	IPSrc    net.IP
 	IPDst    net.IP
@@ -27,18 +37,35 @@ type PacketHeader struct {
 	Protocol string
 }
 
+const (
+	IPV4_HEADER_LEN = 20
+	IPV6_HEADER_LEN = 40
+)
+
+// ParseHeaderPacket reads the addresses of an IP packet. Packets that are
+// too short for their version come back as an empty header.
 func ParseHeaderPacket(buf []byte) PacketHeader {
 	var ipHeader PacketHeader
+	if len(buf) < 1 {
+		return ipHeader
+	}
+
 	switch buf[0] & 0xF0 {
 	case 0x40:
+		if len(buf) < IPV4_HEADER_LEN {
+			break
+		}
 		ipHeader.IPSrc = net.IP(buf[12:16])
 		ipHeader.IPDst = net.IP(buf[16:20])
 		ipHeader.Protocol = fmt.Sprintf("%d", buf[9])
 	case 0x60:
+		if len(buf) < IPV6_HEADER_LEN {
+			break
+		}
 		ipHeader.IsIPv6 = true
 		ipHeader.IPSrc = net.IP(buf[8:24])
 		ipHeader.IPDst = net.IP(buf[24:40])
-		ipHeader.Protocol = fmt.Sprintf("%d", buf[7])
+		ipHeader.Protocol = fmt.Sprintf("%d", buf[6])
 	}
 
 	// switch buf[0] & 0xF0 {
@@ -51,7 +78,7 @@ func ParseHeaderPacket(buf []byte) PacketHeader {
 	// case 0x60:
 	// 	fmt.Println("received ipv6")
 	// 	fmt.Printf("Length: %d\n", binary.BigEndian.Uint16(buf[4:6]))
-	// 	fmt.Printf("Protocol: %d (1=ICMP, 6=TCP, 17=UDP)\n", buf[7])
+	// 	fmt.Printf("Next header: %d (1=ICMP, 6=TCP, 17=UDP)\n", buf[6])
 	// 	fmt.Printf("Source IP: %s\n", net.IP(buf[8:24]))
 	// 	fmt.Printf("Destination IP: %s\n", net.IP(buf[24:40]))
 	// }
@@ -99,6 +126,131 @@ func GetDefaultGatewayWindows() (WindowsRouter, error) {
 
 }
 
+// GetDefaultGateway6Windows returns the IPv6 default route, Interface is
+// the index of its interface.
+func GetDefaultGateway6Windows() (WindowsRouter, error) {
+	var route = WindowsRouter{}
+	routeCmd := exec.Command("netsh", "interface", "ipv6", "show", "route")
+	output, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return route, fmt.Errorf("get default ipv6 gateway err: %v", err)
+	}
+
+	// No       Manual    256  ::/0                       12  fe80::1
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[3] != "::/0" {
+			continue
+		}
+
+		route = WindowsRouter{
+			Destination: fields[3],
+			Netmask:     "0",
+			Interface:   fields[4],
+			Metric:      fields[2],
+		}
+		if net.ParseIP(fields[5]) != nil {
+			route.Gateway = fields[5]
+		}
+		return route, nil
+	}
+
+	return route, fmt.Errorf("get default ipv6 gateway err: no gateway")
+}
+
+func GetDefaultGatewayLinux() (LinuxRouter, error) {
+	var route = LinuxRouter{}
+	routeCmd := exec.Command("/sbin/ip", "route", "show", "default")
+	output, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return route, fmt.Errorf("get default gateway err: %v", err)
+	}
+
+	// default via 192.168.1.1 dev eth0 proto dhcp metric 100
+	line := strings.SplitN(string(output), "\n", 2)[0]
+	fields := strings.Fields(line)
+	for idx := 0; idx+1 < len(fields); idx++ {
+		switch fields[idx] {
+		case "via":
+			route.Gateway = fields[idx+1]
+		case "dev":
+			route.Interface = fields[idx+1]
+		}
+	}
+
+	if len(route.Interface) < 1 {
+		return route, fmt.Errorf("get default gateway err: no gateway")
+	}
+
+	return route, nil
+}
+
+// GetDefaultGatewayDarwin reads the default route of macOS, Gateway is
+// empty when it goes straight through an interface (ppp, another utun).
+func GetDefaultGatewayDarwin() (DarwinRouter, error) {
+	var route = DarwinRouter{}
+	routeCmd := exec.Command("/sbin/route", "-n", "get", "default")
+	output, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return route, fmt.Errorf("get default gateway err: %v", err)
+	}
+
+	//    route to: default
+	// destination: default
+	//     gateway: 192.168.1.1
+	//   interface: en0
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "gateway:":
+			if net.ParseIP(fields[1]) != nil {
+				route.Gateway = fields[1]
+			}
+		case "interface:":
+			route.Interface = fields[1]
+		}
+	}
+
+	if len(route.Interface) < 1 {
+		return route, fmt.Errorf("get default gateway err: no gateway")
+	}
+
+	return route, nil
+}
+
+// EgressInterface returns the interface used to reach dst (host:port).
+func EgressInterface(dst string) (net.Interface, error) {
+	conn, err := net.Dial("udp", dst)
+	if err != nil {
+		return net.Interface{}, err
+	}
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return net.Interface{}, fmt.Errorf("get list interface err: %v", err)
+	}
+
+	for _, i := range ifaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(localIP) {
+				return i, nil
+			}
+		}
+	}
+
+	return net.Interface{}, fmt.Errorf("no interface with address %s", localIP)
+}
+
 func FindPhysicalInterface(DstTest string) (net.Interface, error) {
 	var p physicalInterface
 	p.DstTest = DstTest
@@ -172,6 +324,15 @@ func CIDRToMask(ip string) string {
 	return ipv4MaskString(ipv4Net.Mask)
 }
 
+// IsIPv6 tells whether an address or a CIDR is an IPv6 one.
+func IsIPv6(addr string) bool {
+	ip, _, err := net.ParseCIDR(addr)
+	if err != nil {
+		ip = net.ParseIP(addr)
+	}
+	return ip != nil && ip.To4() == nil
+}
+
 func GetIp(str string) string {
 	if strings.Contains(str, ":") {
 		return str[:strings.Index(str, ":")]
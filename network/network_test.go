@@ -0,0 +1,135 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func FuzzParseHeaderPacket(f *testing.F) {
+	v4 := make([]byte, IPV4_HEADER_LEN)
+	v4[0], v4[9] = 0x45, 17
+	copy(v4[12:], net.IP{172, 16, 0, 2}.To4())
+	copy(v4[16:], net.IP{8, 8, 8, 8}.To4())
+	v6 := make([]byte, IPV6_HEADER_LEN)
+	v6[0], v6[6] = 0x60, 58
+	copy(v6[8:], net.ParseIP("fd00::2"))
+	copy(v6[24:], net.ParseIP("2001:db8::1"))
+
+	f.Add([]byte{})
+	f.Add([]byte{0x45})
+	f.Add(v4)
+	f.Add(v4[:IPV4_HEADER_LEN-1])
+	f.Add(v6)
+	f.Add(v6[:IPV6_HEADER_LEN-1])
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		header := ParseHeaderPacket(buf)
+		if header.IPSrc == nil {
+			if header.IPDst != nil || header.IsIPv6 {
+				t.Fatalf("partial header %+v", header)
+			}
+			return
+		}
+
+		want := net.IPv4len
+		if header.IsIPv6 {
+			want = net.IPv6len
+		}
+		if len(header.IPSrc) != want || len(header.IPDst) != want {
+			t.Fatalf("addresses of %d and %d bytes, want %d", len(header.IPSrc), len(header.IPDst), want)
+		}
+	})
+}
+
+func TestParseHeaderPacket(t *testing.T) {
+	packet := make([]byte, IPV4_HEADER_LEN)
+	packet[0], packet[9] = 0x45, 6
+	copy(packet[12:], net.IP{172, 16, 0, 2}.To4())
+	copy(packet[16:], net.IP{8, 8, 8, 8}.To4())
+
+	header := ParseHeaderPacket(packet)
+	if header.IsIPv6 || header.IPSrc.String() != "172.16.0.2" || header.IPDst.String() != "8.8.8.8" || header.Protocol != "6" {
+		t.Fatalf("got %+v", header)
+	}
+}
+
+func TestICMPUnreachableWithoutSource(t *testing.T) {
+	v4 := make([]byte, IPV4_HEADER_LEN+8)
+	v4[0], v4[9] = 0x45, 17
+	copy(v4[12:], net.IP{172, 16, 0, 2}.To4())
+	copy(v4[16:], net.IP{8, 8, 8, 8}.To4())
+	v6 := make([]byte, IPV6_HEADER_LEN+8)
+	v6[0], v6[6] = 0x60, 17
+	copy(v6[8:], net.ParseIP("fd00::2"))
+	copy(v6[24:], net.ParseIP("2001:db8::1"))
+
+	for _, packet := range [][]byte{v4, v6} {
+		if reply := ICMPUnreachable(packet, nil); reply != nil {
+			t.Errorf("answered %x without a source", reply)
+		}
+	}
+	if ICMPUnreachable(v6, net.ParseIP("fd00::1")) == nil {
+		t.Error("no answer from a source")
+	}
+}
+
+func TestParseHeaderPacketIPv6(t *testing.T) {
+	packet := make([]byte, IPV6_HEADER_LEN)
+	// next header 17 (UDP), hop limit 64
+	packet[0], packet[6], packet[7] = 0x60, 17, 64
+	copy(packet[8:], net.ParseIP("fd00::2"))
+	copy(packet[24:], net.ParseIP("2001:db8::1"))
+
+	header := ParseHeaderPacket(packet)
+	if !header.IsIPv6 || header.IPSrc.String() != "fd00::2" || header.IPDst.String() != "2001:db8::1" || header.Protocol != "17" {
+		t.Fatalf("got %+v", header)
+	}
+}
+
+// testFlowPacket is an IPv4 packet of proto from srcPort to dstPort.
+func testFlowPacket(proto byte, srcPort, dstPort uint16, payload []byte) []byte {
+	header := 8
+	if proto == TCP_PROTOCOL {
+		header = 20
+	}
+	packet := make([]byte, IPV4_HEADER_LEN+header, IPV4_HEADER_LEN+header+len(payload))
+	packet[0], packet[9] = 0x45, proto
+	binary.BigEndian.PutUint16(packet[IPV4_HEADER_LEN:], srcPort)
+	binary.BigEndian.PutUint16(packet[IPV4_HEADER_LEN+2:], dstPort)
+	if proto == TCP_PROTOCOL {
+		packet[IPV4_HEADER_LEN+12] = 5 << 4
+	}
+	return append(packet, payload...)
+}
+
+func TestLooksEncrypted(t *testing.T) {
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n"), 8)
+	random := make([]byte, 512)
+	rand.Read(random)
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   bool
+	}{
+		{"https", testFlowPacket(TCP_PROTOCOL, 50000, 443, text), true},
+		{"https reply", testFlowPacket(TCP_PROTOCOL, 443, 50000, text), true},
+		{"ssh", testFlowPacket(TCP_PROTOCOL, 50000, 22, nil), true},
+		{"quic", testFlowPacket(UDP_PROTOCOL, 50000, 443, text), true},
+		{"http", testFlowPacket(TCP_PROTOCOL, 50000, 80, text), false},
+		{"dns", testFlowPacket(UDP_PROTOCOL, 50000, 53, text), false},
+		{"random tcp", testFlowPacket(TCP_PROTOCOL, 50000, 8080, random), true},
+		{"random udp", testFlowPacket(UDP_PROTOCOL, 50000, 4500, random), true},
+		{"short random", testFlowPacket(UDP_PROTOCOL, 50000, 4500, random[:ENTROPY_SAMPLE-1]), false},
+		{"esp", func() []byte { p := testFlowPacket(UDP_PROTOCOL, 0, 0, nil); p[9] = ESP_PROTOCOL; return p }(), true},
+		{"truncated", testFlowPacket(TCP_PROTOCOL, 50000, 80, nil)[:IPV4_HEADER_LEN+4], false},
+		{"empty", nil, false},
+	}
+	for _, test := range tests {
+		if got := LooksEncrypted(test.packet); got != test.want {
+			t.Errorf("%s: LooksEncrypted = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// IPPool hands out the addresses of a network to users that have no static
+// address, one address per user.
+type IPPool struct {
+	mu       sync.Mutex
+	network  *net.IPNet
+	first    uint32
+	last     uint32
+	reserved map[uint32]bool
+	leases   map[string]uint32
+	users    map[uint32]string
+	// held are the leases of disconnected users kept until then
+	held map[string]time.Time
+}
+
+// NewIPPool creates a pool of the IPv4 network cidr, its network and
+// broadcast addresses and reserved are never handed out.
+func NewIPPool(cidr string, reserved []string) (*IPPool, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pool %s: %v", cidr, err)
+	}
+	if ipNet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid pool %s: only ipv4 is supported", cidr)
+	}
+
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("invalid pool %s: too small", cidr)
+	}
+
+	base := binary.BigEndian.Uint32(ipNet.IP.To4())
+	p := &IPPool{
+		network:  ipNet,
+		first:    base + 1,
+		last:     base + 1<<(bits-ones) - 2,
+		reserved: make(map[uint32]bool, 0),
+		leases:   make(map[string]uint32, 0),
+		users:    make(map[uint32]string, 0),
+		held:     make(map[string]time.Time, 0),
+	}
+
+	for _, r := range reserved {
+		ip := net.ParseIP(r).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid reserved ip %s", r)
+		}
+		p.reserved[binary.BigEndian.Uint32(ip)] = true
+	}
+	return p, nil
+}
+
+// Contains tells whether ip belongs to the pool.
+func (p *IPPool) Contains(ip net.IP) bool {
+	return p.network.Contains(ip)
+}
+
+// Allocate returns the address of user, a new one if it has none.
+func (p *IPPool) Allocate(user string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ip, found := p.leases[user]; found {
+		delete(p.held, user)
+		return uint32ToIP(ip), nil
+	}
+
+	for ip := p.first; ip <= p.last; ip++ {
+		if p.reserved[ip] || len(p.users[ip]) > 0 {
+			continue
+		}
+		p.leases[user] = ip
+		p.users[ip] = user
+		return uint32ToIP(ip), nil
+	}
+	return "", fmt.Errorf("pool %s is exhausted", p.network)
+}
+
+// Release gives the address of user back to the pool.
+func (p *IPPool) Release(user string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ip, found := p.leases[user]; found {
+		delete(p.users, ip)
+		delete(p.leases, user)
+		delete(p.held, user)
+	}
+}
+
+// Hold keeps the address of a disconnected user for it until until, so it
+// gets it back when it reconnects before. Reap releases it afterwards.
+func (p *IPPool) Hold(user string, until time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, found := p.leases[user]; found {
+		p.held[user] = until
+	}
+}
+
+// Reap releases the addresses held past now and returns their users.
+func (p *IPPool) Reap(now time.Time) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var released []string
+	for user, until := range p.held {
+		if now.Before(until) {
+			continue
+		}
+		delete(p.users, p.leases[user])
+		delete(p.leases, user)
+		delete(p.held, user)
+		released = append(released, user)
+	}
+	return released
+}
+
+func uint32ToIP(n uint32) string {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip.String()
+}
@@ -0,0 +1,145 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	TCP_PROTOCOL = 6
+	UDP_PROTOCOL = 17
+
+	DROP_NOT_IP    = "not_ip"
+	DROP_MALFORMED = "malformed"
+	DROP_BROADCAST = "broadcast"
+	DROP_MULTICAST = "multicast"
+	DROP_PROTOCOL  = "protocol"
+	DROP_ZERO_ADDR = "unspecified"
+)
+
+// ValidatePacket checks that packet is a well-formed unicast IPv4 or IPv6
+// packet carrying TCP, UDP or ICMP. It returns the DROP_* reason of a packet
+// that is not, or "" if it is.
+func ValidatePacket(packet []byte) string {
+	if len(packet) < 1 {
+		return DROP_MALFORMED
+	}
+
+	var src, dst net.IP
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < IPV4_HEADER_LEN {
+			return DROP_MALFORMED
+		}
+		headerLen := int(packet[0]&0x0F) * 4
+		totalLen := int(binary.BigEndian.Uint16(packet[2:4]))
+		if headerLen < IPV4_HEADER_LEN || headerLen > totalLen || totalLen > len(packet) {
+			return DROP_MALFORMED
+		}
+		if checksum(packet[:headerLen], 0) != 0 {
+			return DROP_MALFORMED
+		}
+		switch packet[9] {
+		case ICMP_PROTOCOL, TCP_PROTOCOL, UDP_PROTOCOL:
+		default:
+			return DROP_PROTOCOL
+		}
+		src, dst = net.IP(packet[12:16]), net.IP(packet[16:20])
+		if dst.Equal(net.IPv4bcast) {
+			return DROP_BROADCAST
+		}
+	case 6:
+		if len(packet) < IPV6_HEADER_LEN {
+			return DROP_MALFORMED
+		}
+		if IPV6_HEADER_LEN+int(binary.BigEndian.Uint16(packet[4:6])) > len(packet) {
+			return DROP_MALFORMED
+		}
+		// extension headers are dropped too, hardly any legit traffic
+		// through a tunnel needs them
+		switch packet[6] {
+		case ICMPV6_PROTOCOL, TCP_PROTOCOL, UDP_PROTOCOL:
+		default:
+			return DROP_PROTOCOL
+		}
+		src, dst = net.IP(packet[8:24]), net.IP(packet[24:40])
+	default:
+		return DROP_NOT_IP
+	}
+
+	if src.IsMulticast() || dst.IsMulticast() {
+		return DROP_MULTICAST
+	}
+	if src.IsUnspecified() || dst.IsUnspecified() {
+		return DROP_ZERO_ADDR
+	}
+	return ""
+}
+
+// DstPort returns the destination port of a TCP or UDP packet.
+func DstPort(packet []byte) (uint16, bool) {
+	if len(packet) < 1 {
+		return 0, false
+	}
+
+	var proto byte
+	offset := 0
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < IPV4_HEADER_LEN {
+			return 0, false
+		}
+		proto = packet[9]
+		offset = int(packet[0]&0x0F) * 4
+	case 6:
+		if len(packet) < IPV6_HEADER_LEN {
+			return 0, false
+		}
+		proto = packet[6]
+		offset = IPV6_HEADER_LEN
+	default:
+		return 0, false
+	}
+
+	if (proto != TCP_PROTOCOL && proto != UDP_PROTOCOL) || len(packet) < offset+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(packet[offset+2:]), true
+}
+
+// TCPSegment returns the ports, sequence number and payload length of a
+// TCP packet without IPv6 extension headers.
+func TCPSegment(packet []byte) (srcPort, dstPort uint16, seq uint32, payload int, ok bool) {
+	if len(packet) < 1 {
+		return
+	}
+
+	var proto byte
+	offset := 0
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < IPV4_HEADER_LEN {
+			return
+		}
+		proto = packet[9]
+		offset = int(packet[0]&0x0F) * 4
+	case 6:
+		if len(packet) < IPV6_HEADER_LEN {
+			return
+		}
+		proto = packet[6]
+		offset = IPV6_HEADER_LEN
+	default:
+		return
+	}
+
+	if proto != TCP_PROTOCOL || len(packet) < offset+20 {
+		return
+	}
+	tcp := packet[offset:]
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || len(tcp) < dataOffset {
+		return
+	}
+	return binary.BigEndian.Uint16(tcp), binary.BigEndian.Uint16(tcp[2:]), binary.BigEndian.Uint32(tcp[4:]), len(tcp) - dataOffset, true
+}
@@ -0,0 +1,94 @@
+package tun
+
+import (
+	"os"
+	"sync"
+)
+
+const MEMORY_QUEUE_LEN = 256
+
+// MemoryDevice is a tun device without the OS: what is injected is read by
+// the tunnel and what the tunnel writes comes out of Received. It lets the
+// tunnel run in tests and demos without root.
+type MemoryDevice struct {
+	name      string
+	mtu       int
+	in        chan []byte
+	out       chan []byte
+	events    chan Event
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func CreateMemoryTUN(name string, mtu int) *MemoryDevice {
+	return &MemoryDevice{
+		name:   name,
+		mtu:    mtu,
+		in:     make(chan []byte, MEMORY_QUEUE_LEN),
+		out:    make(chan []byte, MEMORY_QUEUE_LEN),
+		events: make(chan Event, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// Inject hands a packet to the tunnel as if the OS had routed it there.
+func (t *MemoryDevice) Inject(packet []byte) error {
+	select {
+	case t.in <- append([]byte(nil), packet...):
+		return nil
+	case <-t.closed:
+		return os.ErrClosed
+	}
+}
+
+// Received returns the packets the tunnel delivered to the device.
+func (t *MemoryDevice) Received() <-chan []byte {
+	return t.out
+}
+
+func (t *MemoryDevice) File() *os.File {
+	return nil
+}
+
+func (t *MemoryDevice) Read(buf []byte, offset int) (int, error) {
+	select {
+	case packet := <-t.in:
+		return copy(buf[offset:], packet), nil
+	case <-t.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (t *MemoryDevice) Write(buf []byte, offset int) (int, error) {
+	packet := append([]byte(nil), buf[offset:]...)
+	select {
+	case t.out <- packet:
+		return len(packet), nil
+	case <-t.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (t *MemoryDevice) Flush() error {
+	return nil
+}
+
+func (t *MemoryDevice) MTU() (int, error) {
+	return t.mtu, nil
+}
+
+func (t *MemoryDevice) Name() (string, error) {
+	return t.name, nil
+}
+
+func (t *MemoryDevice) Events() chan Event {
+	return t.events
+}
+
+func (t *MemoryDevice) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		close(t.events)
+	})
+	return nil
+}
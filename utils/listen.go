@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	UNIX_SOCKET_PREFIX    = "unix:"
+	HTTP_SHUTDOWN_TIMEOUT = 5 * time.Second
+)
+
+// ServeHTTP serves handler on addr until ctx is done, "unix:/path" listens
+// on a unix socket and anything else on tcp. A tcp address outside the
+// loopback is only accepted with a certificate and a bearer token.
+func ServeHTTP(ctx context.Context, addr, certFile, keyFile, token string, handler http.Handler) error {
+	if len(token) > 0 {
+		handler = requireToken(token, handler)
+	}
+	srv := &http.Server{Addr: addr, Handler: handler}
+
+	if strings.HasPrefix(addr, UNIX_SOCKET_PREFIX) {
+		path := strings.TrimPrefix(addr, UNIX_SOCKET_PREFIX)
+		os.Remove(path)
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return err
+		}
+
+		err = os.Chmod(path, 0600)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		return serveUntil(ctx, srv, func() error { return srv.Serve(ln) })
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	tls := len(certFile) > 0 && len(keyFile) > 0
+	if (ip == nil || !ip.IsLoopback()) && (!tls || len(token) < 1) {
+		return fmt.Errorf("%s is not a loopback address, a certificate and a token are required", addr)
+	}
+
+	if tls {
+		return serveUntil(ctx, srv, func() error { return srv.ListenAndServeTLS(certFile, keyFile) })
+	}
+	return serveUntil(ctx, srv, srv.ListenAndServe)
+}
+
+// serveUntil runs serve until it fails or ctx is done. Then srv stops
+// listening before serve returns, and the running requests get
+// HTTP_SHUTDOWN_TIMEOUT to finish.
+func serveUntil(ctx context.Context, srv *http.Server, serve func() error) error {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), HTTP_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	err := serve()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Request sends a POST to path on a server started with ServeHTTP and
+// returns the body of the answer.
+func Request(addr, token, path string) (string, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	url := "http://" + addr + path
+	if strings.HasPrefix(addr, UNIX_SOCKET_PREFIX) {
+		socket := strings.TrimPrefix(addr, UNIX_SOCKET_PREFIX)
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		url = "http://unix" + path
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return string(b), nil
+}
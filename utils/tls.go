@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"hivpn/log"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	ACME_DEFAULT_DIR = "acme-certs"
+	ACME_HTTP_ADDR   = ":80"
+)
+
+// ServerTLSConfig returns the certificate of the server: the given files
+// when set, otherwise one obtained and renewed from Let's Encrypt for
+// domain and cached in dir. The second is then the handler of the http
+// challenge, to run with ServeACMEChallenge.
+func ServerTLSConfig(certFile, keyFile, domain, dir, email string) (*tls.Config, http.Handler, error) {
+	if len(certFile) > 0 && len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("load certificate error: %v", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil, nil
+	}
+
+	if len(domain) < 1 {
+		return nil, nil, fmt.Errorf("acme needs the domain of the server in HostHeader")
+	}
+	if len(dir) < 1 {
+		dir = ACME_DEFAULT_DIR
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domain),
+		Cache:      autocert.DirCache(dir),
+		Email:      email,
+	}
+
+	return m.TLSConfig(), m.HTTPHandler(nil), nil
+}
+
+// ServeACMEChallenge answers the http challenge on port 80 until ctx is
+// done. The tls-alpn challenge is answered by the tls listener itself, the
+// http one only works when port 80 is free.
+func ServeACMEChallenge(ctx context.Context, handler http.Handler) {
+	srv := &http.Server{Addr: ACME_HTTP_ADDR, Handler: handler}
+	err := serveUntil(ctx, srv, srv.ListenAndServe)
+	if err != nil {
+		log.Debug("acme http challenge listener:", err)
+	}
+}
@@ -2,23 +2,27 @@ package utils
 
 import (
 	"fmt"
+	"hivpn/log"
+	"io"
 	"net"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// DNS_MAX_RETRY_DELAY caps the backoff of ValidServerRetry
+const DNS_MAX_RETRY_DELAY = 30 * time.Second
+
 func GenUUID() string {
 	return strings.ReplaceAll(uuid.New().String(), "-", "")
 }
 
 func ValidServer(server string) (string, string, error) {
-	arr := strings.Split(server, ":")
-	host := server
-	port := "80"
-	if len(arr) > 0 {
-		host = arr[0]
-		port = arr[1]
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, "80"
 	}
 
 	if checkNotIPAddress(host) {
@@ -31,16 +35,64 @@ func ValidServer(server string) (string, string, error) {
 			return "", "", fmt.Errorf("dns lookup %s not found", host)
 		}
 
-		for _, ip := range ips {
-			if ip.To4() != nil {
-				return host, ip.String() + ":" + port, nil
+		// ipv4 first, a host with only ipv6 is reached over it
+		ip := ips[0]
+		for _, addr := range ips {
+			if addr.To4() != nil {
+				ip = addr
+				break
 			}
 		}
+		return host, net.JoinHostPort(ip.String(), port), nil
 	}
 
-	return host, server, nil
+	return host, net.JoinHostPort(host, port), nil
+}
+
+// ValidServerRetry is ValidServer trying again up to retries times when the
+// lookup fails, waiting delay on clock at first and twice as long each time.
+func ValidServerRetry(server string, retries int, delay time.Duration, clock Clock) (string, string, error) {
+	for try := 0; ; try++ {
+		host, addr, err := ValidServer(server)
+		if err == nil || try >= retries {
+			return host, addr, err
+		}
+
+		log.Info(fmt.Sprintf("Resolve %s failed (%v), try again(%d) in ", server, err, try+1), delay, "...")
+		clock.Sleep(delay)
+		delay *= 2
+		if delay > DNS_MAX_RETRY_DELAY {
+			delay = DNS_MAX_RETRY_DELAY
+		}
+	}
 }
 
 func checkNotIPAddress(ip string) bool {
 	return net.ParseIP(ip) == nil
 }
+
+// PublicIP returns source when it is an ip address, otherwise source is an
+// url of a service answering the caller's address in plain text.
+func PublicIP(source string) (string, error) {
+	if !checkNotIPAddress(source) {
+		return source, nil
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(source)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return "", err
+	}
+
+	ip := strings.TrimSpace(string(b))
+	if checkNotIPAddress(ip) {
+		return "", fmt.Errorf("%s returned an invalid ip: %q", source, ip)
+	}
+	return ip, nil
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// waitFor returns once the code under test waits on clock.
+func waitFor(t *testing.T, clock *FakeClock) {
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Waiters() < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("nothing waits on the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestValidServerRetryBackoff(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	result := make(chan error, 1)
+	go func() {
+		// an empty host fails the lookup without asking a resolver
+		_, _, err := ValidServerRetry(":443", 3, 20*time.Second, clock)
+		result <- err
+	}()
+
+	for _, delay := range []time.Duration{20 * time.Second, DNS_MAX_RETRY_DELAY, DNS_MAX_RETRY_DELAY} {
+		waitFor(t, clock)
+		clock.Advance(delay - time.Millisecond)
+		if clock.Waiters() != 1 {
+			t.Fatalf("retry before %v", delay)
+		}
+		clock.Advance(time.Millisecond)
+	}
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("empty host resolved")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no result after the last retry")
+	}
+}
+
+func TestValidServerAddress(t *testing.T) {
+	for server, want := range map[string]string{
+		"192.0.2.1:443":     "192.0.2.1:443",
+		"192.0.2.1":         "192.0.2.1:80",
+		"[2001:db8::1]:443": "[2001:db8::1]:443",
+		"localhost:443":     "127.0.0.1:443",
+	} {
+		_, addr, err := ValidServer(server)
+		if err != nil || addr != want {
+			t.Errorf("server %s resolved to %q, %v, want %s", server, addr, err, want)
+		}
+	}
+}
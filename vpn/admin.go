@@ -0,0 +1,81 @@
+package vpn
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"hivpn/log"
+	"hivpn/utils"
+	"net/http"
+	"time"
+)
+
+const (
+	// how long the previous password of a rekeyed user keeps working
+	REKEY_GRACE = 15 * time.Minute
+)
+
+// serveAdmin runs the control socket on vpn.conf.AdminAddr. It only listens
+// on a unix socket or the loopback, with StatsToken when one is set.
+func (vpn *VPN) serveAdmin(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/changes", vpn.handlerChanges)
+	if vpn.conf.IsServer {
+		mux.HandleFunc("/rekey", vpn.handlerRekey)
+	} else {
+		mux.HandleFunc("/pause", vpn.handlerPause)
+		mux.HandleFunc("/resume", vpn.handlerPause)
+	}
+
+	log.Info("Admin listening on", vpn.conf.AdminAddr)
+	err := utils.ServeHTTP(ctx, vpn.conf.AdminAddr, "", "", vpn.conf.StatsToken, mux)
+	if err != nil {
+		log.Error("admin endpoint error:", err)
+	}
+}
+
+// handlerRekey gives ?user=<name> a new password and answers it, the old
+// one keeps working for REKEY_GRACE.
+func (vpn *VPN) handlerRekey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("user")
+	password, err := vpn.rekey(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, password)
+}
+
+func (vpn *VPN) rekey(name string) (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	password := base64.RawURLEncoding.EncodeToString(b)
+
+	vpn.usersMu.Lock()
+	defer vpn.usersMu.Unlock()
+	u, found := vpn.userTable[name]
+	if !found {
+		return "", fmt.Errorf("user %s not found", name)
+	}
+
+	key, err := userKey(name, password, u.Salt)
+	if err != nil {
+		return "", err
+	}
+	u.OldPass = u.Pass
+	u.OldPassUntil = vpn.conf.Clock.Now().Add(REKEY_GRACE)
+	u.Pass = key
+	vpn.userTable[name] = u
+
+	log.Info("User", name, "rekeyed, the old password expires at", u.OldPassUntil.Format(time.RFC3339))
+	return password, nil
+}
@@ -0,0 +1,204 @@
+package vpn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hivpn/log"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	AUTH_WEBHOOK_TIMEOUT = 5 * time.Second
+	// AUTH_WEBHOOK_CACHE keeps an answer for the authentication that
+	// follows the handshake of the same connection
+	AUTH_WEBHOOK_CACHE = 10 * time.Second
+	// AUTH_WEBHOOK_REFUSED_CACHE keeps a refusal, a client retrying an
+	// unknown name does not reach the webhook every time
+	AUTH_WEBHOOK_REFUSED_CACHE = 30 * time.Second
+	// the questions about names missing from the cache, per second and at
+	// once, past them the name is refused without asking
+	AUTH_WEBHOOK_ASK_RATE  = 10
+	AUTH_WEBHOOK_ASK_BURST = 20
+)
+
+// Authenticator finds the users of the server. The token of a client is
+// encrypted with the key of its password, which never goes over the
+// network, so a backend gives the server the user with its password
+// (Pass) rather than checking one: an LDAP bind or RADIUS PAP has nothing
+// to check. Lookup returns false for unknown and refused users, and is
+// called for every connection.
+type Authenticator interface {
+	Lookup(name string) (User, bool)
+}
+
+// staticUsers is the table of Users of the config, the default.
+type staticUsers struct {
+	vpn *VPN
+}
+
+func (s staticUsers) Lookup(name string) (User, bool) {
+	s.vpn.usersMu.RLock()
+	defer s.vpn.usersMu.RUnlock()
+	u, found := s.vpn.userTable[name]
+	return u, found
+}
+
+// webhookAuth asks AuthWebhook about the users missing from the table,
+// with a POST of
+//
+//	{"user": "alice"}
+//
+// answered by
+//
+//	{"allow": true, "password": "...", "ip": "172.16.0.20/24", "ip6": "", "routes": ["10.1.0.0/16"], "mtu": 0}
+//
+// An empty ip takes one of the Pool. Group, Quota, Subnets, NAT64 and
+// AllowedPorts are set up with the server and only work from Users.
+type webhookAuth struct {
+	vpn    *VPN
+	static staticUsers
+	client *http.Client
+
+	mu        sync.Mutex
+	cache     map[string]webhookEntry
+	asks      tokenBucket
+	nextPrune time.Time
+}
+
+// webhookEntry is an answer of the webhook, allowed is false for a
+// refusal.
+type webhookEntry struct {
+	user    User
+	allowed bool
+	expires time.Time
+}
+
+type webhookRequest struct {
+	User string `json:"user"`
+}
+
+type webhookResponse struct {
+	Allow    bool     `json:"allow"`
+	Password string   `json:"password"`
+	Salt     string   `json:"salt"`
+	IP       string   `json:"ip"`
+	IP6      string   `json:"ip6"`
+	Routes   []string `json:"routes"`
+	MTU      int      `json:"mtu"`
+}
+
+func (vpn *VPN) newWebhookAuth() *webhookAuth {
+	return &webhookAuth{
+		vpn:    vpn,
+		static: staticUsers{vpn},
+		client: &http.Client{Timeout: AUTH_WEBHOOK_TIMEOUT},
+		cache:  make(map[string]webhookEntry, 0),
+		asks:   tokenBucket{rate: AUTH_WEBHOOK_ASK_RATE, burst: AUTH_WEBHOOK_ASK_BURST, tokens: AUTH_WEBHOOK_ASK_BURST},
+	}
+}
+
+func (w *webhookAuth) Lookup(name string) (User, bool) {
+	if u, found := w.static.Lookup(name); found {
+		return u, true
+	}
+
+	now := w.vpn.conf.Clock.Now()
+	w.mu.Lock()
+	w.prune(now)
+	e, found := w.cache[name]
+	if found && now.Before(e.expires) {
+		w.mu.Unlock()
+		return e.user, e.allowed
+	}
+	if !w.asks.take(now, 1) {
+		w.mu.Unlock()
+		log.Debug("auth webhook asked too often, refuse user", name)
+		return User{}, false
+	}
+	w.mu.Unlock()
+
+	u, ok, err := w.ask(name)
+	if err != nil {
+		log.Error("auth webhook error:", err)
+		return User{}, false
+	}
+	e = webhookEntry{user: u, allowed: true, expires: now.Add(AUTH_WEBHOOK_CACHE)}
+	if !ok {
+		log.Debug("auth webhook refused user", name)
+		e = webhookEntry{expires: now.Add(AUTH_WEBHOOK_REFUSED_CACHE)}
+	}
+
+	w.mu.Lock()
+	w.cache[name] = e
+	w.mu.Unlock()
+	return e.user, e.allowed
+}
+
+// prune drops the expired answers, once every AUTH_WEBHOOK_CACHE, with w.mu
+// held.
+func (w *webhookAuth) prune(now time.Time) {
+	if now.Before(w.nextPrune) {
+		return
+	}
+	w.nextPrune = now.Add(AUTH_WEBHOOK_CACHE)
+	for n, e := range w.cache {
+		if !now.Before(e.expires) {
+			delete(w.cache, n)
+		}
+	}
+}
+
+func (w *webhookAuth) ask(name string) (User, bool, error) {
+	body, err := json.Marshal(webhookRequest{User: name})
+	if err != nil {
+		return User{}, false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.vpn.conf.AuthWebhook, bytes.NewReader(body))
+	if err != nil {
+		return User{}, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.vpn.conf.AuthWebhookToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+w.vpn.conf.AuthWebhookToken)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return User{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return User{}, false, fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+
+	var r webhookResponse
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return User{}, false, fmt.Errorf("decode answer: %v", err)
+	}
+	if !r.Allow {
+		return User{}, false, nil
+	}
+	if len(r.Password) < 1 {
+		return User{}, false, fmt.Errorf("no password for user %s", name)
+	}
+	if len(r.IP) < 1 && w.vpn.pool == nil {
+		return User{}, false, fmt.Errorf("no ip for user %s and no Pool", name)
+	}
+
+	u, err := w.vpn.prepareUser(User{
+		Name:   name,
+		Pass:   r.Password,
+		Salt:   r.Salt,
+		IP:     r.IP,
+		IP6:    r.IP6,
+		Routes: r.Routes,
+		MTU:    r.MTU,
+	})
+	return u, err == nil, err
+}
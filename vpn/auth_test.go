@@ -0,0 +1,87 @@
+package vpn
+
+import (
+	"encoding/json"
+	"fmt"
+	"hivpn/log"
+	"hivpn/utils"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testWebhook is a webhook allowing the users named in allow, and how many
+// times it was asked.
+func testWebhook(t *testing.T, clock utils.Clock, allow ...string) (*webhookAuth, *int64) {
+	log.SetLevel(log.LevelError)
+	asked := new(int64)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(asked, 1)
+		var req webhookRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		resp := webhookResponse{}
+		for _, name := range allow {
+			if name == req.User {
+				resp = webhookResponse{Allow: true, Password: "password", Salt: TEST_SALT, IP: "172.16.0.20/24"}
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+
+	v := &VPN{conf: Config{IsServer: true, MTU: 1500, Clock: clock, AuthWebhook: server.URL}}
+	v.userTable = make(map[string]User, 0)
+	return v.newWebhookAuth(), asked
+}
+
+func TestWebhookCachesRefusals(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	w, asked := testWebhook(t, clock, "alice")
+
+	for i := 0; i < 5; i++ {
+		if _, ok := w.Lookup("alice"); !ok {
+			t.Fatal("allowed user refused")
+		}
+		if _, ok := w.Lookup("mallory"); ok {
+			t.Fatal("refused user allowed")
+		}
+	}
+	if n := atomic.LoadInt64(asked); n != 2 {
+		t.Errorf("webhook asked %d times for two users", n)
+	}
+
+	clock.Advance(AUTH_WEBHOOK_REFUSED_CACHE)
+	w.Lookup("alice")
+	w.Lookup("mallory")
+	if n := atomic.LoadInt64(asked); n != 4 {
+		t.Errorf("webhook asked %d times, want 4 once the answers expired", n)
+	}
+	w.mu.Lock()
+	cached := len(w.cache)
+	w.mu.Unlock()
+	if cached != 2 {
+		t.Errorf("%d answers cached for two users", cached)
+	}
+}
+
+func TestWebhookAskRate(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	w, asked := testWebhook(t, clock)
+
+	// a scan of names gets the burst, then the rate
+	for i := 0; i < 100; i++ {
+		w.Lookup(fmt.Sprintf("user%d", i))
+	}
+	if n := atomic.LoadInt64(asked); n != AUTH_WEBHOOK_ASK_BURST {
+		t.Errorf("webhook asked %d times for 100 names at once, want %d", n, AUTH_WEBHOOK_ASK_BURST)
+	}
+	clock.Advance(time.Second)
+	for i := 100; i < 200; i++ {
+		w.Lookup(fmt.Sprintf("user%d", i))
+	}
+	if n := atomic.LoadInt64(asked); n != AUTH_WEBHOOK_ASK_BURST+AUTH_WEBHOOK_ASK_RATE {
+		t.Errorf("webhook asked %d times a second later, want %d", n, AUTH_WEBHOOK_ASK_BURST+AUTH_WEBHOOK_ASK_RATE)
+	}
+}
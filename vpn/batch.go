@@ -0,0 +1,141 @@
+package vpn
+
+import (
+	"hivpn/log"
+	"hivpn/network"
+	"sync"
+	"time"
+)
+
+const (
+	// BATCH_SMALL_PACKET is the largest packet held back for a batch, the
+	// bigger ones gain little from it and are sent at once
+	BATCH_SMALL_PACKET = 256
+	// BATCH_MAX_BYTES sends a batch before its window is over
+	BATCH_MAX_BYTES = 4096
+)
+
+// batcher holds the small packets to a connection for BatchWindow so they
+// are encrypted and sent as one frame (see network.Batch).
+type batcher struct {
+	mu     sync.Mutex
+	window time.Duration
+	conns  map[interface{}]*batchConn
+	send   func(r network.ARPRecord, data []byte) error
+}
+
+// batchConn is a connection with a batch pending or being sent. Its sends
+// happen with mu held so the packets to it keep their order, while the
+// other connections go on. It leaves conns once it holds no batch.
+type batchConn struct {
+	mu   sync.Mutex
+	conn interface{}
+	p    *batch
+	gone bool
+}
+
+type batch struct {
+	r       network.ARPRecord
+	packets [][]byte
+	size    int
+}
+
+func newBatcher(window time.Duration, send func(r network.ARPRecord, data []byte) error) *batcher {
+	return &batcher{
+		window: window,
+		conns:  make(map[interface{}]*batchConn, 0),
+		send:   send,
+	}
+}
+
+// write sends data to r now or with the next batch.
+func (b *batcher) write(r network.ARPRecord, data []byte) error {
+	big := len(data) > BATCH_SMALL_PACKET
+	for {
+		b.mu.Lock()
+		c := b.conns[r.Conn]
+		if c == nil {
+			if big {
+				// nothing of this connection in flight to keep order with
+				b.mu.Unlock()
+				return b.send(r, data)
+			}
+			c = &batchConn{conn: r.Conn}
+			b.conns[r.Conn] = c
+		}
+		b.mu.Unlock()
+
+		c.mu.Lock()
+		if c.gone {
+			// emptied while we waited, look again
+			c.mu.Unlock()
+			continue
+		}
+		err := b.writeConn(c, r, data, big)
+		c.mu.Unlock()
+		return err
+	}
+}
+
+// writeConn is write with c.mu held.
+func (b *batcher) writeConn(c *batchConn, r network.ARPRecord, data []byte, big bool) error {
+	if big {
+		if c.p != nil {
+			b.flush(c.p)
+		}
+		b.drop(c)
+		return b.send(r, data)
+	}
+
+	// a batch is compressed only when all its packets may be
+	p := c.p
+	if p != nil && !r.Compress {
+		p.r.Compress = false
+	}
+	if p == nil {
+		p = &batch{r: r}
+		c.p = p
+		time.AfterFunc(b.window, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.p == p {
+				b.flush(p)
+				b.drop(c)
+			}
+		})
+	}
+
+	// the readers reuse their buffer
+	packet := make([]byte, len(data))
+	copy(packet, data)
+	p.packets = append(p.packets, packet)
+	p.size += network.BATCH_LENGTH + len(packet)
+	if p.size >= BATCH_MAX_BYTES {
+		b.flush(p)
+		b.drop(c)
+	}
+	return nil
+}
+
+// drop removes c, with c.mu held, once it holds no batch.
+func (b *batcher) drop(c *batchConn) {
+	c.p = nil
+	c.gone = true
+	b.mu.Lock()
+	if b.conns[c.conn] == c {
+		delete(b.conns, c.conn)
+	}
+	b.mu.Unlock()
+}
+
+func (b *batcher) flush(p *batch) {
+	data := p.packets[0]
+	if len(p.packets) > 1 {
+		data = network.Batch(p.packets)
+	}
+
+	err := b.send(p.r, data)
+	if err != nil {
+		log.Debug("write batch error", err)
+	}
+}
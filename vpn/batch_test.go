@@ -0,0 +1,86 @@
+package vpn
+
+import (
+	"bytes"
+	"hivpn/network"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatcherSlowConnection(t *testing.T) {
+	release := make(chan struct{})
+	sent := make(chan string, 16)
+	b := newBatcher(time.Millisecond, func(r network.ARPRecord, data []byte) error {
+		if r.Conn == "slow" {
+			<-release
+		}
+		sent <- r.Conn.(string)
+		return nil
+	})
+
+	// fill a batch of the slow connection, its flush blocks in send
+	go func() {
+		small := make([]byte, BATCH_SMALL_PACKET)
+		for size := 0; size < BATCH_MAX_BYTES; size += network.BATCH_LENGTH + len(small) {
+			b.write(network.ARPRecord{Conn: "slow"}, small)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	b.write(network.ARPRecord{Conn: "fast"}, make([]byte, BATCH_SMALL_PACKET+1))
+	b.write(network.ARPRecord{Conn: "fast"}, make([]byte, 1))
+	for i := 0; i < 2; i++ {
+		select {
+		case conn := <-sent:
+			if conn != "fast" {
+				t.Fatalf("sent to %s", conn)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("a slow connection stalls the others")
+		}
+	}
+	close(release)
+}
+
+func TestBatcherOrder(t *testing.T) {
+	var mu sync.Mutex
+	var frames [][]byte
+	b := newBatcher(time.Hour, func(r network.ARPRecord, data []byte) error {
+		mu.Lock()
+		frames = append(frames, append([]byte{}, data...))
+		mu.Unlock()
+		return nil
+	})
+
+	r := network.ARPRecord{Conn: "conn"}
+	small := []byte{1}
+	big := bytes.Repeat([]byte{2}, BATCH_SMALL_PACKET+1)
+	b.write(r, small)
+	b.write(r, big)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(frames) != 2 || !bytes.Equal(frames[0], small) || !bytes.Equal(frames[1], big) {
+		t.Errorf("sent %d frames, want the small packet then the big one", len(frames))
+	}
+	if len(b.conns) != 0 {
+		t.Errorf("%d connections left without a batch", len(b.conns))
+	}
+}
+
+func TestBatcherCompressAll(t *testing.T) {
+	var compress []bool
+	b := newBatcher(time.Hour, func(r network.ARPRecord, data []byte) error {
+		compress = append(compress, r.Compress)
+		return nil
+	})
+
+	b.write(network.ARPRecord{Conn: "conn", Compress: true}, []byte{1})
+	b.write(network.ARPRecord{Conn: "conn", Compress: false}, []byte{2})
+	b.write(network.ARPRecord{Conn: "conn", Compress: true}, make([]byte, BATCH_SMALL_PACKET+1))
+
+	if len(compress) != 2 || compress[0] || !compress[1] {
+		t.Errorf("compress flags %v, want the batch with a packet not to compress left as it is", compress)
+	}
+}
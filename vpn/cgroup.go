@@ -0,0 +1,79 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	CGROUP_ROOT  = "/sys/fs/cgroup"
+	CGROUP_MARK  = "0x68"
+	CGROUP_TABLE = "104"
+)
+
+// setupCgroup sends only the traffic of the processes in vpn.conf.Cgroup
+// (cgroup v2) through the tunnel: their packets are marked and routed with
+// a dedicated table whose default route is the tun device.
+func (vpn *VPN) setupCgroup() error {
+	err := os.MkdirAll(filepath.Join(CGROUP_ROOT, vpn.conf.Cgroup), 0755)
+	if err != nil {
+		return fmt.Errorf("create cgroup error: %v", err)
+	}
+
+	for _, cmdAgrs := range vpn.cgroupCmds("-A", "add") {
+		err := vpn.runCmd(cmdAgrs[0], cmdAgrs[1:]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vpn *VPN) stopCgroup() {
+	cmds := vpn.cgroupCmds("-D", "del")
+	for i := len(cmds) - 1; i >= 0; i-- {
+		err := vpn.runCmd(cmds[i][0], cmds[i][1:]...)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	// only removed when no process is left in it
+	os.Remove(filepath.Join(CGROUP_ROOT, vpn.conf.Cgroup))
+}
+
+func (vpn *VPN) cgroupCmds(iptablesAction, ipAction string) [][]string {
+	return [][]string{
+		{"iptables", "-t", "mangle", iptablesAction, "OUTPUT", "-m", "cgroup", "--path", vpn.conf.Cgroup, "-j", "MARK", "--set-mark", CGROUP_MARK},
+		{"iptables", "-t", "nat", iptablesAction, "POSTROUTING", "-o", TUN_NAME, "-m", "mark", "--mark", CGROUP_MARK, "-j", "MASQUERADE"},
+		{"/sbin/ip", "route", ipAction, "default", "dev", TUN_NAME, "table", CGROUP_TABLE},
+		{"/sbin/ip", "rule", ipAction, "fwmark", CGROUP_MARK, "table", CGROUP_TABLE},
+	}
+}
+
+// RunInCgroup moves the current process into the cgroup and runs the
+// command there, so it and its children are routed through the tunnel.
+func RunInCgroup(cgroup string, name string, args ...string) (int, error) {
+	procs := filepath.Join(CGROUP_ROOT, cgroup, "cgroup.procs")
+	err := os.WriteFile(procs, []byte(strconv.Itoa(os.Getpid())), 0644)
+	if err != nil {
+		return 1, fmt.Errorf("join cgroup %s error: %v", cgroup, err)
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,268 @@
+package vpn
+
+import (
+	"encoding/json"
+	"hivpn/log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SystemChange is a change hivpn made to the system: a command of runCmd,
+// a file or a device. Undo tells how it is reverted, empty when it goes
+// away with the device.
+type SystemChange struct {
+	Time     time.Time `json:"time"`
+	Change   string    `json:"change"`
+	Error    string    `json:"error,omitempty"`
+	Undo     string    `json:"undo,omitempty"`
+	Reverted bool      `json:"reverted,omitempty"`
+
+	key  string
+	undo func() error
+}
+
+// CHANGELOG_MAX_SETTLED is how many reverted or failed changes the
+// changelog keeps, the outstanding ones are always kept
+const CHANGELOG_MAX_SETTLED = 200
+
+// changelog holds the changes of a VPN in order. stop reverts the ones its
+// teardown left behind, which also tells about cleanup bugs.
+type changelog struct {
+	mu      sync.Mutex
+	changes []*SystemChange
+}
+
+// run runs a command and records it.
+func (l *changelog) run(c string, args ...string) error {
+	err := execCmd(c, args...)
+	l.recordCmd(c, args, err)
+	return err
+}
+
+// recordCmd records a command of run. A command undoing an earlier one
+// marks it reverted rather than being added.
+func (l *changelog) recordCmd(c string, args []string, err error) {
+	cmd := append([]string{c}, args...)
+	key, undo, isUndo := undoCmd(cmd)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil && isUndo && l.resolve(key) {
+		l.compact()
+		return
+	}
+
+	change := &SystemChange{Time: time.Now(), Change: strings.Join(cmd, " ")}
+	if err != nil {
+		change.Error = err.Error()
+	}
+	l.changes = append(l.changes, change)
+	if err == nil && len(key) > 0 && !isUndo {
+		change.key = key
+		change.Undo = strings.Join(undo, " ")
+		change.undo = func() error {
+			return l.run(undo[0], undo[1:]...)
+		}
+	}
+	l.compact()
+}
+
+// record adds a change undone by undo, nil when it goes away with the
+// device, and returns its key for reverted.
+func (l *changelog) record(change, undoDesc string, undo func() error) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.changes = append(l.changes, &SystemChange{
+		Time:   time.Now(),
+		Change: change,
+		Undo:   undoDesc,
+		key:    change,
+		undo:   undo,
+	})
+	l.compact()
+	return change
+}
+
+// reverted marks the change of key undone by the teardown.
+func (l *changelog) reverted(key string) {
+	l.mu.Lock()
+	l.resolve(key)
+	l.compact()
+	l.mu.Unlock()
+}
+
+// resolve marks the latest outstanding change of key reverted, with l.mu
+// held, false when there is none.
+func (l *changelog) resolve(key string) bool {
+	for i := len(l.changes) - 1; i >= 0; i-- {
+		c := l.changes[i]
+		if c.key == key && !c.Reverted {
+			c.Reverted = true
+			return true
+		}
+	}
+	return false
+}
+
+// settled tells whether nothing is left to undo of c.
+func (c *SystemChange) settled() bool {
+	return c.Reverted || len(c.key) < 1
+}
+
+// compact drops the oldest settled changes past CHANGELOG_MAX_SETTLED, with
+// l.mu held. A client reconnecting for days would grow the log forever.
+func (l *changelog) compact() {
+	settled := 0
+	for _, c := range l.changes {
+		if c.settled() {
+			settled++
+		}
+	}
+	if settled <= CHANGELOG_MAX_SETTLED {
+		return
+	}
+
+	drop := settled - CHANGELOG_MAX_SETTLED
+	kept := l.changes[:0]
+	for _, c := range l.changes {
+		if drop > 0 && c.settled() {
+			drop--
+			continue
+		}
+		kept = append(kept, c)
+	}
+	for i := len(kept); i < len(l.changes); i++ {
+		l.changes[i] = nil
+	}
+	l.changes = kept
+}
+
+func (l *changelog) list() []SystemChange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]SystemChange, 0, len(l.changes))
+	for _, c := range l.changes {
+		list = append(list, *c)
+	}
+	return list
+}
+
+// revertAll undoes what is still outstanding, latest first.
+func (l *changelog) revertAll() {
+	l.mu.Lock()
+	var left []*SystemChange
+	for i := len(l.changes) - 1; i >= 0; i-- {
+		c := l.changes[i]
+		if len(c.key) > 0 && !c.Reverted && c.undo != nil {
+			left = append(left, c)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, c := range left {
+		log.Info("Revert", c.Change, "left behind by the teardown")
+		err := c.undo()
+		if err != nil {
+			log.Error("revert", c.Change, "error:", err)
+			continue
+		}
+		// an undone command resolved itself, a file or device did not
+		l.mu.Lock()
+		c.Reverted = true
+		l.compact()
+		l.mu.Unlock()
+	}
+}
+
+// undoCmd returns the key of a command, what undoes it and whether it is
+// itself an undo. The key is the command with its verb as the one adding,
+// so a change and its undo share it. Commands that cannot be undone (the
+// settings of a device) have no key.
+func undoCmd(cmd []string) (string, []string, bool) {
+	verb := -1
+	var add, del string
+	switch cmd[0] {
+	case "/sbin/ip":
+		i := 1
+		if i < len(cmd) && cmd[i] == "-6" {
+			i++
+		}
+		if i+1 < len(cmd) && (cmd[i] == "route" || cmd[i] == "rule" || cmd[i] == "addr") {
+			verb, add, del = i+1, "add", "del"
+		}
+	case "iptables":
+		for i, a := range cmd {
+			if a == "-A" || a == "-I" || a == "-D" {
+				verb, add, del = i, a, "-D"
+				break
+			}
+		}
+	case "route":
+		// windows, delete only takes the destination and its mask
+		if len(cmd) >= 5 {
+			verb, add, del = 1, "add", "delete"
+			cmd = cmd[:5]
+		}
+	case "/sbin/route":
+		// darwin, route -n add|delete takes the same arguments both ways
+		if len(cmd) >= 3 && cmd[1] == "-n" {
+			verb, add, del = 2, "add", "delete"
+		}
+	case "netsh":
+		// windows, the nexthop is not needed to delete
+		if len(cmd) >= 7 && cmd[1] == "interface" && cmd[2] == "ipv6" && cmd[4] == "route" {
+			verb, add, del = 3, "add", "delete"
+			cmd = cmd[:7]
+		}
+	}
+	if verb < 0 {
+		return "", nil, false
+	}
+
+	isUndo := cmd[verb] == "del" || cmd[verb] == "delete" || cmd[verb] == "-D"
+	if !isUndo && cmd[verb] != add {
+		return "", nil, false
+	}
+	key := append([]string{}, cmd...)
+	if add == "-D" || add == "-I" {
+		add = "-A"
+	}
+	key[verb] = add
+	undo := append([]string{}, cmd...)
+	undo[verb] = del
+	return strings.Join(key, " "), undo, isUndo
+}
+
+// deviceGone marks reverted what went away with the device name: itself
+// and the routes and addresses through it.
+func (l *changelog) deviceGone(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.changes {
+		if c.Reverted || len(c.key) < 1 {
+			continue
+		}
+		words := strings.Fields(c.key)
+		for i := 0; i+1 < len(words); i++ {
+			if (words[i] == "dev" || words[i] == "-interface") && words[i+1] == name {
+				c.Reverted = true
+				break
+			}
+		}
+		if c.key == deviceChange(name) {
+			c.Reverted = true
+		}
+	}
+	l.compact()
+}
+
+func deviceChange(name string) string {
+	return "create device " + name
+}
+
+func (vpn *VPN) handlerChanges(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vpn.changes.list())
+}
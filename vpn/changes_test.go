@@ -0,0 +1,63 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestChangelogUndoResolves(t *testing.T) {
+	var l changelog
+	add := []string{"route", "add", "10.0.0.0/8", "dev", "tun0"}
+	del := []string{"route", "del", "10.0.0.0/8", "dev", "tun0"}
+
+	l.recordCmd("/sbin/ip", add, nil)
+	l.recordCmd("/sbin/ip", del, nil)
+	list := l.list()
+	if len(list) != 1 || !list[0].Reverted {
+		t.Fatalf("add and del logged as %+v", list)
+	}
+
+	// an undo with nothing to undo, or failing, is logged
+	l.recordCmd("/sbin/ip", del, nil)
+	l.recordCmd("/sbin/ip", add, nil)
+	l.recordCmd("/sbin/ip", del, errors.New("exit status 2"))
+	list = l.list()
+	if len(list) != 4 || list[2].Reverted || len(list[3].Error) < 1 {
+		t.Fatalf("stray and failed undo logged as %+v", list)
+	}
+}
+
+func TestChangelogCompacts(t *testing.T) {
+	var l changelog
+	l.record(deviceChange("tun0"), "", nil)
+	l.recordCmd("/sbin/ip", strings.Fields("route add default dev tun0"), nil)
+	// a client reconnecting for days
+	for i := 0; i < 10*CHANGELOG_MAX_SETTLED; i++ {
+		route := fmt.Sprintf("10.%d.0.0/16", i%256)
+		l.recordCmd("/sbin/ip", []string{"route", "add", route, "dev", "tun0"}, nil)
+		l.recordCmd("/sbin/ip", []string{"link", "set", "dev", "tun0", "up"}, nil)
+		l.recordCmd("/sbin/ip", []string{"route", "del", route, "dev", "tun0"}, nil)
+	}
+
+	list := l.list()
+	if len(list) != 2+CHANGELOG_MAX_SETTLED {
+		t.Errorf("%d changes kept, want %d", len(list), 2+CHANGELOG_MAX_SETTLED)
+	}
+	if list[0].Change != deviceChange("tun0") || list[1].Reverted {
+		t.Errorf("outstanding changes dropped, first ones %+v %+v", list[0], list[1])
+	}
+	for _, c := range list[2:] {
+		if !c.settled() {
+			t.Fatalf("%+v outstanding", c)
+		}
+	}
+
+	l.deviceGone("tun0")
+	for _, c := range l.list() {
+		if !c.settled() {
+			t.Errorf("%+v outstanding once the device is gone", c)
+		}
+	}
+}
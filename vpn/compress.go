@@ -0,0 +1,68 @@
+package vpn
+
+import (
+	"hivpn/log"
+	"hivpn/network"
+	"strings"
+	"sync/atomic"
+)
+
+// COMPRESS_FLATE is asked for by a client after its token, user:key:flate,
+// which older servers ignore, and granted in the handshake. Each side only
+// compresses what it sends to a peer that agreed, and takes compressed
+// frames from anyone (see network.Compress).
+const COMPRESS_FLATE = "flate"
+
+// compressToken adds the request for compression to the token of a client.
+func (vpn *VPN) compressToken(token string) string {
+	if !vpn.conf.Compress {
+		return token
+	}
+	return token + ":" + COMPRESS_FLATE
+}
+
+// asksCompression tells whether the client of token wants compression.
+func asksCompression(token string) bool {
+	arr := strings.Split(token, ":")
+	if len(arr) < 3 {
+		return false
+	}
+	for _, ask := range arr[2:] {
+		if ask == COMPRESS_FLATE {
+			return true
+		}
+	}
+	return false
+}
+
+// adoptCompression compresses the packets to the server when it agreed in
+// its handshake, an older server says nothing.
+func (vpn *VPN) adoptCompression(hs handshakeData) {
+	granted := vpn.conf.Compress && hs.Compress == COMPRESS_FLATE
+	if vpn.conf.Compress && !granted {
+		log.Info("The server does not compress, send the packets as they are")
+	}
+	var v int32
+	if granted {
+		v = 1
+	}
+	atomic.StoreInt32(&vpn.compressOK, v)
+}
+
+// compresses tells whether the session of token compresses what it sends.
+func (vpn *VPN) compresses(token string) bool {
+	if vpn.conf.IsServer {
+		return vpn.conf.Compress && asksCompression(token)
+	}
+	return atomic.LoadInt32(&vpn.compressOK) == 1
+}
+
+// compressMax bounds what a compressed frame may expand to: a packet of the
+// device, or a batch of small ones.
+func (vpn *VPN) compressMax() int {
+	max := BATCH_MAX_BYTES + BATCH_SMALL_PACKET + network.BATCH_HEADER + network.BATCH_LENGTH
+	if vpn.conf.MTU > max {
+		return vpn.conf.MTU
+	}
+	return max
+}
@@ -0,0 +1,45 @@
+package vpn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hivpn/crypto"
+	"hivpn/log"
+	"hivpn/network"
+	"hivpn/utils"
+	"testing"
+)
+
+func TestEncryptedFlowsNotCompressed(t *testing.T) {
+	log.SetLevel(log.LevelError)
+	key, err := crypto.NewSession([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n"), 8)
+
+	for _, compressEncrypted := range []bool{false, true} {
+		v := &VPN{conf: Config{MTU: 1500, Clock: utils.RealClock, Compress: true, CompressEncrypted: compressEncrypted}}
+		v.getCurrentConnClient = func(ip string) network.ARPRecord {
+			return network.ARPRecord{Conn: "conn", Key: key, Compress: true}
+		}
+		var frame []byte
+		v.OnFuncWriteDevToTun(func(c interface{}, data []byte) error {
+			frame, err = key.Decrypt(data)
+			return err
+		})
+
+		for _, port := range []uint16{53, 443} {
+			packet := udpPacket(testRemoteIP, testClientIP, text)
+			binary.BigEndian.PutUint16(packet[20:], port)
+			if err := v.writeDevToTun(network.ParseHeaderPacket(packet), packet); err != nil {
+				t.Fatal(err)
+			}
+
+			want := port != 443 || compressEncrypted
+			if network.IsCompressed(frame) != want {
+				t.Errorf("CompressEncrypted %v: packet from port %d compressed %v, want %v", compressEncrypted, port, !want, want)
+			}
+		}
+	}
+}
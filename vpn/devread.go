@@ -0,0 +1,39 @@
+package vpn
+
+import (
+	"hivpn/log"
+	"net"
+	"time"
+)
+
+const DEV_READ_MAX_BACKOFF = time.Second
+
+// devReadFailed handles a failed read of the tun device. It tells whether
+// the device is gone, the tunnel is then stopped; otherwise it waits a
+// little longer after each consecutive failure instead of spinning.
+func (vpn *VPN) devReadFailed(err error, failures int) bool {
+	if isFatalDevError(err) || vpn.devRemoved() {
+		vpn.devFailed.Do(func() {
+			log.Error("tun device", vpn.devName, "is gone, probably deleted by another program, stop (start again to recreate it):", err)
+			vpn.cancel()
+		})
+		return true
+	}
+
+	log.Error("read data from vpn error", err)
+	backoff := DEV_READ_MAX_BACKOFF
+	if failures < 10 {
+		backoff = time.Millisecond << failures
+	}
+	vpn.conf.Clock.Sleep(backoff)
+	return false
+}
+
+// devRemoved tells whether the system interface of the device disappeared.
+func (vpn *VPN) devRemoved() bool {
+	if vpn.conf.Device != nil {
+		return false
+	}
+	_, err := net.InterfaceByName(vpn.devName)
+	return err != nil
+}
@@ -0,0 +1,66 @@
+package vpn
+
+import (
+	"errors"
+	"hivpn/log"
+	"hivpn/tun"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	DEV_WRITE_RETRIES = 3
+	DEV_WRITE_BACKOFF = time.Millisecond
+
+	// consecutive failed writes after which the device is considered gone
+	DEV_WRITE_MAX_FAILURES = 1000
+)
+
+// writeDev writes a packet to a tun device. A busy device is retried with
+// a short backoff, a device that is gone stops the tunnel, anything else
+// only loses the packet.
+func (vpn *VPN) writeDev(dev tun.Device, data []byte) {
+	for try := 0; ; try++ {
+		_, err := dev.Write(data, 0)
+		if err == nil {
+			atomic.StoreInt64(&vpn.devFailures, 0)
+			return
+		}
+
+		if isTransientWriteError(err) && try < DEV_WRITE_RETRIES {
+			atomic.AddInt64(&vpn.devRetries, 1)
+			vpn.conf.Clock.Sleep(DEV_WRITE_BACKOFF << try)
+			continue
+		}
+
+		atomic.AddInt64(&vpn.devWriteErrors, 1)
+		failures := atomic.AddInt64(&vpn.devFailures, 1)
+		if isFatalDevError(err) || failures >= DEV_WRITE_MAX_FAILURES {
+			vpn.devFailed.Do(func() {
+				log.Error("tun device is unusable, stop:", err)
+				vpn.cancel()
+			})
+			return
+		}
+
+		log.Debug("write tun to dev err", err)
+		return
+	}
+}
+
+func isTransientWriteError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM)
+}
+
+func isFatalDevError(err error) bool {
+	return errors.Is(err, os.ErrClosed) ||
+		errors.Is(err, syscall.EBADF) ||
+		errors.Is(err, syscall.EIO) ||
+		errors.Is(err, syscall.ENXIO) ||
+		errors.Is(err, syscall.ENODEV)
+}
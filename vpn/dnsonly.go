@@ -0,0 +1,72 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/log"
+	"hivpn/network"
+	"net"
+)
+
+const (
+	DNS_PORT      = 53
+	DNSONLY_MARK  = "0x35"
+	DNSONLY_TABLE = "53"
+)
+
+// dnsHost is the address of vpn.conf.DNS without its port.
+func (vpn *VPN) dnsHost() string {
+	host, _, err := net.SplitHostPort(vpn.conf.DNS)
+	if err != nil {
+		return vpn.conf.DNS
+	}
+	return host
+}
+
+// setupDNSOnly sends only DNS through the tunnel: the packets to port 53
+// are marked and routed with a dedicated table whose default route is the
+// tun device, the resolver in vpn.conf.DNS is routed through it as well in
+// case it listens on another port.
+func (vpn *VPN) setupDNSOnly() error {
+	for _, cmdAgrs := range vpn.dnsOnlyCmds("-A", "add") {
+		err := vpn.runCmd(cmdAgrs[0], cmdAgrs[1:]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vpn *VPN) stopDNSOnly() {
+	cmds := vpn.dnsOnlyCmds("-D", "del")
+	for i := len(cmds) - 1; i >= 0; i-- {
+		err := vpn.runCmd(cmds[i][0], cmds[i][1:]...)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func (vpn *VPN) dnsOnlyCmds(iptablesAction, ipAction string) [][]string {
+	port := fmt.Sprintf("%d", DNS_PORT)
+	cmds := [][]string{
+		{"iptables", "-t", "mangle", iptablesAction, "OUTPUT", "-p", "udp", "--dport", port, "-j", "MARK", "--set-mark", DNSONLY_MARK},
+		{"iptables", "-t", "mangle", iptablesAction, "OUTPUT", "-p", "tcp", "--dport", port, "-j", "MARK", "--set-mark", DNSONLY_MARK},
+		{"iptables", "-t", "nat", iptablesAction, "POSTROUTING", "-o", TUN_NAME, "-m", "mark", "--mark", DNSONLY_MARK, "-j", "MASQUERADE"},
+		{"/sbin/ip", "route", ipAction, "default", "dev", TUN_NAME, "table", DNSONLY_TABLE},
+		{"/sbin/ip", "rule", ipAction, "fwmark", DNSONLY_MARK, "table", DNSONLY_TABLE},
+	}
+	if !network.IsIPv6(vpn.dnsHost()) {
+		cmds = append(cmds, []string{"/sbin/ip", "route", ipAction, vpn.dnsHost() + "/32", "dev", TUN_NAME})
+	}
+	return cmds
+}
+
+// dnsOnlyAllowed tells whether a packet read from the device is DNS, the
+// rest is not meant to reach the tunnel in this mode.
+func (vpn *VPN) dnsOnlyAllowed(header network.PacketHeader, packet []byte) bool {
+	if port, ok := network.DstPort(packet); ok && port == DNS_PORT {
+		return true
+	}
+	// the server itself stays reachable, e.g. for the startup ping
+	return header.IPDst.Equal(net.ParseIP(vpn.dnsHost())) || header.IPDst.Equal(net.ParseIP(vpn.conf.DefaultGateway))
+}
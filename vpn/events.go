@@ -0,0 +1,110 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"hivpn/log"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EVENTS_VERSION is bumped whenever a field of Event changes meaning or goes
+// away, new fields and events keep the version.
+const (
+	EVENTS_VERSION        = 1
+	EVENTS_STATS_INTERVAL = 5 * time.Second
+
+	EVENT_CONNECTING   = "connecting"
+	EVENT_CONNECTED    = "connected"
+	EVENT_RECONNECTING = "reconnecting"
+	EVENT_DISCONNECTED = "disconnected"
+	EVENT_ERROR        = "error"
+	EVENT_STATS        = "stats-update"
+	EVENT_PAUSED       = "paused"
+	EVENT_RESUMED      = "resumed"
+)
+
+// Event is one line of the event stream of the client.
+type Event struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Server  string    `json:"server,omitempty"`
+	Address string    `json:"address,omitempty"`
+	Try     int       `json:"try,omitempty"`
+	Error   string    `json:"error,omitempty"`
+
+	Stats *EventStats `json:"stats,omitempty"`
+}
+
+// EventStats are the totals since the client started.
+type EventStats struct {
+	RxBytes   int64 `json:"rx_bytes"`
+	TxBytes   int64 `json:"tx_bytes"`
+	RxPackets int64 `json:"rx_packets"`
+	TxPackets int64 `json:"tx_packets"`
+}
+
+type eventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+
+	stats EventStats
+}
+
+func newEventStream(w io.Writer) *eventStream {
+	return &eventStream{enc: json.NewEncoder(w)}
+}
+
+// emit writes e as a JSON line, a nil stream drops it.
+func (s *eventStream) emit(e Event) {
+	if s == nil {
+		return
+	}
+	e.Version = EVENTS_VERSION
+	e.Time = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.enc.Encode(e)
+	if err != nil {
+		log.Debug("write event error:", err)
+	}
+}
+
+func (s *eventStream) emitError(err error) {
+	s.emit(Event{Event: EVENT_ERROR, Error: err.Error()})
+}
+
+func (s *eventStream) countRx(data []byte) {
+	atomic.AddInt64(&s.stats.RxBytes, int64(len(data)))
+	atomic.AddInt64(&s.stats.RxPackets, 1)
+}
+
+func (s *eventStream) countTx(data []byte) {
+	atomic.AddInt64(&s.stats.TxBytes, int64(len(data)))
+	atomic.AddInt64(&s.stats.TxPackets, 1)
+}
+
+// reportStats emits a stats-update every EVENTS_STATS_INTERVAL until ctx is
+// done.
+func (s *eventStream) reportStats(ctx context.Context) {
+	ticker := time.NewTicker(EVENTS_STATS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		s.emit(Event{Event: EVENT_STATS, Stats: &EventStats{
+			RxBytes:   atomic.LoadInt64(&s.stats.RxBytes),
+			TxBytes:   atomic.LoadInt64(&s.stats.TxBytes),
+			RxPackets: atomic.LoadInt64(&s.stats.RxPackets),
+			TxPackets: atomic.LoadInt64(&s.stats.TxPackets),
+		}})
+	}
+}
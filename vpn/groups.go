@@ -0,0 +1,89 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/log"
+	"hivpn/network"
+	"hivpn/tun"
+	"net"
+)
+
+// Group is a set of users served through a tun device of their own, so
+// the OS can apply its own firewall policy to them.
+type Group struct {
+	Name      string
+	LocalAddr string
+}
+
+type devGroup struct {
+	group   string
+	name    string
+	dev     tun.Device
+	network *net.IPNet
+}
+
+// setupGroups creates the device of every group, MyNIC1, MyNIC2... in the
+// order of the config, and checks the users of the groups fit in them.
+func (vpn *VPN) setupGroups() error {
+	if YOUR_OS != "linux" || vpn.conf.Device != nil {
+		return fmt.Errorf("groups are only supported by a linux server")
+	}
+
+	byName := make(map[string]*devGroup, 0)
+	for i, g := range vpn.conf.Groups {
+		if _, found := byName[g.Name]; found || len(g.Name) < 1 {
+			return fmt.Errorf("invalid or duplicated group name %q", g.Name)
+		}
+
+		_, ipNet, err := net.ParseCIDR(g.LocalAddr)
+		if err != nil {
+			return fmt.Errorf("group %s: %v", g.Name, err)
+		}
+		if ipNet.Contains(vpn.myNetwork.IP) || vpn.myNetwork.Contains(ipNet.IP) {
+			return fmt.Errorf("group %s overlaps the network of the server", g.Name)
+		}
+
+		name := fmt.Sprintf("%s%d", TUN_NAME, i+1)
+		dev, err := tun.CreateTUN(name, vpn.conf.MTU)
+		if err != nil {
+			return fmt.Errorf("create device of group %s error: %v", g.Name, err)
+		}
+		vpn.changes.record(deviceChange(name), "", nil)
+		group := &devGroup{group: g.Name, name: name, dev: dev, network: ipNet}
+		vpn.groups = append(vpn.groups, group)
+		byName[g.Name] = group
+
+		for _, cmdAgrs := range [][]string{
+			{"link", "set", "dev", name, "mtu", fmt.Sprintf("%d", vpn.conf.MTU)},
+			{"addr", "add", g.LocalAddr, "dev", name},
+			{"link", "set", "dev", name, "up"},
+		} {
+			err := vpn.runCmd("/sbin/ip", cmdAgrs...)
+			if err != nil {
+				return err
+			}
+		}
+		log.Info("Group", g.Name, "on", name, g.LocalAddr)
+	}
+
+	for _, u := range vpn.conf.Users {
+		if len(u.Group) < 1 {
+			continue
+		}
+		group, found := byName[u.Group]
+		if !found {
+			return fmt.Errorf("user %s is in unknown group %s", u.Name, u.Group)
+		}
+		if len(u.IP) < 1 || !group.network.Contains(net.ParseIP(network.GetIp(u.IP))) {
+			return fmt.Errorf("user %s needs an Ipaddress in the network of group %s", u.Name, u.Group)
+		}
+	}
+	return nil
+}
+
+func (vpn *VPN) stopGroups() {
+	for _, g := range vpn.groups {
+		g.dev.Close()
+		vpn.changes.deviceGone(g.name)
+	}
+}
@@ -0,0 +1,60 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/crypto"
+	"hivpn/log"
+	"os"
+	"sync"
+	"time"
+)
+
+// KEYLOG_HEADER starts every key log file. Each line after it is
+//
+//	HIVPN_SESSION_KEY <unix time> <user> <ip> <key id hex> <key hex>
+//
+// the key id is the additional data of every packet of the session (see
+// crypto.Session), so the frames of a capture can be matched to their key.
+const KEYLOG_HEADER = "# hivpn session keys, DEBUG ONLY: anyone reading this file can decrypt the captured tunnel traffic\n"
+
+type keyLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openKeyLog(path string) (*keyLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open key log error: %v", err)
+	}
+
+	_, err = f.WriteString(KEYLOG_HEADER)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("write key log error: %v", err)
+	}
+
+	log.Error("Session keys are written to", path, ", the tunnel traffic can be decrypted with it")
+	return &keyLog{f: f}, nil
+}
+
+// write records the key of a session, a nil key log does nothing.
+func (k *keyLog) write(user, ip string, key *crypto.Session) {
+	if k == nil {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	_, err := fmt.Fprintf(k.f, "HIVPN_SESSION_KEY %d %s %s %x %x\n", time.Now().Unix(), user, ip, key.ID, key.Key)
+	if err != nil {
+		log.Error("write key log error:", err)
+	}
+}
+
+func (k *keyLog) close() {
+	if k == nil {
+		return
+	}
+	k.f.Close()
+}
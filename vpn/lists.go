@@ -0,0 +1,265 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/log"
+	"hivpn/network"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// blockList is the blacklist as the handler looks it up, it is replaced as
+// a whole on reload.
+type blockList struct {
+	ips  map[string]bool
+	nets []*net.IPNet
+}
+
+func newBlockList(entries []string) *blockList {
+	b := &blockList{ips: make(map[string]bool, 0)}
+	for _, e := range entries {
+		if _, ipNet, err := net.ParseCIDR(e); err == nil {
+			b.nets = append(b.nets, ipNet)
+		} else if ip := net.ParseIP(e); ip != nil {
+			// the handler looks packets up by their canonical form
+			b.ips[ip.String()] = true
+		}
+	}
+	return b
+}
+
+func (vpn *VPN) isBlocked(ip net.IP) bool {
+	b, _ := vpn.blocked.Load().(*blockList)
+	if b == nil {
+		return false
+	}
+	if b.ips[ip.String()] {
+		return true
+	}
+	for _, n := range b.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadListFiles adds the entries of WhitelistFile and BlacklistFile to the
+// lists of the config.
+func (vpn *VPN) loadListFiles() error {
+	var err error
+	if len(vpn.conf.WhitelistFile) > 0 {
+		vpn.whiteFromFile, err = readWhitelist(vpn.conf.WhitelistFile)
+		if err != nil {
+			return err
+		}
+		vpn.conf.Whitelist = append(vpn.conf.Whitelist, vpn.whiteFromFile...)
+	}
+
+	if len(vpn.conf.BlacklistFile) > 0 {
+		vpn.blackFromFile, err = network.ReadList(vpn.conf.BlacklistFile)
+		if err != nil {
+			return err
+		}
+		vpn.conf.Blacklist = append(vpn.conf.Blacklist, vpn.blackFromFile...)
+	}
+	return nil
+}
+
+// readWhitelist reads a whitelist file, its entries are routes so they are
+// all made CIDRs.
+func readWhitelist(path string) ([]string, error) {
+	list, err := network.ReadList(path)
+	for i := range list {
+		list[i] = toCIDR(list[i])
+	}
+	return list, err
+}
+
+// watchListFiles reloads the list files on SIGHUP until stop is closed.
+func (vpn *VPN) watchListFiles(stop <-chan struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-sig:
+		case <-stop:
+			return
+		}
+
+		log.Info("Reload whitelist and blacklist files")
+		err := vpn.reloadListFiles()
+		if err != nil {
+			log.Error("reload lists error:", err)
+		}
+	}
+}
+
+// reloadListFiles installs the routes of the new entries of the files and
+// removes the ones of the entries that are gone.
+func (vpn *VPN) reloadListFiles() error {
+	var white, black []string
+	var err error
+	if len(vpn.conf.WhitelistFile) > 0 {
+		white, err = readWhitelist(vpn.conf.WhitelistFile)
+		if err != nil {
+			return err
+		}
+	}
+	if len(vpn.conf.BlacklistFile) > 0 {
+		black, err = network.ReadList(vpn.conf.BlacklistFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	vpn.listsMu.Lock()
+	defer vpn.listsMu.Unlock()
+
+	added, removed := diffList(vpn.whiteFromFile, white)
+	for _, e := range removed {
+		vpn.runRouteCmd(vpn.bypassRouteCmd("delete", e))
+	}
+	for _, e := range added {
+		vpn.runRouteCmd(vpn.bypassRouteCmd("add", e))
+	}
+	vpn.conf.Whitelist = append(withoutList(vpn.conf.Whitelist, vpn.whiteFromFile), white...)
+	vpn.whiteFromFile = white
+
+	added, removed = diffList(vpn.blackFromFile, black)
+	if YOUR_OS == "windows" {
+		for _, e := range removed {
+			vpn.runRouteCmd(vpn.blacklistRouteCmd("delete", e))
+		}
+		for _, e := range added {
+			vpn.runRouteCmd(vpn.blacklistRouteCmd("add", e))
+		}
+	}
+	vpn.conf.Blacklist = append(withoutList(vpn.conf.Blacklist, vpn.blackFromFile), black...)
+	vpn.blackFromFile = black
+	vpn.blocked.Store(newBlockList(vpn.conf.Blacklist))
+
+	log.Info(fmt.Sprintf("Lists reloaded: %d whitelist, %d blacklist entries", len(vpn.conf.Whitelist), len(vpn.conf.Blacklist)))
+	return nil
+}
+
+func (vpn *VPN) runRouteCmd(cmdAgrs []string) {
+	// a replaced device has no system routes to keep in line
+	if len(cmdAgrs) < 1 || vpn.conf.Device != nil {
+		return
+	}
+	err := vpn.runCmd(cmdAgrs[0], cmdAgrs[1:]...)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// bypassRouteCmd is the command routing a whitelist entry around the tunnel.
+func (vpn *VPN) bypassRouteCmd(action, entry string) []string {
+	cidr := toCIDR(entry)
+	if YOUR_OS == "linux" {
+		return append([]string{"/sbin/ip"}, linuxBypassRoute(action, cidr, vpn.gatewayLinux)...)
+	}
+	if YOUR_OS == "darwin" {
+		return darwinBypassRoute(action, cidr, vpn.gatewayDarwin)
+	}
+
+	if network.IsIPv6(cidr) {
+		if len(vpn.gateway6Win.Interface) < 1 {
+			gw, err := network.GetDefaultGateway6Windows()
+			if err != nil {
+				log.Error(err)
+				return nil
+			}
+			vpn.gateway6Win = gw
+		}
+		nexthop := vpn.gateway6Win.Gateway
+		if action == "delete" {
+			nexthop = ""
+		}
+		return windowsRoute6(action, cidr, vpn.gateway6Win.Interface, nexthop)
+	}
+
+	if action == "delete" {
+		return []string{"route", "delete", network.GetIp(cidr), "mask", network.CIDRToMask(cidr)}
+	}
+	return []string{"route", "add", network.GetIp(cidr), "mask", network.CIDRToMask(cidr), vpn.gatewayWindows.Gateway}
+}
+
+// blacklistRouteCmd is the command routing a blacklist entry into the
+// tunnel on windows, where the handler drops it.
+func (vpn *VPN) blacklistRouteCmd(action, entry string) []string {
+	index := ""
+	if iface, err := net.InterfaceByName(TUN_NAME); err == nil {
+		index = fmt.Sprintf("%d", iface.Index)
+	}
+
+	cidr := toCIDR(entry)
+
+	if network.IsIPv6(cidr) {
+		cmdAgrs := windowsRoute6(action, cidr, index, "")
+		if action == "add" {
+			cmdAgrs = append(cmdAgrs, "metric=5")
+		}
+		return cmdAgrs
+	}
+
+	if action == "delete" {
+		return []string{"route", "delete", network.GetIp(cidr), "mask", network.CIDRToMask(cidr)}
+	}
+	return []string{"route", "add", network.GetIp(cidr), "mask", network.CIDRToMask(cidr), vpn.conf.DefaultGateway, "if", index, "metric", "5"}
+}
+
+// toCIDR turns a single address into its host CIDR.
+func toCIDR(entry string) string {
+	if _, _, err := net.ParseCIDR(entry); err == nil {
+		return entry
+	}
+	if network.IsIPv6(entry) {
+		return entry + "/128"
+	}
+	return entry + "/32"
+}
+
+// diffList returns the entries of next missing from prev and the entries
+// of prev missing from next.
+func diffList(prev, next []string) (added, removed []string) {
+	inPrev := make(map[string]bool, len(prev))
+	for _, e := range prev {
+		inPrev[e] = true
+	}
+	inNext := make(map[string]bool, len(next))
+	for _, e := range next {
+		inNext[e] = true
+		if !inPrev[e] {
+			added = append(added, e)
+		}
+	}
+	for _, e := range prev {
+		if !inNext[e] {
+			removed = append(removed, e)
+		}
+	}
+	return
+}
+
+// withoutList returns list without the entries of drop, once each.
+func withoutList(list, drop []string) []string {
+	count := make(map[string]int, len(drop))
+	for _, e := range drop {
+		count[e]++
+	}
+	var result []string
+	for _, e := range list {
+		if count[e] > 0 {
+			count[e]--
+			continue
+		}
+		result = append(result, e)
+	}
+	return result
+}
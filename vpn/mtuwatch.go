@@ -0,0 +1,122 @@
+package vpn
+
+import (
+	"hivpn/log"
+	"hivpn/network"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// MTU_WATCH_PERIOD is how often the counters are looked at and reset
+	MTU_WATCH_PERIOD = time.Minute
+	// MTU_WATCH_LARGE_MARGIN makes a segment large when it is within this
+	// many bytes of the MTU, MTU_WATCH_SMALL is the largest small one
+	MTU_WATCH_LARGE_MARGIN = 100
+	MTU_WATCH_SMALL        = 576
+	// MTU_WATCH_MIN_RETRANSMITS large retransmissions in a period, half of
+	// the large segments at least, while under a tenth of the small ones
+	// are retransmitted make a black hole
+	MTU_WATCH_MIN_RETRANSMITS = 5
+	// MTU_WATCH_MAX_SEGMENTS bounds the segments remembered in a period
+	MTU_WATCH_MAX_SEGMENTS = 4096
+	// MTU_WATCH_WARN_EVERY keeps the warning from flooding the log
+	MTU_WATCH_WARN_EVERY = 10 * time.Minute
+)
+
+type segmentKey struct {
+	src, dst         [16]byte
+	srcPort, dstPort uint16
+	seq              uint32
+}
+
+// mtuWatch looks for the pattern of an MTU black hole in the TCP segments
+// read from the devices: the large ones sent again and again while the
+// small ones go through.
+type mtuWatch struct {
+	mu       sync.Mutex
+	mtu      int
+	seen     map[segmentKey]bool
+	large    int
+	small    int
+	largeRe  int
+	smallRe  int
+	lastWarn time.Time
+
+	// for the stats
+	largeRetransmits int64
+	warnings         int64
+}
+
+func newMTUWatch(mtu int) *mtuWatch {
+	return &mtuWatch{
+		mtu:  mtu,
+		seen: make(map[segmentKey]bool, 0),
+	}
+}
+
+// count records a packet going into the tunnel.
+func (w *mtuWatch) count(header network.PacketHeader, packet []byte) {
+	srcPort, dstPort, seq, payload, ok := network.TCPSegment(packet)
+	if !ok || payload < 1 {
+		return
+	}
+	large := len(packet) >= w.mtu-MTU_WATCH_LARGE_MARGIN
+	if !large && len(packet) > MTU_WATCH_SMALL {
+		return
+	}
+
+	key := segmentKey{srcPort: srcPort, dstPort: dstPort, seq: seq}
+	copy(key.src[:], header.IPSrc.To16())
+	copy(key.dst[:], header.IPDst.To16())
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	retransmit := w.seen[key]
+	if !retransmit && len(w.seen) < MTU_WATCH_MAX_SEGMENTS {
+		w.seen[key] = true
+	}
+
+	switch {
+	case large && retransmit:
+		w.largeRe++
+		atomic.AddInt64(&w.largeRetransmits, 1)
+	case large:
+		w.large++
+	case retransmit:
+		w.smallRe++
+	default:
+		w.small++
+	}
+}
+
+// check is called every MTU_WATCH_PERIOD, it warns when the period looks
+// like a black hole and starts a new one.
+func (w *mtuWatch) check(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	blackHole := w.largeRe >= MTU_WATCH_MIN_RETRANSMITS && w.largeRe*2 >= w.large &&
+		w.small > 0 && w.smallRe*10 < w.small
+	if blackHole && now.Sub(w.lastWarn) >= MTU_WATCH_WARN_EVERY {
+		w.lastWarn = now
+		atomic.AddInt64(&w.warnings, 1)
+		log.Error("Possible MTU black hole:", w.largeRe, "retransmissions of", w.large, "large TCP segments while",
+			w.small, "small ones went through, lower MTU from", w.mtu, "or clamp the TCP MSS on the path")
+	}
+
+	w.seen = make(map[segmentKey]bool, 0)
+	w.large, w.small, w.largeRe, w.smallRe = 0, 0, 0, 0
+}
+
+func (vpn *VPN) watchMTU(stop <-chan struct{}) {
+	for {
+		select {
+		case <-vpn.conf.Clock.After(MTU_WATCH_PERIOD):
+			vpn.mtuWatch.check(vpn.conf.Clock.Now())
+		case <-stop:
+			return
+		}
+	}
+}
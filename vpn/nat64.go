@@ -0,0 +1,53 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/network"
+	"net"
+)
+
+// setupNAT64 maps the IPv6 address of the users with NAT64 to their IPv4
+// one, the source their traffic to NAT64_PREFIX is translated from.
+func (vpn *VPN) setupNAT64() error {
+	for name, u := range vpn.userTable {
+		if !u.NAT64 {
+			continue
+		}
+		if len(u.IP) < 1 || len(u.IP6) < 1 {
+			return fmt.Errorf("user %s needs Ipaddress and Ipaddress6 for NAT64", name)
+		}
+
+		if vpn.nat64 == nil {
+			vpn.nat64 = make(map[string]net.IP, 0)
+			vpn.nat64Back = make(map[string]net.IP, 0)
+		}
+		vpn.nat64[u.IP6] = net.ParseIP(u.IP)
+		vpn.nat64Back[u.IP] = net.ParseIP(u.IP6)
+	}
+	return nil
+}
+
+// nat64To4 translates the packets of a NAT64 user to the IPv4 internet, ok
+// is false for a packet that is not for NAT64.
+func (vpn *VPN) nat64To4(header network.PacketHeader, packet []byte) ([]byte, bool) {
+	if !header.IsIPv6 || !network.IsNAT64(header.IPDst) {
+		return nil, false
+	}
+	src, found := vpn.nat64[header.IPSrc.String()]
+	if !found {
+		return nil, false
+	}
+	return network.NAT64To4(packet, src), true
+}
+
+// nat64To6 translates the IPv4 packets to a NAT64 user back to IPv6.
+func (vpn *VPN) nat64To6(header network.PacketHeader, packet []byte) ([]byte, bool) {
+	if header.IsIPv6 {
+		return nil, false
+	}
+	dst, found := vpn.nat64Back[header.IPDst.String()]
+	if !found {
+		return nil, false
+	}
+	return network.NAT64To6(packet, dst), true
+}
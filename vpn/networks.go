@@ -0,0 +1,88 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/log"
+	"hivpn/network"
+	"net"
+)
+
+// setupNetworks gathers the networks of the clients of the server: the one
+// of LocalAddr, the one of LocalAddr6 and the Networks. A packet from a
+// client to one of them is sent to the client owning the address instead
+// of the device.
+func (vpn *VPN) setupNetworks() error {
+	vpn.myNetworks = []*net.IPNet{vpn.myNetwork}
+	ip, _, _ := net.ParseCIDR(vpn.conf.LocalAddr)
+	vpn.myIPs = []net.IP{ip}
+
+	if len(vpn.conf.LocalAddr6) > 0 {
+		ip6, ipNet6, err := net.ParseCIDR(vpn.conf.LocalAddr6)
+		if err != nil {
+			return err
+		}
+		vpn.myNetworks = append(vpn.myNetworks, ipNet6)
+		vpn.myIPs = append(vpn.myIPs, ip6)
+	}
+
+	for _, n := range vpn.conf.Networks {
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return fmt.Errorf("network %s: %v", n, err)
+		}
+		for _, mine := range vpn.myNetworks {
+			if mine.Contains(ipNet.IP) || ipNet.Contains(mine.IP) {
+				return fmt.Errorf("network %s overlaps %s", ipNet, mine)
+			}
+		}
+		vpn.myNetworks = append(vpn.myNetworks, ipNet)
+	}
+	return nil
+}
+
+// inMyNetworks tells whether ip is a client of the server, only the
+// networks of the family of the packet are looked at: an IPv4-mapped IPv6
+// address is no IPv4 client.
+func (vpn *VPN) inMyNetworks(header network.PacketHeader) bool {
+	for _, n := range vpn.myNetworks {
+		if (n.IP.To4() == nil) != header.IsIPv6 || !n.Contains(header.IPDst) {
+			continue
+		}
+		for _, ip := range vpn.myIPs {
+			if ip.Equal(header.IPDst) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// addNetworkRoutes sends the traffic of the host to the Networks through
+// the device, they go away with it. The networks of LocalAddr and
+// LocalAddr6 are routed by their address.
+func (vpn *VPN) addNetworkRoutes() {
+	for _, n := range vpn.conf.Networks {
+		_, ipNet, _ := net.ParseCIDR(n)
+		var cmdAgrs []string
+		switch YOUR_OS {
+		case "linux":
+			cmdAgrs = []string{"/sbin/ip", "route", "add", ipNet.String(), "dev", TUN_NAME}
+			if network.IsIPv6(n) {
+				cmdAgrs = []string{"/sbin/ip", "-6", "route", "add", ipNet.String(), "dev", TUN_NAME}
+			}
+		case "darwin":
+			cmdAgrs = []string{"/sbin/route", "-n", "add", "-net", ipNet.String(), "-interface", vpn.devName}
+			if network.IsIPv6(n) {
+				cmdAgrs = []string{"/sbin/route", "-n", "add", "-inet6", "-net", ipNet.String(), "-interface", vpn.devName}
+			}
+		default:
+			log.Error("Networks are not routed on", YOUR_OS, ", route", ipNet, "to the device by hand")
+			continue
+		}
+		err := vpn.runCmd(cmdAgrs[0], cmdAgrs[1:]...)
+		if err != nil {
+			log.Error("add route to network", ipNet, "error:", err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hivpn/log"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	OTLP_DEFAULT_INTERVAL = 60
+	OTLP_TIMEOUT          = 10 * time.Second
+	OTLP_METRIC_PREFIX    = "hivpn."
+)
+
+// The OTLP/HTTP JSON encoding of the metrics (opentelemetry-proto), only
+// the parts used here.
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   map[string]string `json:"scope"`
+	Metrics []otlpMetric      `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name  string     `json:"name"`
+	Sum   *otlpSum   `json:"sum,omitempty"`
+	Gauge *otlpGauge `json:"gauge,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpDataPoint struct {
+	AsInt             string `json:"asInt"`
+	StartTimeUnixNano string `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string `json:"timeUnixNano"`
+}
+
+// cumulative, the counters only grow since the start
+const OTLP_TEMPORALITY_CUMULATIVE = 2
+
+// pushOTLP sends the counters and the sessions to vpn.conf.OTLPEndpoint
+// every OTLPInterval seconds until ctx is done.
+func (vpn *VPN) pushOTLP(ctx context.Context) {
+	interval := time.Duration(vpn.conf.OTLPInterval) * time.Second
+	if interval <= 0 {
+		interval = OTLP_DEFAULT_INTERVAL * time.Second
+	}
+	start := vpn.conf.Clock.Now()
+	client := &http.Client{Timeout: OTLP_TIMEOUT}
+
+	log.Info("Push metrics to", vpn.conf.OTLPEndpoint, "every", interval)
+	for {
+		select {
+		case <-vpn.conf.Clock.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		err := vpn.sendOTLP(ctx, client, start)
+		if err != nil {
+			log.Error("push metrics error:", err)
+		}
+	}
+}
+
+func (vpn *VPN) sendOTLP(ctx context.Context, client *http.Client, start time.Time) error {
+	now := strconv.FormatInt(vpn.conf.Clock.Now().UnixNano(), 10)
+	since := strconv.FormatInt(start.UnixNano(), 10)
+
+	counters := vpn.counters()
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var metrics []otlpMetric
+	for _, name := range names {
+		if gaugeCounters[name] {
+			metrics = append(metrics, otlpMetric{
+				Name:  OTLP_METRIC_PREFIX + name,
+				Gauge: &otlpGauge{DataPoints: []otlpDataPoint{{AsInt: strconv.FormatInt(counters[name], 10), TimeUnixNano: now}}},
+			})
+			continue
+		}
+		metrics = append(metrics, otlpMetric{
+			Name: OTLP_METRIC_PREFIX + name,
+			Sum: &otlpSum{
+				DataPoints:             []otlpDataPoint{{AsInt: strconv.FormatInt(counters[name], 10), StartTimeUnixNano: since, TimeUnixNano: now}},
+				AggregationTemporality: OTLP_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			},
+		})
+	}
+	metrics = append(metrics, otlpMetric{
+		Name:  OTLP_METRIC_PREFIX + "sessions",
+		Gauge: &otlpGauge{DataPoints: []otlpDataPoint{{AsInt: strconv.Itoa(vpn.arpTable.Sessions()), TimeUnixNano: now}}},
+	})
+
+	role := "client"
+	if vpn.conf.IsServer {
+		role = "server"
+	}
+	body, err := json.Marshal(otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: map[string]string{"stringValue": "hivpn"}},
+			{Key: "service.version", Value: map[string]string{"stringValue": VERSION}},
+			{Key: "hivpn.role", Value: map[string]string{"stringValue": role}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   map[string]string{"name": "hivpn"},
+			Metrics: metrics,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, vpn.conf.OTLPEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range vpn.conf.OTLPHeaders {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
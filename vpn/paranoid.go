@@ -0,0 +1,71 @@
+package vpn
+
+import (
+	"encoding/json"
+	"hivpn/log"
+	"hivpn/network"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// dropCounters counts the packets dropped in paranoid mode by reason, the
+// map is filled once so it is only read afterwards.
+type dropCounters map[string]*int64
+
+func newDropCounters() dropCounters {
+	counters := make(dropCounters, 0)
+	for _, reason := range []string{
+		network.DROP_NOT_IP,
+		network.DROP_MALFORMED,
+		network.DROP_BROADCAST,
+		network.DROP_MULTICAST,
+		network.DROP_PROTOCOL,
+		network.DROP_ZERO_ADDR,
+	} {
+		counters[reason] = new(int64)
+	}
+	return counters
+}
+
+// paranoidDrop tells whether a packet has to be dropped before it is
+// forwarded, only well-formed unicast TCP, UDP and ICMP packets pass.
+func (vpn *VPN) paranoidDrop(data []byte) bool {
+	reason := network.ValidatePacket(data)
+	if len(reason) < 1 && data[0]>>4 == 4 && net.IP(data[16:20]).Equal(vpn.broadcast) {
+		reason = network.DROP_BROADCAST
+	}
+	if len(reason) < 1 {
+		return false
+	}
+
+	atomic.AddInt64(vpn.dropped[reason], 1)
+	log.Debug("Drop packet:", reason)
+	return true
+}
+
+// broadcastOf returns the broadcast address of an IPv4 network.
+func broadcastOf(n *net.IPNet) net.IP {
+	if n == nil {
+		return nil
+	}
+	ip := n.IP.To4()
+	if ip == nil || len(n.Mask) != net.IPv4len {
+		return nil
+	}
+
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range ip {
+		broadcast[i] = ip[i] | ^n.Mask[i]
+	}
+	return broadcast
+}
+
+func (vpn *VPN) handlerDropped(w http.ResponseWriter, r *http.Request) {
+	counters := make(map[string]int64, len(vpn.dropped))
+	for reason, c := range vpn.dropped {
+		counters[reason] = atomic.LoadInt64(c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counters)
+}
@@ -0,0 +1,153 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+)
+
+// pause stops the forwarding both ways while the session stays up, so
+// resume is instant. With PauseRoutes the default routes through the
+// device are removed meanwhile and the traffic goes direct.
+func (vpn *VPN) pause() error {
+	if vpn.conf.IsServer {
+		return fmt.Errorf("only a client can pause")
+	}
+	vpn.pauseMu.Lock()
+	defer vpn.pauseMu.Unlock()
+	if !atomic.CompareAndSwapInt32(&vpn.paused, 0, 1) {
+		return nil
+	}
+
+	if vpn.conf.PauseRoutes && vpn.ownsDefaultRoutes() {
+		vpn.runDefaultRoutes("delete")
+		vpn.pausedRoutes = true
+	}
+	log.Info("Tunnel paused")
+	vpn.events.emit(Event{Event: EVENT_PAUSED})
+	return nil
+}
+
+func (vpn *VPN) resume() error {
+	if vpn.conf.IsServer {
+		return fmt.Errorf("only a client can pause")
+	}
+	vpn.pauseMu.Lock()
+	defer vpn.pauseMu.Unlock()
+	if atomic.LoadInt32(&vpn.paused) == 0 {
+		return nil
+	}
+
+	if vpn.pausedRoutes {
+		vpn.runDefaultRoutes("add")
+		vpn.pausedRoutes = false
+	}
+	atomic.StoreInt32(&vpn.paused, 0)
+	log.Info("Tunnel resumed")
+	vpn.events.emit(Event{Event: EVENT_RESUMED})
+	return nil
+}
+
+func (vpn *VPN) isPaused() bool {
+	return atomic.LoadInt32(&vpn.paused) == 1
+}
+
+// ownsDefaultRoutes tells whether setupRoute sent the default route
+// through the device and it can be changed now.
+func (vpn *VPN) ownsDefaultRoutes() bool {
+	if vpn.conf.Device != nil || len(vpn.conf.DefaultGateway) < 1 || vpn.conf.DNSOnly {
+		return false
+	}
+	if vpn.unprivileged {
+		log.Info("Running as", vpn.conf.RunAsUser, ", the default routes are left in place")
+		return false
+	}
+	return YOUR_OS == "windows" || YOUR_OS == "darwin" || (YOUR_OS == "linux" && len(vpn.conf.Cgroup) < 1)
+}
+
+// runDefaultRoutes adds or deletes the default routes of setupRoute.
+func (vpn *VPN) runDefaultRoutes(action string) {
+	var cmds [][]string
+	if YOUR_OS == "linux" {
+		cmds = [][]string{
+			{"/sbin/ip", "route", action, "0.0.0.0/1", "dev", TUN_NAME},
+			{"/sbin/ip", "route", action, "128.0.0.0/1", "dev", TUN_NAME},
+		}
+	} else if YOUR_OS == "darwin" {
+		cmds = vpn.darwinDefaultRoutes(action)
+	} else {
+		cmd := []string{"route", action, "0.0.0.0", "mask", "0.0.0.0", vpn.conf.DefaultGateway}
+		if action == "add" {
+			iface, err := net.InterfaceByName(TUN_NAME)
+			if err != nil {
+				log.Error("find device error:", err)
+				return
+			}
+			cmd = append(cmd, "if", fmt.Sprintf("%d", iface.Index), "metric", "5")
+		}
+		cmds = [][]string{cmd}
+	}
+
+	for _, cmd := range cmds {
+		err := vpn.runCmd(cmd[0], cmd[1:]...)
+		if err != nil {
+			log.Error(action, "default route error:", err)
+		}
+	}
+}
+
+// watchPauseSignal toggles pause on PAUSE_SIGNAL until stop is closed.
+func (vpn *VPN) watchPauseSignal(stop <-chan struct{}) {
+	if PAUSE_SIGNAL == nil {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, PAUSE_SIGNAL)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-sig:
+		case <-stop:
+			return
+		}
+
+		var err error
+		if vpn.isPaused() {
+			err = vpn.resume()
+		} else {
+			err = vpn.pause()
+		}
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// handlerPause answers /pause and /resume.
+func (vpn *VPN) handlerPause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var err error
+	if r.URL.Path == "/pause" {
+		err = vpn.pause()
+	} else {
+		err = vpn.resume()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if vpn.isPaused() {
+		fmt.Fprintln(w, "paused")
+	} else {
+		fmt.Fprintln(w, "running")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package vpn
+
+import (
+	"os"
+	"syscall"
+)
+
+// PAUSE_SIGNAL pauses a running client, or resumes it
+var PAUSE_SIGNAL os.Signal = syscall.SIGUSR1
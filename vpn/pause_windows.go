@@ -0,0 +1,7 @@
+package vpn
+
+import "os"
+
+// PAUSE_SIGNAL is nil, windows has no user signal, the control socket
+// still pauses
+var PAUSE_SIGNAL os.Signal
@@ -0,0 +1,101 @@
+package vpn
+
+import (
+	"hivpn/utils"
+	"sync"
+	"time"
+)
+
+const (
+	PENDING_MAX_PACKETS = 64
+	// PENDING_MAX_BYTES caps the packets held for all the destinations
+	PENDING_MAX_BYTES = 4 << 20
+	PENDING_TIMEOUT   = 3 * time.Second
+	// the client keeps them through a reconnection, the first retries plus
+	// the time to connect again
+	PENDING_RECONNECT_TIMEOUT = 15 * time.Second
+)
+
+type pendingPacket struct {
+	at   time.Time
+	data []byte
+}
+
+// pendingPackets holds the packets of a destination whose connection is
+// not there (yet), so they can be sent once it comes back.
+type pendingPackets struct {
+	mu      sync.Mutex
+	packets map[string][]pendingPacket
+	// size is the bytes held for all the keys
+	size      int
+	nextPrune time.Time
+	clock     utils.Clock
+	timeout   time.Duration
+}
+
+func newPendingPackets(clock utils.Clock, timeout time.Duration) *pendingPackets {
+	return &pendingPackets{
+		packets: make(map[string][]pendingPacket, 0),
+		clock:   clock,
+		timeout: timeout,
+	}
+}
+
+func (p *pendingPackets) push(key string, data []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	// the destinations that never came back, once per timeout
+	if !now.Before(p.nextPrune) {
+		for k := range p.packets {
+			p.expire(k, now)
+		}
+		p.nextPrune = now.Add(p.timeout)
+	}
+
+	p.expire(key, now)
+	list := p.packets[key]
+	if len(list) >= PENDING_MAX_PACKETS || p.size+len(data) > PENDING_MAX_BYTES {
+		return false
+	}
+
+	packet := make([]byte, len(data))
+	copy(packet, data)
+	p.packets[key] = append(list, pendingPacket{at: now, data: packet})
+	p.size += len(packet)
+	return true
+}
+
+// expire drops the packets of key older than the timeout, with p.mu held.
+func (p *pendingPackets) expire(key string, now time.Time) {
+	list := p.packets[key]
+	for len(list) > 0 && now.Sub(list[0].at) > p.timeout {
+		p.size -= len(list[0].data)
+		list = list[1:]
+	}
+	if len(list) < 1 {
+		delete(p.packets, key)
+		return
+	}
+	p.packets[key] = list
+}
+
+func (p *pendingPackets) take(key string) [][]byte {
+	p.mu.Lock()
+	list := p.packets[key]
+	delete(p.packets, key)
+	for _, packet := range list {
+		p.size -= len(packet.data)
+	}
+	p.mu.Unlock()
+
+	var packets [][]byte
+	now := p.clock.Now()
+	for _, packet := range list {
+		if now.Sub(packet.at) <= p.timeout {
+			packets = append(packets, packet.data)
+		}
+	}
+	return packets
+}
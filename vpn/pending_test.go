@@ -0,0 +1,47 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/utils"
+	"testing"
+	"time"
+)
+
+func TestPendingMaxBytes(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	p := newPendingPackets(clock, PENDING_TIMEOUT)
+	packet := make([]byte, 60000)
+
+	pushed := 0
+	for i := 0; i < 1000; i++ {
+		if p.push(fmt.Sprint(i%100), packet) {
+			pushed++
+		}
+	}
+	if pushed*len(packet) > PENDING_MAX_BYTES || pushed < PENDING_MAX_BYTES/len(packet) {
+		t.Errorf("%d packets of %d bytes held, the cap is %d bytes", pushed, len(packet), PENDING_MAX_BYTES)
+	}
+
+	// taking some gives room again
+	taken := len(p.take("0"))
+	if taken < 1 || !p.push("new", packet) {
+		t.Errorf("no room after taking %d packets", taken)
+	}
+}
+
+func TestPendingExpiresEveryKey(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	p := newPendingPackets(clock, PENDING_TIMEOUT)
+	for i := 0; i < 100; i++ {
+		p.push(fmt.Sprint(i), make([]byte, 100))
+	}
+
+	// a push for another destination forgets the ones that never came back
+	clock.Advance(PENDING_TIMEOUT + time.Millisecond)
+	p.push("other", make([]byte, 100))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.packets) != 1 || p.size != 100 {
+		t.Errorf("%d destinations and %d bytes held after the timeout", len(p.packets), p.size)
+	}
+}
@@ -0,0 +1,84 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/log"
+	"hivpn/network"
+	"net"
+	"time"
+)
+
+// POOL_REAP_INTERVAL is how often the addresses held past LeaseGrace are
+// given back to the pool
+const POOL_REAP_INTERVAL = 10 * time.Second
+
+// setupPool creates the address pool of the users without a static
+// address. The server address is always reserved, a static address inside
+// the pool is a configuration error.
+func (vpn *VPN) setupPool() error {
+	myIP, _, _ := net.ParseCIDR(vpn.conf.LocalAddr)
+	reserved := append([]string{myIP.String()}, vpn.conf.ReservedIPs...)
+
+	pool, err := network.NewIPPool(vpn.conf.Pool, reserved)
+	if err != nil {
+		return err
+	}
+
+	_, poolNet, _ := net.ParseCIDR(vpn.conf.Pool)
+	if !vpn.myNetwork.Contains(poolNet.IP) {
+		return fmt.Errorf("pool %s is outside of the network %s", vpn.conf.Pool, vpn.myNetwork)
+	}
+
+	for name, u := range vpn.userTable {
+		if len(u.IP) > 0 && pool.Contains(net.ParseIP(u.IP)) {
+			return fmt.Errorf("static ip %s of user %s is inside the pool %s", u.IP, name, vpn.conf.Pool)
+		}
+	}
+
+	vpn.pool = pool
+	return nil
+}
+
+// addressOf returns the address of a user, leased from the pool when it
+// has no static one.
+func (vpn *VPN) addressOf(name string, u User) (string, error) {
+	if len(u.IP) > 0 {
+		return u.IP, nil
+	}
+	if vpn.pool == nil {
+		return "", fmt.Errorf("user %s has no ip and there is no pool", name)
+	}
+	return vpn.pool.Allocate(name)
+}
+
+// prefixOf turns an address of the tunnel network into its CIDR.
+func (vpn *VPN) prefixOf(ip string) string {
+	ones, _ := vpn.myNetwork.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones)
+}
+
+// releaseAddress gives the address of a disconnected user back to the pool,
+// after LeaseGrace seconds so a quick reconnect gets the same one and the
+// connections through it survive.
+func (vpn *VPN) releaseAddress(name string) {
+	if vpn.conf.LeaseGrace <= 0 {
+		vpn.pool.Release(name)
+		return
+	}
+	vpn.pool.Hold(name, vpn.conf.Clock.Now().Add(time.Duration(vpn.conf.LeaseGrace)*time.Second))
+}
+
+// reapLeases releases the held addresses once their grace is over, until
+// stop is closed.
+func (vpn *VPN) reapLeases(stop <-chan struct{}) {
+	for {
+		select {
+		case <-vpn.conf.Clock.After(POOL_REAP_INTERVAL):
+			for _, name := range vpn.pool.Reap(vpn.conf.Clock.Now()) {
+				log.Debug("Address of user", name, "back to the pool")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package vpn
+
+import (
+	"hivpn/log"
+	"hivpn/network"
+	"sync/atomic"
+)
+
+// setupAllowedPorts builds the TCP/UDP ports every client may send to, the
+// ports of a user replace the global ones. Nothing is filtered when no
+// ports are configured at all.
+func (vpn *VPN) setupAllowedPorts() {
+	toSet := func(ports []int) map[uint16]bool {
+		if len(ports) < 1 {
+			return nil
+		}
+		set := make(map[uint16]bool, len(ports))
+		for _, p := range ports {
+			if p < 1 || p > 0xFFFF {
+				log.Error("invalid allowed port", p)
+				continue
+			}
+			set[uint16(p)] = true
+		}
+		return set
+	}
+
+	vpn.allowedPorts = toSet(vpn.conf.AllowedPorts)
+	vpn.userPorts = make(map[string]map[uint16]bool, 0)
+	for name, u := range vpn.userTable {
+		if ports := toSet(u.AllowedPorts); ports != nil {
+			vpn.userPorts[name] = ports
+		}
+	}
+}
+
+// allowedPortsOf returns the ports user may send to, nil for any. It is
+// looked up by name, whatever address the session got.
+func (vpn *VPN) allowedPortsOf(user string) map[uint16]bool {
+	if ports, found := vpn.userPorts[user]; found {
+		return ports
+	}
+	return vpn.allowedPorts
+}
+
+// portAllowed tells whether the client of session may send data, only TCP
+// and UDP are filtered.
+func (vpn *VPN) portAllowed(session *clientSession, data []byte) bool {
+	port, ok := network.DstPort(data)
+	if !ok || session.ports[port] {
+		return true
+	}
+
+	atomic.AddInt64(&vpn.portDropped, 1)
+	log.Debug("Drop packet of user", session.user, "to port", port)
+	return false
+}
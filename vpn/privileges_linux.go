@@ -0,0 +1,45 @@
+package vpn
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches every thread of the process to name and its
+// primary group, for good.
+func dropPrivileges(name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid of %s: %v", name, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid of %s: %v", name, err)
+	}
+
+	// groups first, they cannot be changed once the uid is dropped
+	err = syscall.Setgroups([]int{gid})
+	if err != nil {
+		return fmt.Errorf("setgroups error: %v", err)
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return fmt.Errorf("setgid error: %v", err)
+	}
+	err = syscall.Setuid(uid)
+	if err != nil {
+		return fmt.Errorf("setuid error: %v", err)
+	}
+
+	if syscall.Setuid(0) == nil {
+		return fmt.Errorf("root privileges could be regained")
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package vpn
+
+import (
+	"fmt"
+)
+
+func dropPrivileges(name string) error {
+	return fmt.Errorf("RunAsUser is only supported on linux")
+}
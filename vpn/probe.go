@@ -0,0 +1,81 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"hivpn/connection"
+	"hivpn/log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const PROBE_TIMEOUT = 10 * time.Second
+
+// probe checks every ProbeInterval that ProbeTarget answers through the
+// tunnel, after ProbeFailures failures in a row the connection is dropped
+// so the reconnect loop starts over.
+func (vpn *VPN) probe(ctx context.Context, virtualChannel *connection.TUN) {
+	interval := time.Duration(vpn.conf.ProbeInterval) * time.Second
+	failures := 0
+	for {
+		select {
+		case <-vpn.conf.Clock.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		err := vpn.probeOnce()
+		if err == nil {
+			if failures > 0 {
+				log.Info("Probe of", vpn.conf.ProbeTarget, "ok again")
+			}
+			failures = 0
+			atomic.AddInt64(&vpn.probeOK, 1)
+			continue
+		}
+
+		failures++
+		atomic.AddInt64(&vpn.probeFailed, 1)
+		log.Error(fmt.Sprintf("Probe of %s failed (%d in a row):", vpn.conf.ProbeTarget, failures), err)
+		if vpn.conf.ProbeFailures > 0 && failures >= vpn.conf.ProbeFailures {
+			log.Info("Tunnel does not forward, reconnecting ...")
+			failures = 0
+			atomic.StoreInt32(&vpn.networkChanged, 1)
+			virtualChannel.Disconnect()
+		}
+	}
+}
+
+// probeOnce fetches ProbeTarget when it is an url, pings it otherwise.
+func (vpn *VPN) probeOnce() error {
+	target := vpn.conf.ProbeTarget
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return ping(target)
+	}
+
+	client := http.Client{Timeout: PROBE_TIMEOUT}
+	resp, err := client.Get(target)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%s answered %s", target, resp.Status)
+	}
+	return nil
+}
+
+// ping sends one echo request to host and waits 5 seconds for the answer.
+func ping(host string) error {
+	args := []string{"-c", "1", "-W", "5", host}
+	if YOUR_OS == "windows" {
+		args = []string{"-n", "1", "-w", "5000", host}
+	} else if YOUR_OS == "darwin" {
+		// -W is in milliseconds there
+		args = []string{"-c", "1", "-W", "5000", host}
+	}
+	return exec.Command("ping", args...).Run()
+}
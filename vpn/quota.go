@@ -0,0 +1,200 @@
+package vpn
+
+import (
+	"encoding/json"
+	"fmt"
+	"hivpn/log"
+	"hivpn/utils"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	QUOTA_SAVE_INTERVAL = time.Minute
+
+	QUOTA_RESET_MONTHLY = "monthly"
+	QUOTA_RESET_WEEKLY  = "weekly"
+	QUOTA_RESET_DAILY   = "daily"
+)
+
+// quotaState is what QuotaFile holds, so the usage survives restarts.
+type quotaState struct {
+	PeriodStart time.Time        `json:"period_start"`
+	Used        map[string]int64 `json:"used"`
+}
+
+// quotas counts the bytes of the users with a Quota, both ways, and stops
+// forwarding theirs once it is used up until the next period.
+type quotas struct {
+	mu     sync.Mutex
+	state  quotaState
+	limits map[string]int64
+	file   string
+	reset  string
+	clock  utils.Clock
+}
+
+func (vpn *VPN) setupQuotas() error {
+	q := &quotas{
+		state:  quotaState{Used: make(map[string]int64, 0)},
+		limits: make(map[string]int64, 0),
+		file:   vpn.conf.QuotaFile,
+		reset:  vpn.conf.QuotaReset,
+		clock:  vpn.conf.Clock,
+	}
+	switch q.reset {
+	case "":
+		q.reset = QUOTA_RESET_MONTHLY
+	case QUOTA_RESET_MONTHLY, QUOTA_RESET_WEEKLY, QUOTA_RESET_DAILY:
+	default:
+		return fmt.Errorf("unknown quota reset: %s", q.reset)
+	}
+
+	for name, u := range vpn.userTable {
+		if u.Quota > 0 {
+			q.limits[name] = u.Quota
+		}
+	}
+	if len(q.limits) < 1 {
+		return nil
+	}
+
+	if len(q.file) > 0 {
+		data, err := os.ReadFile(q.file)
+		if err == nil {
+			err = json.Unmarshal(data, &q.state)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("read quota file error: %v", err)
+		}
+		if q.state.Used == nil {
+			q.state.Used = make(map[string]int64, 0)
+		}
+	}
+	q.rollover()
+
+	vpn.quotas = q
+	return nil
+}
+
+// periodStart returns the start of the period now is in, in UTC.
+func (q *quotas) periodStart(now time.Time) time.Time {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch q.reset {
+	case QUOTA_RESET_DAILY:
+		return day
+	case QUOTA_RESET_WEEKLY:
+		// weeks start on monday
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	}
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// rollover starts a new period when the current one is over, with q.mu
+// held or before q is shared.
+func (q *quotas) rollover() {
+	start := q.periodStart(q.clock.Now())
+	if !start.After(q.state.PeriodStart) {
+		return
+	}
+	if !q.state.PeriodStart.IsZero() {
+		log.Info("New quota period from", start.Format(time.RFC3339))
+	}
+	q.state.PeriodStart = start
+	q.state.Used = make(map[string]int64, 0)
+}
+
+// allow counts a packet of user, either way, and tells whether it may be
+// forwarded.
+func (q *quotas) allow(user string, size int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	limit, limited := q.limits[user]
+	if !limited {
+		return true
+	}
+	q.rollover()
+
+	used := q.state.Used[user]
+	if used >= limit {
+		return false
+	}
+	used += int64(size)
+	q.state.Used[user] = used
+	if used >= limit {
+		log.Info("User", user, "used up its quota, stop forwarding until the next period")
+	}
+	return true
+}
+
+// save writes the usage to QuotaFile, through a temporary file so a crash
+// does not leave half of it.
+func (q *quotas) save() {
+	if q == nil || len(q.file) < 1 {
+		return
+	}
+
+	q.mu.Lock()
+	data, err := json.Marshal(q.state)
+	q.mu.Unlock()
+	if err != nil {
+		log.Error("encode quotas error:", err)
+		return
+	}
+
+	tmp := q.file + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, q.file)
+	}
+	if err != nil {
+		log.Error("save quotas error:", err)
+	}
+}
+
+// saveQuotas saves the usage every QUOTA_SAVE_INTERVAL until stop is
+// closed, stop saves it a last time.
+func (vpn *VPN) saveQuotas(stop <-chan struct{}) {
+	for {
+		select {
+		case <-vpn.conf.Clock.After(QUOTA_SAVE_INTERVAL):
+			vpn.quotas.save()
+		case <-stop:
+			return
+		}
+	}
+}
+
+type quotaStatus struct {
+	Quota     int64 `json:"quota"`
+	Used      int64 `json:"used"`
+	Remaining int64 `json:"remaining"`
+}
+
+func (vpn *VPN) handlerQuotas(w http.ResponseWriter, r *http.Request) {
+	q := vpn.quotas
+	q.mu.Lock()
+	q.rollover()
+	users := make(map[string]quotaStatus, len(q.limits))
+	for user, limit := range q.limits {
+		used := q.state.Used[user]
+		remaining := limit - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		users[user] = quotaStatus{Quota: limit, Used: used, Remaining: remaining}
+	}
+	start := q.state.PeriodStart
+	q.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"period_start": start,
+		"reset":        q.reset,
+		"users":        users,
+	})
+}
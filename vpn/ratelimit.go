@@ -0,0 +1,142 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RATE_BURST is how much traffic a user can send at once above its Rate,
+// in time at that rate. Less makes TCP back off too often.
+const RATE_BURST = 200 * time.Millisecond
+
+// rateUnits are the units of a Rate, tc style: bits or bytes per second
+// with decimal prefixes.
+var rateUnits = []struct {
+	suffix string
+	bits   float64
+}{
+	{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+	{"gbps", 8e9}, {"mbps", 8e6}, {"kbps", 8e3}, {"bps", 8},
+}
+
+// parseRate returns the bytes per second of a Rate like "10mbit".
+func parseRate(rate string) (float64, error) {
+	s := strings.ToLower(strings.TrimSpace(rate))
+	for _, u := range rateUnits {
+		if !strings.HasSuffix(s, u.suffix) {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), 64)
+		if err != nil || n <= 0 {
+			break
+		}
+		return n * u.bits / 8, nil
+	}
+	return 0, fmt.Errorf("invalid rate %q, use a number and bit, kbit, mbit, gbit or bps, kbps, mbps, gbps", rate)
+}
+
+// tokenBucket lets rate bytes per second through with bursts up to burst
+// bytes.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, mtu int) tokenBucket {
+	burst := rate * RATE_BURST.Seconds()
+	// a full packet must always fit
+	if burst < float64(mtu) {
+		burst = float64(mtu)
+	}
+	return tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+func (b *tokenBucket) take(now time.Time, size int) bool {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < float64(size) {
+		return false
+	}
+	b.tokens -= float64(size)
+	return true
+}
+
+// rateLimits polices the users with a Rate, each way on its own: the
+// packets over the rate are dropped, holding them would stall the device
+// for all the users.
+type rateLimits struct {
+	mu      sync.Mutex
+	rates   map[string]float64
+	buckets map[string]*userBuckets
+	mtu     int
+	clock   utils.Clock
+	dropped int64
+}
+
+type userBuckets struct {
+	up, down tokenBucket
+}
+
+func (vpn *VPN) setupRates() error {
+	r := &rateLimits{
+		rates:   make(map[string]float64, 0),
+		buckets: make(map[string]*userBuckets, 0),
+		mtu:     vpn.conf.MTU,
+		clock:   vpn.conf.Clock,
+	}
+	for name, u := range vpn.userTable {
+		if len(u.Rate) < 1 {
+			continue
+		}
+		rate, err := parseRate(u.Rate)
+		if err != nil {
+			return fmt.Errorf("rate of user %s: %v", name, err)
+		}
+		r.rates[name] = rate
+	}
+	if len(r.rates) < 1 {
+		return nil
+	}
+
+	vpn.rates = r
+	return nil
+}
+
+// allow tells whether a packet of size bytes of user, from (up) or to its
+// client, is within its rate. The sessions and addresses of a user share
+// its buckets.
+func (r *rateLimits) allow(user string, size int, up bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rate, limited := r.rates[user]
+	if !limited {
+		return true
+	}
+	b := r.buckets[user]
+	if b == nil {
+		b = &userBuckets{up: newTokenBucket(rate, r.mtu), down: newTokenBucket(rate, r.mtu)}
+		r.buckets[user] = b
+	}
+	bucket := &b.down
+	if up {
+		bucket = &b.up
+	}
+	if bucket.take(r.clock.Now(), size) {
+		return true
+	}
+	atomic.AddInt64(&r.dropped, 1)
+	return false
+}
@@ -0,0 +1,104 @@
+package vpn
+
+import (
+	"hivpn/utils"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate string
+		want float64
+	}{
+		{"10mbit", 1.25e6},
+		{" 1.5 Gbit ", 1.875e8},
+		{"800kbit", 1e5},
+		{"64bit", 8},
+		{"2mbps", 2e6},
+		{"512kbps", 5.12e5},
+		{"0mbit", 0},
+		{"-1mbit", 0},
+		{"10", 0},
+		{"mbit", 0},
+	}
+	for _, test := range tests {
+		got, err := parseRate(test.rate)
+		if test.want == 0 {
+			if err == nil {
+				t.Errorf("rate %q parsed as %v", test.rate, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("rate %q parsed as %v, %v, want %v", test.rate, got, err, test.want)
+		}
+	}
+}
+
+// testRates are the rate limits of users, on a fake clock.
+func testRates(t *testing.T, clock *utils.FakeClock, users ...User) *rateLimits {
+	v := &VPN{conf: Config{MTU: 1500, Clock: clock}, userTable: make(map[string]User, 0)}
+	for _, u := range users {
+		v.userTable[u.Name] = u
+	}
+	if err := v.setupRates(); err != nil {
+		t.Fatal(err)
+	}
+	return v.rates
+}
+
+// offer sends packets of size bytes of user every interval for d and
+// returns the bytes per second let through.
+func offer(r *rateLimits, clock *utils.FakeClock, user string, up bool, size int, interval, d time.Duration) float64 {
+	passed := 0
+	for elapsed := time.Duration(0); elapsed < d; elapsed += interval {
+		if r.allow(user, size, up) {
+			passed += size
+		}
+		clock.Advance(interval)
+	}
+	return float64(passed) / d.Seconds()
+}
+
+func TestRateThroughput(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	r := testRates(t, clock, User{Name: "limited", Rate: "10mbit"}, User{Name: "free"})
+	rate := 1.25e6
+	// 1500 bytes every 100µs is 120mbit/s offered
+	const size, interval, d = 1500, 100 * time.Microsecond, 10 * time.Second
+
+	for _, up := range []bool{true, false} {
+		got := offer(r, clock, "limited", up, size, interval, d)
+		// the burst comes on top of the rate once
+		max := rate + (rate*RATE_BURST.Seconds()+size)/d.Seconds()
+		if got < rate*0.99 || got > max {
+			t.Errorf("up %v: %.0f bytes/s through a rate of %.0f, want at most %.0f", up, got, rate, max)
+		}
+	}
+
+	if got := offer(r, clock, "free", true, size, interval, time.Second); got != size/interval.Seconds() {
+		t.Errorf("user without a rate limited to %.0f bytes/s", got)
+	}
+	if r.dropped == 0 {
+		t.Error("no drop counted")
+	}
+}
+
+func TestRateBurstFitsAPacket(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	r := testRates(t, clock, User{Name: "limited", Rate: "8kbit"})
+
+	// 1000 bytes per second, a burst of 200 bytes would never let a full
+	// packet through
+	if !r.allow("limited", 1500, true) {
+		t.Fatal("packet of the MTU dropped")
+	}
+	if r.allow("limited", 1500, true) {
+		t.Error("second packet within the burst")
+	}
+	clock.Advance(1500 * time.Millisecond)
+	if !r.allow("limited", 1500, true) {
+		t.Error("bucket not refilled at the rate")
+	}
+}
@@ -0,0 +1,154 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/connection"
+	"hivpn/log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// liveUser is the session of a connected user, what a reload evicts when
+// the user is removed.
+type liveUser struct {
+	conn interface{}
+	ips  []string
+}
+
+func (vpn *VPN) bindLiveUser(name string, conn interface{}, ip, ip6 string) {
+	s := liveUser{conn: conn, ips: []string{ip}}
+	if len(ip6) > 0 {
+		s.ips = append(s.ips, ip6)
+	}
+	vpn.liveMu.Lock()
+	if vpn.liveUsers == nil {
+		vpn.liveUsers = make(map[string]liveUser, 0)
+	}
+	vpn.liveUsers[name] = s
+	vpn.liveMu.Unlock()
+}
+
+func (vpn *VPN) unbindLiveUser(name string, conn interface{}) {
+	vpn.liveMu.Lock()
+	if s, found := vpn.liveUsers[name]; found && s.conn == conn {
+		delete(vpn.liveUsers, name)
+	}
+	vpn.liveMu.Unlock()
+}
+
+// watchUsers reloads the users on SIGHUP until stop is closed.
+func (vpn *VPN) watchUsers(stop <-chan struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-sig:
+		case <-stop:
+			return
+		}
+
+		log.Info("Reload users")
+		err := vpn.reloadUsers()
+		if err != nil {
+			log.Error("reload users error:", err, ", the users are unchanged")
+		}
+	}
+}
+
+// reloadUsers replaces the user table with what ReloadUsers returns. New
+// users can connect at once, the sessions of the removed ones and of those
+// whose password changed are closed, the others stay up and get their new
+// settings when they connect again. What is set up at start from the users
+// (groups, subnets, NAT64, ports, quotas, rates) needs a restart to change,
+// a reload adding or changing it is refused.
+func (vpn *VPN) reloadUsers() error {
+	users, err := vpn.conf.ReloadUsers()
+	if err != nil {
+		return err
+	}
+	table, err := vpn.buildUserTable(users)
+	if err != nil {
+		return err
+	}
+	if vpn.pool != nil {
+		for name, u := range table {
+			if len(u.IP) > 0 && vpn.pool.Contains(net.ParseIP(u.IP)) {
+				return fmt.Errorf("static ip %s of user %s is inside the pool %s", u.IP, name, vpn.conf.Pool)
+			}
+		}
+	}
+
+	var added, removed, changed []string
+	vpn.usersMu.Lock()
+	for name, u := range table {
+		old, found := vpn.userTable[name]
+		if restartNeeded(old, u) {
+			vpn.usersMu.Unlock()
+			if !found {
+				return fmt.Errorf("new user %s has a Group, Subnets, NAT64, AllowedPorts, Quota or Rate, restart to add it", name)
+			}
+			return fmt.Errorf("user %s changed Group, Subnets, NAT64, AllowedPorts, Quota or Rate, restart to apply it", name)
+		}
+		if !found {
+			added = append(added, name)
+			continue
+		}
+		// a rekey lives on until the password of the file changes
+		if len(old.OldPass) > 0 && u.Pass == old.OldPass {
+			u.Pass, u.OldPass, u.OldPassUntil = old.Pass, old.OldPass, old.OldPassUntil
+			table[name] = u
+		}
+		// the key comes from Pass and Salt
+		if u.Pass != old.Pass {
+			changed = append(changed, name)
+		}
+	}
+	for name := range vpn.userTable {
+		if _, found := table[name]; !found {
+			removed = append(removed, name)
+		}
+	}
+	vpn.userTable = table
+	vpn.conf.Users = users
+	vpn.usersMu.Unlock()
+
+	for _, name := range removed {
+		vpn.evictUser(name, "user removed")
+	}
+	for _, name := range changed {
+		vpn.evictUser(name, "password changed")
+	}
+	log.Info(fmt.Sprintf("Users reloaded: %d users, %d added, %d removed, %d changed", len(table), len(added), len(removed), len(changed)))
+	return nil
+}
+
+// restartNeeded tells whether u changed what is only read at start, old is
+// empty for a new user.
+func restartNeeded(old, u User) bool {
+	return old.Group != u.Group || old.NAT64 != u.NAT64 || old.Quota != u.Quota || old.Rate != u.Rate ||
+		fmt.Sprint(old.Subnets) != fmt.Sprint(u.Subnets) || fmt.Sprint(old.AllowedPorts) != fmt.Sprint(u.AllowedPorts)
+}
+
+// evictUser takes the session of a removed user, or of one whose password
+// changed, out of the arp table so no packet reaches it anymore, and closes
+// it with reason.
+func (vpn *VPN) evictUser(name, reason string) {
+	vpn.liveMu.Lock()
+	s, found := vpn.liveUsers[name]
+	vpn.liveMu.Unlock()
+	if !found {
+		return
+	}
+
+	for _, ip := range s.ips {
+		if vpn.arpTable.Query(ip).Conn == s.conn {
+			vpn.arpTable.Delete(ip)
+		}
+	}
+	log.Info("User", name, reason+", close its session")
+	rejectConn(s.conn, connection.CLOSE_AUTH_FAILED, reason)
+}
@@ -0,0 +1,101 @@
+package vpn
+
+import (
+	"hivpn/log"
+	"hivpn/network"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closedPeer records how the server closed it.
+type closedPeer struct {
+	code   int
+	reason string
+}
+
+func (p *closedPeer) RemoteAddr() string    { return "198.51.100.1:1234" }
+func (p *closedPeer) PublicIP() string      { return "" }
+func (p *closedPeer) ClientTime() time.Time { return time.Time{} }
+func (p *closedPeer) Close(code int, reason string) {
+	p.code, p.reason = code, reason
+}
+
+// testReload is a server of users, each connected, which reloads next.
+func testReload(t *testing.T, next *[]User, users ...User) (*VPN, map[string]*closedPeer) {
+	log.SetLevel(log.LevelError)
+	v := testServer(t, users...)
+	v.arpTable = network.NewARP()
+	v.conf.ReloadUsers = func() ([]User, error) { return *next, nil }
+	peers := make(map[string]*closedPeer, 0)
+	for _, u := range users {
+		peers[u.Name] = &closedPeer{}
+		v.bindLiveUser(u.Name, peers[u.Name], strings.Split(u.IP, "/")[0], "")
+	}
+	return v, peers
+}
+
+func TestReloadEvictsChangedPasswords(t *testing.T) {
+	alice := User{Name: "alice", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.2/24"}
+	bob := User{Name: "bob", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.3/24"}
+	carol := User{Name: "carol", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.4/24"}
+	dave := User{Name: "dave", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.5/24"}
+	var next []User
+	v, peers := testReload(t, &next, alice, bob, carol, dave)
+
+	newBob, newCarol := bob, carol
+	newBob.Pass = "another"
+	newCarol.Salt = strings.ToUpper(TEST_SALT)
+	next = []User{alice, newBob, newCarol}
+	if err := v.reloadUsers(); err != nil {
+		t.Fatal(err)
+	}
+
+	if peers["alice"].code != 0 {
+		t.Error("unchanged user evicted")
+	}
+	for _, name := range []string{"bob", "carol", "dave"} {
+		if peers[name].code == 0 {
+			t.Errorf("session of %s left up", name)
+		}
+	}
+	if peers["bob"].reason != "password changed" || peers["dave"].reason != "user removed" {
+		t.Errorf("closed with %q and %q", peers["bob"].reason, peers["dave"].reason)
+	}
+}
+
+func TestReloadRefusesStartSettings(t *testing.T) {
+	alice := User{Name: "alice", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.2/24"}
+	var next []User
+	v, _ := testReload(t, &next, alice)
+
+	for _, u := range []User{
+		{Name: "bob", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.3/24", Quota: 1 << 30},
+		{Name: "bob", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.3/24", Rate: "1mbit"},
+		{Name: "bob", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.3/24", Group: "staff"},
+		{Name: "bob", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.3/24", AllowedPorts: []int{53}},
+		{Name: "alice", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.2/24", Rate: "1mbit"},
+	} {
+		next = []User{alice, u}
+		if u.Name == "alice" {
+			next = []User{u}
+		}
+		if err := v.reloadUsers(); err == nil {
+			t.Errorf("reload of %+v accepted", u)
+		}
+		if _, found := v.userTable["bob"]; found {
+			t.Fatal("user added by a refused reload")
+		}
+		if v.userTable["alice"].Rate != "" {
+			t.Fatal("user changed by a refused reload")
+		}
+	}
+
+	next = []User{alice, {Name: "bob", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.3/24"}}
+	if err := v.reloadUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := v.userTable["bob"]; !found {
+		t.Error("plain new user not added")
+	}
+}
@@ -0,0 +1,102 @@
+package vpn
+
+import (
+	"hivpn/crypto"
+	"hivpn/log"
+	"hivpn/tun"
+	"net"
+	"sync/atomic"
+)
+
+// clientSession is what the server knows of the session of a key. The
+// addresses of a packet are whatever the client wrote, only the key it
+// decrypted with tells who sent it.
+type clientSession struct {
+	user string
+	// sources are the addresses the client may send from: its own and
+	// its Subnets
+	sources []*net.IPNet
+	// dev is the device of the group of the user
+	dev tun.Device
+	// ports are the TCP/UDP ports it may send to, nil for any
+	ports map[uint16]bool
+}
+
+// newClientSession is the session of user, once its addresses are known.
+func (vpn *VPN) newClientSession(user string, u User) *clientSession {
+	s := &clientSession{user: user, ports: vpn.allowedPortsOf(user)}
+	for _, ip := range []string{u.IP, u.IP6} {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			continue
+		}
+		bits := 8 * net.IPv6len
+		if v4 := addr.To4(); v4 != nil {
+			addr, bits = v4, 8*net.IPv4len
+		}
+		s.sources = append(s.sources, &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)})
+	}
+	for _, subnet := range u.Subnets {
+		if _, ipNet, err := net.ParseCIDR(subnet); err == nil {
+			s.sources = append(s.sources, ipNet)
+		}
+	}
+	for _, g := range vpn.groups {
+		if g.group == u.Group && len(u.Group) > 0 {
+			s.dev = g.dev
+		}
+	}
+	return s
+}
+
+// owns tells whether the client of s may send from ip.
+func (s *clientSession) owns(ip net.IP) bool {
+	for _, n := range s.sources {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (vpn *VPN) bindSession(key *crypto.Session, s *clientSession) {
+	vpn.sessionsMu.Lock()
+	if vpn.sessions == nil {
+		vpn.sessions = make(map[*crypto.Session]*clientSession, 0)
+	}
+	vpn.sessions[key] = s
+	vpn.sessionsMu.Unlock()
+}
+
+func (vpn *VPN) unbindSession(key *crypto.Session) {
+	vpn.sessionsMu.Lock()
+	delete(vpn.sessions, key)
+	vpn.sessionsMu.Unlock()
+}
+
+// sessionOf returns the session of key, nil once it ended.
+func (vpn *VPN) sessionOf(key *crypto.Session) *clientSession {
+	vpn.sessionsMu.RLock()
+	defer vpn.sessionsMu.RUnlock()
+	return vpn.sessions[key]
+}
+
+// spoofed tells whether a packet of the session s claims a source the
+// client does not own, and counts it.
+func (vpn *VPN) spoofed(s *clientSession, src net.IP) bool {
+	if s.owns(src) {
+		return false
+	}
+	atomic.AddInt64(&vpn.spoofDropped, 1)
+	log.Debug("Drop packet of user", s.user, "from", src)
+	return true
+}
+
+// withinLimits tells whether a packet of size bytes of session, from its
+// client (up) or to it, fits the Rate and the Quota of the user.
+func (vpn *VPN) withinLimits(session *clientSession, size int, up bool) bool {
+	if vpn.rates != nil && !vpn.rates.allow(session.user, size, up) {
+		return false
+	}
+	return vpn.quotas == nil || vpn.quotas.allow(session.user, size)
+}
@@ -0,0 +1,37 @@
+package vpn
+
+import (
+	"hivpn/log"
+	"time"
+)
+
+// DEFAULT_MAX_CLOCK_SKEW is the skew tolerated when MaxClockSkew is not
+// set, the second resolution of the times exchanged and the latency of
+// the connection are well within it.
+const DEFAULT_MAX_CLOCK_SKEW = 120
+
+// maxClockSkew returns how far the clocks of a client and the server may
+// be, the time-based checks between them must accept that much.
+func (vpn *VPN) maxClockSkew() time.Duration {
+	if vpn.conf.MaxClockSkew > 0 {
+		return time.Duration(vpn.conf.MaxClockSkew) * time.Second
+	}
+	return DEFAULT_MAX_CLOCK_SKEW * time.Second
+}
+
+// checkClockSkew warns when the clock of the other side, as it told it when
+// connecting, is further than maxClockSkew from ours. A zero time is an
+// older peer that did not tell.
+func (vpn *VPN) checkClockSkew(who string, theirs time.Time) {
+	if theirs.IsZero() {
+		return
+	}
+
+	skew := theirs.Sub(vpn.conf.Clock.Now())
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > vpn.maxClockSkew() {
+		log.Error("The clock of", who, "is", skew.Round(time.Second), "off, fix the time (NTP) of one of them")
+	}
+}
@@ -0,0 +1,107 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hivpn/log"
+	"hivpn/utils"
+	"net/http"
+	"sync/atomic"
+)
+
+// serveStats exposes the operational endpoints on vpn.conf.StatsAddr.
+func (vpn *VPN) serveStats(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", vpn.handlerHealth)
+	mux.HandleFunc("/counters", vpn.handlerCounters)
+	mux.HandleFunc("/queues", vpn.handlerQueues)
+	if vpn.traffic != nil {
+		mux.HandleFunc("/traffic", vpn.handlerTraffic)
+	}
+	if vpn.dropped != nil {
+		mux.HandleFunc("/dropped", vpn.handlerDropped)
+	}
+	if vpn.quotas != nil {
+		mux.HandleFunc("/quotas", vpn.handlerQuotas)
+	}
+	if vpn.userStats != nil {
+		mux.HandleFunc("/users", vpn.handlerUsers)
+	}
+
+	log.Info("Stats listening on", vpn.conf.StatsAddr)
+	err := utils.ServeHTTP(ctx, vpn.conf.StatsAddr, vpn.conf.StatsTLSCert, vpn.conf.StatsTLSKey, vpn.conf.StatsToken, mux)
+	if err != nil {
+		log.Error("stats endpoint error:", err)
+	}
+}
+
+func (vpn *VPN) handlerHealth(w http.ResponseWriter, r *http.Request) {
+	if !vpn.conf.IsServer && vpn.arpTable.QueryOne("").Conn == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "disconnected")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// counters are the totals since the start, served on /counters and pushed
+// to OTLPEndpoint.
+func (vpn *VPN) counters() map[string]int64 {
+	counters := map[string]int64{
+		// packets and bytes out of and into the tunnel
+		"rx_packets":        atomic.LoadInt64(&vpn.rxPackets),
+		"rx_bytes":          atomic.LoadInt64(&vpn.rxBytes),
+		"tx_packets":        atomic.LoadInt64(&vpn.txPackets),
+		"tx_bytes":          atomic.LoadInt64(&vpn.txBytes),
+		"decrypt_errors":    atomic.LoadInt64(&vpn.decryptErrors),
+		"reconnects":        atomic.LoadInt64(&vpn.reconnects),
+		"dev_write_errors":  atomic.LoadInt64(&vpn.devWriteErrors),
+		"dev_write_retries": atomic.LoadInt64(&vpn.devRetries),
+		"port_dropped":      atomic.LoadInt64(&vpn.portDropped),
+		// from an address the session of the client does not own
+		"spoof_dropped": atomic.LoadInt64(&vpn.spoofDropped),
+		// client to client through the server vs forwarded to the host
+		"mesh_packets":    atomic.LoadInt64(&vpn.meshPackets),
+		"mesh_bytes":      atomic.LoadInt64(&vpn.meshBytes),
+		"gateway_packets": atomic.LoadInt64(&vpn.gatewayPackets),
+		"gateway_bytes":   atomic.LoadInt64(&vpn.gatewayBytes),
+		"probe_ok":        atomic.LoadInt64(&vpn.probeOK),
+		"probe_failed":    atomic.LoadInt64(&vpn.probeFailed),
+	}
+	if vpn.rates != nil {
+		counters["rate_dropped"] = atomic.LoadInt64(&vpn.rates.dropped)
+	}
+	// bytes waiting in the session queues now, all of them and the
+	// deepest one (see /queues)
+	counters["queued_bytes"] = vpn.channel.QueuedBytes()
+	var deepest int64
+	for _, depth := range vpn.channel.QueueDepths() {
+		if depth > deepest {
+			deepest = depth
+		}
+	}
+	counters["queue_deepest_bytes"] = deepest
+	if vpn.mtuWatch != nil {
+		counters["mtu_large_retransmits"] = atomic.LoadInt64(&vpn.mtuWatch.largeRetransmits)
+		counters["mtu_blackhole_warnings"] = atomic.LoadInt64(&vpn.mtuWatch.warnings)
+	}
+	return counters
+}
+
+// gaugeCounters are the counters that go down too, pushed as gauges.
+var gaugeCounters = map[string]bool{
+	"queued_bytes":        true,
+	"queue_deepest_bytes": true,
+}
+
+func (vpn *VPN) handlerCounters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vpn.counters())
+}
+
+// handlerQueues returns the bytes queued to each session by its id.
+func (vpn *VPN) handlerQueues(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vpn.channel.QueueDepths())
+}
@@ -0,0 +1,111 @@
+package vpn
+
+import (
+	"fmt"
+	"hivpn/log"
+	"net"
+	"sort"
+	"sync"
+)
+
+// userSubnet is a network behind the client of a user (a spoke), the server
+// forwards the packets to it to that session.
+type userSubnet struct {
+	network *net.IPNet
+	user    string
+}
+
+// subnetRoutes finds the session owning a destination by longest prefix
+// match over the Subnets of the users.
+type subnetRoutes struct {
+	nets []userSubnet
+
+	mu  sync.RWMutex
+	ips map[string]string // user to the address of its session
+}
+
+// setupSubnets checks the Subnets of the users, two users cannot own the
+// same one, and routes them to the device.
+func (vpn *VPN) setupSubnets() error {
+	routes := &subnetRoutes{ips: make(map[string]string, 0)}
+	owners := make(map[string]string, 0)
+	for _, u := range vpn.conf.Users {
+		if len(u.Subnets) > 0 && len(u.Group) > 0 {
+			return fmt.Errorf("user %s cannot have Subnets in a group", u.Name)
+		}
+		for _, s := range u.Subnets {
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				return fmt.Errorf("subnet of user %s: %v", u.Name, err)
+			}
+			if owner, found := owners[ipNet.String()]; found {
+				return fmt.Errorf("subnet %s belongs to both %s and %s", ipNet, owner, u.Name)
+			}
+			if ipNet.Contains(vpn.myNetwork.IP) || vpn.myNetwork.Contains(ipNet.IP) {
+				return fmt.Errorf("subnet %s of user %s overlaps the network of the server", ipNet, u.Name)
+			}
+			owners[ipNet.String()] = u.Name
+			routes.nets = append(routes.nets, userSubnet{network: ipNet, user: u.Name})
+		}
+	}
+	if len(routes.nets) < 1 {
+		return nil
+	}
+
+	sort.SliceStable(routes.nets, func(i, j int) bool {
+		a, _ := routes.nets[i].network.Mask.Size()
+		b, _ := routes.nets[j].network.Mask.Size()
+		return a > b
+	})
+	vpn.subnets = routes
+	return nil
+}
+
+// addSubnetRoutes sends the traffic of the host to the subnets through the
+// device, they go away with it.
+func (vpn *VPN) addSubnetRoutes() {
+	if YOUR_OS != "linux" || vpn.conf.Device != nil {
+		return
+	}
+	for _, s := range vpn.subnets.nets {
+		err := vpn.runCmd("/sbin/ip", "route", "add", s.network.String(), "dev", TUN_NAME)
+		if err != nil {
+			log.Error("add route to subnet", s.network, "of user", s.user, "error:", err)
+			continue
+		}
+		log.Info("Subnet", s.network, "through user", s.user)
+	}
+}
+
+func (r *subnetRoutes) bind(user, ip string) {
+	r.mu.Lock()
+	r.ips[user] = ip
+	r.mu.Unlock()
+}
+
+func (r *subnetRoutes) unbind(user, ip string) {
+	r.mu.Lock()
+	if r.ips[user] == ip {
+		delete(r.ips, user)
+	}
+	r.mu.Unlock()
+}
+
+// lookup returns the address of the session owning the most specific
+// subnet of ip, false when no connected user owns it.
+func (r *subnetRoutes) lookup(ip string) (string, bool) {
+	dst := net.ParseIP(ip)
+	if dst == nil {
+		return "", false
+	}
+	for _, s := range r.nets {
+		if !s.network.Contains(dst) {
+			continue
+		}
+		r.mu.RLock()
+		owner, found := r.ips[s.user]
+		r.mu.RUnlock()
+		return owner, found
+	}
+	return "", false
+}
@@ -0,0 +1,151 @@
+package vpn
+
+import (
+	"encoding/json"
+	"fmt"
+	"hivpn/network"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var protocolNames = map[int]string{
+	1:  "icmp",
+	6:  "tcp",
+	17: "udp",
+	58: "icmpv6",
+}
+
+type counter struct {
+	Packets int64 `json:"packets"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type talker struct {
+	Dst   string `json:"dst"`
+	Bytes int64  `json:"bytes"`
+	// Error is the most the bytes may be overestimated by, see add
+	Error int64 `json:"error"`
+}
+
+// trafficStats counts the packets forwarded by the server per L4 protocol
+// and, when topN > 0, the destinations each session sends the most to.
+type trafficStats struct {
+	protocols [256]counter
+
+	topN     int
+	sessions map[string]bool
+	mu       sync.Mutex
+	talkers  map[string][]talker
+}
+
+func newTrafficStats(topN int, sessions map[string]bool) *trafficStats {
+	return &trafficStats{
+		topN:     topN,
+		sessions: sessions,
+		talkers:  make(map[string][]talker, 0),
+	}
+}
+
+func (s *trafficStats) count(header network.PacketHeader, data []byte) {
+	if header.IPDst == nil {
+		return
+	}
+
+	proto := data[9]
+	if header.IsIPv6 {
+		proto = data[6]
+	}
+	atomic.AddInt64(&s.protocols[proto].Packets, 1)
+	atomic.AddInt64(&s.protocols[proto].Bytes, int64(len(data)))
+}
+
+// countSession records a packet sent by a client. Only the sessions of
+// configured users are kept so spoofed sources cannot grow the table.
+func (s *trafficStats) countSession(header network.PacketHeader, data []byte) {
+	s.count(header, data)
+	if s.topN < 1 || header.IPDst == nil {
+		return
+	}
+
+	session := header.IPSrc.String()
+	if !s.sessions[session] {
+		return
+	}
+
+	s.mu.Lock()
+	s.talkers[session] = s.add(s.talkers[session], header.IPDst.String(), int64(len(data)))
+	s.mu.Unlock()
+}
+
+// add keeps the topN destinations with the space-saving algorithm: when the
+// list is full the smallest entry is replaced and inherits its count.
+func (s *trafficStats) add(list []talker, dst string, size int64) []talker {
+	min := -1
+	for i := range list {
+		if list[i].Dst == dst {
+			list[i].Bytes += size
+			return list
+		}
+		if min < 0 || list[i].Bytes < list[min].Bytes {
+			min = i
+		}
+	}
+
+	if len(list) < s.topN {
+		return append(list, talker{Dst: dst, Bytes: size})
+	}
+
+	list[min] = talker{Dst: dst, Bytes: list[min].Bytes + size, Error: list[min].Bytes}
+	return list
+}
+
+func (s *trafficStats) protocolCounters() map[string]counter {
+	result := make(map[string]counter, 0)
+	for i := range s.protocols {
+		c := counter{
+			Packets: atomic.LoadInt64(&s.protocols[i].Packets),
+			Bytes:   atomic.LoadInt64(&s.protocols[i].Bytes),
+		}
+		if c.Packets < 1 {
+			continue
+		}
+
+		name, found := protocolNames[i]
+		if !found {
+			name = fmt.Sprintf("%d", i)
+		}
+		result[name] = c
+	}
+	return result
+}
+
+func (s *trafficStats) topTalkers(session string) map[string][]talker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string][]talker, 0)
+	for k, list := range s.talkers {
+		if len(session) > 0 && k != session {
+			continue
+		}
+		sorted := append([]talker(nil), list...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Bytes > sorted[j].Bytes })
+		result[k] = sorted
+	}
+	return result
+}
+
+// handlerTraffic returns the counters as json, ?session=<ip> limits the top
+// talkers to one session.
+func (vpn *VPN) handlerTraffic(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Protocols  map[string]counter  `json:"protocols"`
+		TopTalkers map[string][]talker `json:"top_talkers,omitempty"`
+	}{
+		Protocols:  vpn.traffic.protocolCounters(),
+		TopTalkers: vpn.traffic.topTalkers(r.URL.Query().Get("session")),
+	})
+}
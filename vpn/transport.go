@@ -0,0 +1,89 @@
+package vpn
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// TRANSPORT_CDN is for a server fronted by a CDN proxying websockets
+	// (Cloudflare...): the client connects to the CDN over wss:// with the
+	// name of the server as Host and SNI, and pings often enough for the
+	// CDN not to close the session
+	TRANSPORT_CDN = "cdn"
+
+	// CDN_KEEPALIVE is well under the 100 seconds Cloudflare lets a
+	// websocket idle
+	CDN_KEEPALIVE = 30
+
+	// CDN_CLIENT_IP_HEADER carries the address of the client to the server
+	CDN_CLIENT_IP_HEADER = "CF-Connecting-IP"
+
+	// TRANSPORT_MEMORY connects a client and a server of the same process
+	// over channels, ServerAddr is then only a name. It is meant for tests
+	// with tun.CreateMemoryTUN devices
+	TRANSPORT_MEMORY = "memory"
+
+	// TRANSPORT_UDP carries the tunnel in UDP datagrams, for the networks
+	// slowing down long TCP connections. There is no TLS, the frames are
+	// encrypted anyway, and KeepAlive defaults to
+	// connection.UDP_KEEPALIVE for the NATs
+	TRANSPORT_UDP = "udp"
+)
+
+// applyTransport fills the knobs of the Transport profile that the config
+// leaves unset.
+func (vpn *VPN) applyTransport() error {
+	switch vpn.conf.Transport {
+	case "", TRANSPORT_MEMORY:
+		return nil
+	case TRANSPORT_UDP:
+		if vpn.conf.TLS || len(vpn.conf.TLSCert) > 0 || vpn.conf.ACME {
+			return fmt.Errorf("transport %s has no TLS", TRANSPORT_UDP)
+		}
+		return nil
+	case TRANSPORT_CDN:
+	default:
+		return fmt.Errorf("unknown transport: %s", vpn.conf.Transport)
+	}
+
+	if vpn.conf.KeepAlive == 0 {
+		vpn.conf.KeepAlive = CDN_KEEPALIVE
+	}
+	if vpn.conf.IsServer {
+		// the CDN terminates the tls of the client, the server may or may
+		// not have its own behind it
+		if len(vpn.conf.ClientIPHeader) < 1 {
+			vpn.conf.ClientIPHeader = CDN_CLIENT_IP_HEADER
+		}
+		return nil
+	}
+
+	if len(vpn.conf.HostHeader) < 1 {
+		return fmt.Errorf("transport %s needs HostHeader, the name of the server on the CDN", TRANSPORT_CDN)
+	}
+	vpn.conf.TLS = true
+	return nil
+}
+
+// allowedSources parses AllowedSources, CIDRs or single addresses of v4
+// and v6.
+func (vpn *VPN) allowedSources() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range vpn.conf.AllowedSources {
+		if _, ipNet, err := net.ParseCIDR(s); err == nil {
+			nets = append(nets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid allowed source: %s", s)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
@@ -0,0 +1,403 @@
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hivpn/connection"
+	"hivpn/crypto"
+	"hivpn/log"
+	"hivpn/network"
+	"hivpn/tun"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_TIMEOUT = 10 * time.Second
+	TEST_SALT    = "0123456789abcdef0123456789abcdef"
+	// IPv4 and UDP headers of udpPacket
+	TEST_UDP_HEADERS = 28
+)
+
+var (
+	testClientIP = net.IP{172, 16, 0, 2}
+	testRemoteIP = net.IP{8, 8, 8, 8}
+)
+
+// testTunnel is a server and a client of the same process over the memory
+// transport, with memory devices: what is injected into one comes out of
+// the other.
+type testTunnel struct {
+	server, client *tun.MemoryDevice
+	cancel         context.CancelFunc
+	// clientDone gets what CreateWithContext of the client returned
+	clientDone chan error
+}
+
+// startTunnel runs a tunnel for user, configure changes the configs of the
+// server and the client before they start. It returns once a packet went
+// through.
+func startTunnel(tb testing.TB, user User, mtu int, configure func(server, client *Config)) *testTunnel {
+	log.SetLevel(log.LevelError)
+	addr := fmt.Sprintf("%s-%d", tb.Name(), time.Now().UnixNano())
+	ctx, cancel := context.WithCancel(context.Background())
+	tt := &testTunnel{
+		server:     tun.CreateMemoryTUN("server", mtu),
+		client:     tun.CreateMemoryTUN("client", mtu),
+		cancel:     cancel,
+		clientDone: make(chan error, 1),
+	}
+	tb.Cleanup(cancel)
+
+	server := Config{
+		MTU:        mtu,
+		ServerAddr: addr,
+		LocalAddr:  "172.16.0.1/24",
+		IsServer:   true,
+		Users:      []User{user},
+		Device:     tt.server,
+		Transport:  TRANSPORT_MEMORY,
+	}
+	client := Config{
+		MTU:        mtu,
+		ServerAddr: addr,
+		LocalAddr:  user.IP,
+		Users:      []User{user},
+		Device:     tt.client,
+		Transport:  TRANSPORT_MEMORY,
+	}
+	if configure != nil {
+		configure(&server, &client)
+	}
+	go CreateWithContext(ctx, server)
+	if server.Transport != TRANSPORT_MEMORY {
+		// unlike the memory dial, the first one of the client fails at once
+		waitListening(tb, server.ServerAddr)
+	}
+	go func() {
+		_, err := CreateWithContext(ctx, client)
+		tt.clientDone <- err
+	}()
+
+	err := tt.roundTrip(tt.client, tt.server, udpPacket(testClientIP, testRemoteIP, []byte("ping")))
+	if err != nil {
+		tb.Fatal("tunnel did not come up:", err)
+	}
+	return tt
+}
+
+// waitListening returns once the server accepts connections on addr.
+func waitListening(tb testing.TB, addr string) {
+	deadline := time.Now().Add(TEST_TIMEOUT)
+	for {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			tb.Fatal("server not listening:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testListenAddr is a free tcp address of the loopback.
+func testListenAddr(tb testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// roundTrip injects packet into from until it comes out of to, the first
+// ones are dropped while the client connects.
+func (tt *testTunnel) roundTrip(from, to *tun.MemoryDevice, packet []byte) error {
+	deadline := time.After(TEST_TIMEOUT)
+	for {
+		err := from.Inject(packet)
+		if err != nil {
+			return err
+		}
+
+		retry := time.After(200 * time.Millisecond)
+	wait:
+		for {
+			select {
+			case got := <-to.Received():
+				if bytes.Equal(got, packet) {
+					return nil
+				}
+			case <-retry:
+				break wait
+			case <-deadline:
+				return fmt.Errorf("packet of %d bytes did not go through the tunnel", len(packet))
+			}
+		}
+	}
+}
+
+// dropped injects packets into the client, then one going through, and
+// fails if any of packets came out of the server before it: the packets of
+// a session keep their order.
+func (tt *testTunnel) dropped(packets ...[]byte) error {
+	last := udpPacket(testClientIP, testRemoteIP, []byte("last"))
+	for _, packet := range append(packets, last) {
+		if err := tt.client.Inject(packet); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case got := <-tt.server.Received():
+			if bytes.Equal(got, last) {
+				return nil
+			}
+			for i, packet := range packets {
+				if bytes.Equal(got, packet) {
+					return fmt.Errorf("packet %d forwarded", i)
+				}
+			}
+		case <-time.After(TEST_TIMEOUT):
+			return fmt.Errorf("packet from the address of the user did not go through")
+		}
+	}
+}
+
+// udpPacket is an IPv4 UDP packet from src to dst, the UDP checksum is
+// left to 0 (none).
+func udpPacket(src, dst net.IP, payload []byte) []byte {
+	packet := make([]byte, TEST_UDP_HEADERS+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:16], src.To4())
+	copy(packet[16:20], dst.To4())
+
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	binary.BigEndian.PutUint16(packet[10:], ^uint16(sum))
+
+	binary.BigEndian.PutUint16(packet[20:], 40000)
+	binary.BigEndian.PutUint16(packet[22:], 53)
+	binary.BigEndian.PutUint16(packet[24:], uint16(8+len(payload)))
+	copy(packet[28:], payload)
+	return packet
+}
+
+// benchDevice is a tun.Device that reads packet left times, then blocks:
+// the readers of a finished benchmark stay parked.
+type benchDevice struct {
+	packet []byte
+	left   int64
+}
+
+func (d *benchDevice) Read(buf []byte, offset int) (int, error) {
+	if atomic.AddInt64(&d.left, -1) < 0 {
+		select {}
+	}
+	return copy(buf[offset:], d.packet), nil
+}
+
+func (d *benchDevice) Write(buf []byte, offset int) (int, error) { return len(buf) - offset, nil }
+func (d *benchDevice) File() *os.File                            { return nil }
+func (d *benchDevice) Flush() error                              { return nil }
+func (d *benchDevice) MTU() (int, error)                         { return len(d.packet), nil }
+func (d *benchDevice) Name() (string, error)                     { return "bench", nil }
+func (d *benchDevice) Events() chan tun.Event                    { return nil }
+func (d *benchDevice) Close() error                              { return nil }
+
+// BenchmarkTunReaders reads full packets from the device with 1, 2 and 4
+// readers. Each packet is parsed and encrypted, the work the readers share
+// before the connection.
+func BenchmarkTunReaders(b *testing.B) {
+	const MTU = 1500
+	key := bytes.Repeat([]byte{0x42}, 32)
+	packet := udpPacket(testRemoteIP, testClientIP, bytes.Repeat([]byte{0xAA}, MTU-TEST_UDP_HEADERS))
+	for _, readers := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			done := make(chan struct{}, b.N)
+			vpn := &VPN{
+				conf: Config{MTU: MTU},
+				dev:  &benchDevice{packet: packet, left: int64(b.N)},
+			}
+			vpn.writeDevToTun = func(header network.PacketHeader, data []byte) error {
+				_, err := crypto.AESEncrypt(key, data)
+				done <- struct{}{}
+				return err
+			}
+
+			b.SetBytes(int64(len(packet)))
+			b.ResetTimer()
+			for i := 0; i < readers; i++ {
+				go vpn.handler(vpn.dev)
+			}
+			for i := 0; i < b.N; i++ {
+				<-done
+			}
+		})
+	}
+}
+
+func TestTunnelJumboFrames(t *testing.T) {
+	const MTU = 9000
+	user := User{Name: "user", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.2/24"}
+	tt := startTunnel(t, user, MTU, nil)
+
+	payload := make([]byte, MTU-TEST_UDP_HEADERS)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	err := tt.roundTrip(tt.client, tt.server, udpPacket(testClientIP, testRemoteIP, payload))
+	if err != nil {
+		t.Fatal("client to server:", err)
+	}
+	err = tt.roundTrip(tt.server, tt.client, udpPacket(testRemoteIP, testClientIP, payload))
+	if err != nil {
+		t.Fatal("server to client:", err)
+	}
+}
+
+func TestWrongPasswordStopsReconnecting(t *testing.T) {
+	user := User{Name: "changed", Pass: "old password", Salt: TEST_SALT, IP: "172.16.0.2/24"}
+	auth := testServer(t, user)
+	addr := testListenAddr(t)
+	tt := startTunnel(t, user, 1500, func(server, client *Config) {
+		server.Transport, client.Transport = "", ""
+		server.ServerAddr, client.ServerAddr = addr, addr
+		server.Authenticator = staticUsers{auth}
+		server.MaxSessionLifetime = 1
+	})
+
+	// the password changes on the server, the session expires and the
+	// client comes back with the old one
+	changed := testServer(t, User{Name: user.Name, Pass: "new password", Salt: TEST_SALT, IP: user.IP})
+	auth.usersMu.Lock()
+	auth.userTable = changed.userTable
+	auth.usersMu.Unlock()
+
+	select {
+	case err := <-tt.clientDone:
+		var closeErr *connection.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != connection.CLOSE_AUTH_FAILED {
+			t.Errorf("client stopped with %v, want close %d", err, connection.CLOSE_AUTH_FAILED)
+		}
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("client still reconnecting with a wrong password")
+	}
+}
+
+func TestSpoofedSourceDropped(t *testing.T) {
+	user := User{Name: "spoke", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.2/24", Subnets: []string{"192.168.50.0/24"}}
+	tt := startTunnel(t, user, 1500, nil)
+
+	err := tt.roundTrip(tt.client, tt.server, udpPacket(net.IP{192, 168, 50, 7}, testRemoteIP, []byte("from the subnet")))
+	if err != nil {
+		t.Fatal("packet from a subnet of the user:", err)
+	}
+	// another client and an address of nobody
+	err = tt.dropped(udpPacket(net.IP{172, 16, 0, 3}, testRemoteIP, []byte("spoofed")), udpPacket(net.IP{10, 1, 2, 3}, testRemoteIP, []byte("spoofed")))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllowedPortsOfPoolUser(t *testing.T) {
+	user := User{Name: "pooled", Pass: "password", Salt: TEST_SALT, AllowedPorts: []int{53}}
+	tt := startTunnel(t, user, 1500, func(server, client *Config) {
+		// the pool has one address left, the one of udpPacket
+		server.Pool = "172.16.0.0/30"
+		server.ReservedIPs = []string{"172.16.0.1"}
+	})
+
+	https := udpPacket(testClientIP, testRemoteIP, []byte("to 443"))
+	binary.BigEndian.PutUint16(https[22:], 443)
+	if err := tt.dropped(https); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuotaOfSessionUser(t *testing.T) {
+	user := User{Name: "spoke", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.2/24", Subnets: []string{"192.168.50.0/24"}, Quota: 10000}
+	tt := startTunnel(t, user, 1500, nil)
+
+	// to the subnet behind the user, counted like its own address
+	sent := 30
+	for i := 0; i < sent; i++ {
+		packet := udpPacket(testRemoteIP, net.IP{192, 168, 50, 7}, make([]byte, 1000))
+		if err := tt.server.Inject(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := 0
+	for {
+		select {
+		case <-tt.client.Received():
+			received++
+			continue
+		case <-time.After(500 * time.Millisecond):
+		}
+		break
+	}
+	if received < 1 || int64(received) > user.Quota/1000 {
+		t.Errorf("%d packets of 1000 bytes over a quota of %d bytes", received, user.Quota)
+	}
+}
+
+func TestListenersStopWithContext(t *testing.T) {
+	log.SetLevel(log.LevelError)
+	user := User{Name: "user", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.2/24"}
+	stats, admin := testListenAddr(t), testListenAddr(t)
+
+	// the second run listens where the first one did
+	for run := 0; run < 2; run++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			_, err := CreateWithContext(ctx, Config{
+				MTU:        1500,
+				ServerAddr: fmt.Sprintf("%s-%d", t.Name(), run),
+				LocalAddr:  "172.16.0.1/24",
+				IsServer:   true,
+				Users:      []User{user},
+				Device:     tun.CreateMemoryTUN("server", 1500),
+				Transport:  TRANSPORT_MEMORY,
+				StatsAddr:  stats,
+				AdminAddr:  admin,
+			})
+			done <- err
+		}()
+		waitListening(t, stats)
+		waitListening(t, admin)
+		cancel()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(TEST_TIMEOUT):
+			t.Fatal("server still running once ctx is done")
+		}
+		for _, addr := range []string{stats, admin} {
+			if c, err := net.Dial("tcp", addr); err == nil {
+				c.Close()
+				t.Fatalf("run %d: %s still listening once CreateWithContext returned", run, addr)
+			}
+		}
+	}
+}
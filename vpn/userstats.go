@@ -0,0 +1,172 @@
+package vpn
+
+import (
+	"encoding/json"
+	"hivpn/crypto"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// userCounters are the totals of a user since the start of the server, rx
+// from its client and tx to it. LastSeen is the unix time of its last
+// packet, 0 before the first one.
+type userCounters struct {
+	RxPackets int64 `json:"rx_packets"`
+	RxBytes   int64 `json:"rx_bytes"`
+	TxPackets int64 `json:"tx_packets"`
+	TxBytes   int64 `json:"tx_bytes"`
+	LastSeen  int64 `json:"last_seen"`
+}
+
+// userStats counts the traffic of each user on the server, found by the
+// key of its session on the way in and by its connection on the way out.
+type userStats struct {
+	mu     sync.RWMutex
+	users  map[string]*userCounters
+	byKey  map[*crypto.Session]*userCounters
+	byConn map[interface{}]*userCounters
+}
+
+func newUserStats() *userStats {
+	return &userStats{
+		users:  make(map[string]*userCounters, 0),
+		byKey:  make(map[*crypto.Session]*userCounters, 0),
+		byConn: make(map[interface{}]*userCounters, 0),
+	}
+}
+
+// bind counts the session of conn and key as user's until unbind.
+func (s *userStats) bind(user string, conn interface{}, key *crypto.Session) {
+	s.mu.Lock()
+	c := s.users[user]
+	if c == nil {
+		c = &userCounters{}
+		s.users[user] = c
+	}
+	s.byKey[key] = c
+	s.byConn[conn] = c
+	s.mu.Unlock()
+}
+
+func (s *userStats) unbind(conn interface{}, key *crypto.Session) {
+	s.mu.Lock()
+	delete(s.byKey, key)
+	delete(s.byConn, conn)
+	s.mu.Unlock()
+}
+
+// countRx records packets of bytes received on the session of key at now.
+func (s *userStats) countRx(key *crypto.Session, packets, bytes int, now time.Time) {
+	s.mu.RLock()
+	c := s.byKey[key]
+	s.mu.RUnlock()
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.RxPackets, int64(packets))
+	atomic.AddInt64(&c.RxBytes, int64(bytes))
+	atomic.StoreInt64(&c.LastSeen, now.Unix())
+}
+
+// countTx records a packet sent to conn.
+func (s *userStats) countTx(conn interface{}, bytes int) {
+	s.mu.RLock()
+	c := s.byConn[conn]
+	s.mu.RUnlock()
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.TxPackets, 1)
+	atomic.AddInt64(&c.TxBytes, int64(bytes))
+}
+
+func (s *userStats) get(user string) userCounters {
+	s.mu.RLock()
+	c := s.users[user]
+	s.mu.RUnlock()
+	if c == nil {
+		return userCounters{}
+	}
+	return userCounters{
+		RxPackets: atomic.LoadInt64(&c.RxPackets),
+		RxBytes:   atomic.LoadInt64(&c.RxBytes),
+		TxPackets: atomic.LoadInt64(&c.TxPackets),
+		TxBytes:   atomic.LoadInt64(&c.TxBytes),
+		LastSeen:  atomic.LoadInt64(&c.LastSeen),
+	}
+}
+
+func (s *userStats) names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.users))
+	for name := range s.users {
+		names = append(names, name)
+	}
+	return names
+}
+
+type userStatus struct {
+	// State is "up" while the arp table holds the session of the user
+	State    string   `json:"state"`
+	IPs      []string `json:"ips,omitempty"`
+	PublicIP string   `json:"public_ip,omitempty"`
+	userCounters
+}
+
+// handlerUsers returns the state and the counters of the configured users
+// and of the ones authenticated by AuthWebhook since the start, by name.
+// ?user=<name>, or ?ip=<address> of a connected user, returns only that
+// user.
+func (vpn *VPN) handlerUsers(w http.ResponseWriter, r *http.Request) {
+	seen := make(map[string]bool, 0)
+	vpn.usersMu.RLock()
+	for name := range vpn.userTable {
+		seen[name] = true
+	}
+	vpn.usersMu.RUnlock()
+	for _, name := range vpn.userStats.names() {
+		seen[name] = true
+	}
+
+	vpn.liveMu.Lock()
+	live := make(map[string]liveUser, len(vpn.liveUsers))
+	for name, s := range vpn.liveUsers {
+		live[name] = s
+	}
+	vpn.liveMu.Unlock()
+
+	onlyUser, onlyIP := r.URL.Query().Get("user"), r.URL.Query().Get("ip")
+	users := make(map[string]userStatus, len(seen))
+	for name := range seen {
+		status := userStatus{State: "down", userCounters: vpn.userStats.get(name)}
+		if s, found := live[name]; found {
+			if r := vpn.arpTable.Query(s.ips[0]); r.Conn != nil && r.Conn == s.conn {
+				status.State = "up"
+				status.IPs = s.ips
+				status.PublicIP = r.PublicIP
+			}
+		}
+		if len(onlyUser) > 0 && name != onlyUser {
+			continue
+		}
+		if len(onlyIP) > 0 && !contains(status.IPs, onlyIP) {
+			continue
+		}
+		users[name] = status
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
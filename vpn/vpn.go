@@ -1,7 +1,10 @@
 package vpn
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"hivpn/connection"
 	"hivpn/crypto"
@@ -9,32 +12,262 @@ import (
 	"hivpn/network"
 	"hivpn/tun"
 	"hivpn/utils"
+	"io"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
 )
 
 type Config struct {
 	MTU            int
 	ServerAddr     string
+	ServerHost     string
 	LocalAddr      string
+	LocalAddr6     string
 	HostHeader     string
 	DefaultGateway string
 	IsServer       bool
 	Whitelist      []string
 	Blacklist      []string
 	Users          []User
+
+	// Groups get a device each, their users are served through it
+	Groups []Group
+
+	// WhitelistFile and BlacklistFile hold one ip or CIDR per line, they are
+	// read again on SIGHUP
+	WhitelistFile string
+	BlacklistFile string
+
+	ResolveInterval int
+
+	// ProbeTarget (an url or a host to ping) is checked every ProbeInterval
+	// seconds through the tunnel, ProbeFailures failures in a row reconnect
+	ProbeTarget   string
+	ProbeInterval int
+	ProbeFailures int
+
+	AutoMTU bool
+
+	// Networks are more networks of the clients, v4 or v6, the server
+	// sends the packets to them to the clients like LocalAddr and
+	// LocalAddr6
+	Networks []string
+
+	MaxConcurrentAuth int
+
+	TopTalkers int
+
+	Paranoid bool
+
+	AdminAddr string
+	// PauseRoutes makes a paused client remove its default routes, the
+	// traffic goes direct until it resumes
+	PauseRoutes bool
+
+	PadBuckets []int
+
+	Pool        string
+	ReservedIPs []string
+	// seconds the pool keeps the address of a disconnected user, so it
+	// gets it back on a quick reconnect, 0 to release it at once
+	LeaseGrace int
+
+	AllowedPorts []int
+
+	MaxReconnectDuration int
+
+	// the client waits ReconnectDelay seconds before the first retry and
+	// twice as long after each failure up to ReconnectMaxDelay, with
+	// RECONNECT_JITTER. It gives up after MaxReconnectTries, 0 for never
+	ReconnectDelay    int
+	ReconnectMaxDelay int
+	MaxReconnectTries int
+
+	// DSCP marks the packets of the tunnel transport for the local QoS
+	DSCP int
+
+	// QuotaFile keeps the usage of the User.Quota across restarts, they are
+	// reset monthly, weekly or daily (QuotaReset)
+	QuotaFile  string
+	QuotaReset string
+
+	// MaxSessionLifetime closes the sessions older than this many seconds,
+	// active or not, so their clients authenticate again
+	MaxSessionLifetime int
+
+	// MaxClockSkew is how many seconds the clocks of a client and the
+	// server may differ before it is logged, DEFAULT_MAX_CLOCK_SKEW if 0
+	MaxClockSkew int
+
+	// Disguise is an html file or an url answering whatever is not a
+	// tunnel on the server
+	Disguise string
+
+	// MOTD is a message of the day the server sends the clients, they log
+	// it when they connect
+	MOTD string
+
+	// MTUDiagnostic warns when the TCP segments into the tunnel look like
+	// they go through an MTU black hole
+	MTUDiagnostic bool
+
+	// BatchWindow holds the small packets to a connection this many
+	// microseconds to send them in one frame, 0 sends every packet at once
+	BatchWindow int
+
+	// Compress deflates the packets to a peer that agreed to it when
+	// connecting, both sides must have it
+	Compress bool
+
+	// CompressEncrypted compresses the packets that look already encrypted
+	// too (see network.LooksEncrypted), they are sent as they are by default
+	CompressEncrypted bool
+
+	// Transport is a profile setting the knobs below for a kind of
+	// network, TRANSPORT_CDN, TRANSPORT_UDP, TRANSPORT_MEMORY or empty.
+	// Path is the url path of the tunnel, KeepAlive pings an idle session every this many seconds and
+	// ClientIPHeader is the header a proxy in front of the server passes
+	// the address of the client in
+	Transport      string
+	Path           string
+	KeepAlive      int
+	ClientIPHeader string
+
+	// DeadTimeout closes a session silent for this many seconds, pongs
+	// included, so the server frees its address. 3 KeepAlive when 0
+	DeadTimeout int
+
+	// ProtocolMagic opens every connection with the protocol version, the
+	// server drops the ones without it before any crypto. Both sides must
+	// agree on it, connection.DEFAULT_MAGIC when empty
+	ProtocolMagic string
+
+	// AllowedSources are the CIDRs the server takes connections from, the
+	// others are closed at accept before anything else. Behind a proxy
+	// or a CDN these are its addresses
+	AllowedSources []string
+
+	TLS       bool
+	TLSCert   string
+	TLSKey    string
+	ACME      bool
+	ACMEDir   string
+	ACMEEmail string
+
+	MaxQueueBytes        int
+	MaxSessionQueueBytes int
+	QueuePolicy          string
+
+	UpScript   string
+	DownScript string
+
+	TunReaders int
+
+	DNS string
+
+	// DNSOnly sends only the DNS queries through the tunnel, to DNS
+	DNSOnly bool
+
+	ReportPublicIP string
+	NotFoundPolicy string
+
+	StatsAddr    string
+	StatsTLSCert string
+	StatsTLSKey  string
+	StatsToken   string
+
+	// AuthWebhook is asked for the users missing from Users, see
+	// webhookAuth, with AuthWebhookToken as bearer token when set
+	AuthWebhook      string
+	AuthWebhookToken string
+
+	// OTLPEndpoint receives the counters of /counters every OTLPInterval
+	// seconds, OTLP over http with json (e.g.
+	// http://collector:4318/v1/metrics), with OTLPHeaders for the auth
+	OTLPEndpoint string
+	OTLPHeaders  map[string]string
+	OTLPInterval int
+
+	Cgroup string
+
+	// RunAsUser is the user the tunnel runs as once the device and the
+	// routes are set up
+	RunAsUser string
+
+	// Device replaces the tun device, e.g. with a tun.MemoryDevice, the
+	// system routes are then left alone
+	Device tun.Device
+
+	// Events receives the events of a client as JSON lines, see Event
+	Events io.Writer
+
+	// Authenticator finds the users of the server, the table of Users by
+	// default or the AuthWebhook when set
+	Authenticator Authenticator
+
+	// ReloadUsers reads Users again, the server calls it on SIGHUP
+	ReloadUsers func() ([]User, error)
+
+	// Clock drives the timeouts and backoffs, utils.RealClock by default
+	Clock utils.Clock
+
+	// KeyLog is a file the session keys are appended to, for debugging
+	// only: with it a capture of the tunnel can be decrypted
+	KeyLog string
 }
 
 type User struct {
-	Name string
-	Pass string
-	IP   string
+	Name   string
+	Pass   string
+	IP     string
+	IP6    string
+	Routes []string
+
+	// Salt of the key derived from Pass, the client and the server must
+	// have the same, see USER_SALT_MIN
+	Salt string
+
+	// Group is the name of the Group of the user, empty for the main device
+	Group string
+
+	// NAT64 translates the traffic of the user to network.NAT64_PREFIX
+	// into IPv4 from its IP
+	NAT64 bool
+
+	// Quota is how many bytes the user may send and receive per
+	// Config.QuotaReset period, 0 for no limit
+	Quota int64
+
+	// MTU is sent to the client for its device, 0 leaves it to the client
+	MTU int
+
+	// Rate limits the traffic of the user each way, like "10mbit" (see
+	// parseRate), empty for no limit
+	Rate string
+
+	// Subnets are the networks behind the client (site to site), the
+	// server sends the packets to them through its session and takes the
+	// packets of the session from them
+	Subnets []string
+
+	// AllowedPorts overrides Config.AllowedPorts for this user
+	AllowedPorts []int
+
+	// OldPass is still accepted until OldPassUntil after a rekey
+	OldPass      string
+	OldPassUntil time.Time
 }
 
 type VPN struct {
@@ -42,56 +275,426 @@ type VPN struct {
 
 	dev       tun.Device
 	arpTable  *network.ARP
+	channel   *connection.TUN
 	userTable map[string]User
-	blackList map[string]bool
+	usersMu   sync.RWMutex
+	liveUsers map[string]liveUser
+	liveMu    sync.Mutex
+	blocked   atomic.Value
 	myNetwork *net.IPNet
+	// the networks of the clients and the addresses of the server in them
+	myNetworks []*net.IPNet
+	myIPs      []net.IP
+
+	listsMu       sync.Mutex
+	whiteFromFile []string
+	blackFromFile []string
 
 	writeDevToTun        func(header network.PacketHeader, data []byte) error
 	getCurrentConnClient func(ip string) network.ARPRecord
-	inMyNetwork          func(ip net.IP) bool
+	inMyNetwork          func(header network.PacketHeader) bool
+
+	gatewayLinux   network.LinuxRouter
+	gatewayWindows network.WindowsRouter
+	gateway6Win    network.WindowsRouter
+	gatewayDarwin  network.DarwinRouter
+	devName        string // TUN_NAME, or the utunN given by darwin
+	networkChanged int32
+	scriptUp       bool
+	dnsForwarder   *network.DNSForwarder
+	// restoreDNS undoes dnsChange, what setupDNS did to the resolver
+	restoreDNS     func() error
+	dnsChange      string
+	changes        changelog // what this VPN did to the system
+	pending        *pendingPackets
+	cgroupUp       bool
+	dnsOnlyUp      bool
+	routesUp       bool
+	pushedRoutes   []string
+	authSem        chan struct{}
+	traffic        *trafficStats
+	dropped        dropCounters
+	broadcast      net.IP
+	allowedPorts   map[uint16]bool
+	userPorts      map[string]map[uint16]bool
+	pool           *network.IPPool
+	portDropped    int64
+	meshPackets    int64
+	meshBytes      int64
+	gatewayPackets int64
+	gatewayBytes   int64
+	probeOK        int64
+	probeFailed    int64
+	rxPackets      int64
+	rxBytes        int64
+	txPackets      int64
+	txBytes        int64
+	decryptErrors  int64
+	reconnects     int64
+	mtuWatch       *mtuWatch
+	subnets        *subnetRoutes
+	cancel         context.CancelFunc
+	// serverAddr is the address of the server as resolved last, a string
+	serverAddr atomic.Value
+	// listeners are the http servers, shut down with the context
+	listeners      sync.WaitGroup
+	devWriteErrors int64
+	devRetries     int64
+	devFailures    int64
+	devFailed      sync.Once
+	unprivileged   bool
+	events         *eventStream
+	nat64          map[string]net.IP
+	nat64Back      map[string]net.IP
+	quotas         *quotas
+	rates          *rateLimits
+	userStats      *userStats
+	groups         []*devGroup
+	sessions       map[*crypto.Session]*clientSession
+	sessionsMu     sync.RWMutex
+	spoofDropped   int64
+	keyLog         *keyLog
+	paused         int32
+	pauseMu        sync.Mutex
+	pausedRoutes   bool
+	compressOK     int32 // the server agreed to compress
 }
 
 const (
 	TUN_NAME = "MyNIC"
+	// darwin names its devices utunN, this takes the first free one
+	TUN_NAME_DARWIN = "utun"
+
+	// the default ReconnectDelay and ReconnectMaxDelay
+	RECONNECT_DELAY     = time.Second
+	RECONNECT_MAX_DELAY = time.Minute
+	// RECONNECT_JITTER spreads the retries of the clients of a server that
+	// went down together, a delay is this fraction shorter or longer
+	RECONNECT_JITTER = 0.2
+
+	VERSION = "1.1.0 - (29/11/2022)"
+
+	// outer IP and TCP headers with options, websocket frame and the AES-GCM
+	// nonce and tag
+	TUNNEL_OVERHEAD = 92
+
+	// MOTD_MAX_LEN bounds the message of the day
+	MOTD_MAX_LEN = 512
+
+	// MAX_MTU is the largest packet an IP header can tell, the websocket
+	// frames and the padding carry up to it, jumbo frames (9000) included
+	MAX_MTU = 65535
+
+	// the smallest MTU a user can be given, 1280 with IPv6
+	MIN_USER_MTU  = 576
+	MIN_USER_MTU6 = 1280
 
-	TIME_TO_TRY = 5 * time.Second
-	MAX_TRY     = 10
-	VERSION     = "1.1.0 - (29/11/2022)"
+	NOT_FOUND_DROP  = "drop"
+	NOT_FOUND_ICMP  = "icmp"
+	NOT_FOUND_QUEUE = "queue"
+
+	// how long an authentication waits for a free slot before it is rejected
+	AUTH_QUEUE_TIMEOUT = 2 * time.Second
 )
 
 var (
 	YOUR_OS = runtime.GOOS
 )
 
-func Create(conf Config) (vpn *VPN, err error) {
+// Create runs the tunnel until SIGINT or SIGTERM.
+func Create(conf Config) (*VPN, error) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	return CreateWithContext(ctx, conf)
+}
+
+// CreateWithContext runs the tunnel until ctx is cancelled, the routes and
+// the device are cleaned up before it returns.
+func CreateWithContext(ctx context.Context, conf Config) (vpn *VPN, err error) {
 	vpn = new(VPN)
 	vpn.conf = conf
-	vpn.blackList = make(map[string]bool, 0)
-	_, vpn.myNetwork, err = net.ParseCIDR(vpn.conf.LocalAddr)
-	if err != nil {
-		return
+	// runs after the cancel below: the next call may listen on the same
+	// addresses
+	defer vpn.listeners.Wait()
+	ctx, vpn.cancel = context.WithCancel(ctx)
+	defer vpn.cancel()
+
+	if conf.Events != nil && !conf.IsServer {
+		vpn.events = newEventStream(conf.Events)
+	}
+	// errors of the reconnect loop are emitted as they happen
+	events := vpn.events
+	reconnecting := false
+	defer func() {
+		if err != nil && !reconnecting {
+			events.emitError(err)
+		}
+	}()
+
+	if vpn.conf.Clock == nil {
+		vpn.conf.Clock = utils.RealClock
+	}
+	if vpn.conf.IsServer {
+		vpn.pending = newPendingPackets(vpn.conf.Clock, PENDING_TIMEOUT)
+	} else {
+		vpn.pending = newPendingPackets(vpn.conf.Clock, PENDING_RECONNECT_TIMEOUT)
+	}
+	// a client without an address gets one from the server pool
+	if vpn.conf.IsServer || len(vpn.conf.LocalAddr) > 0 {
+		_, vpn.myNetwork, err = net.ParseCIDR(vpn.conf.LocalAddr)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(vpn.conf.PadBuckets) > 0 {
+		sort.Ints(vpn.conf.PadBuckets)
+		if vpn.conf.PadBuckets[0] <= crypto.PAD_HEADER || vpn.conf.PadBuckets[len(vpn.conf.PadBuckets)-1] > 0xFFFF {
+			return nil, fmt.Errorf("pad buckets must be between %d and %d bytes", crypto.PAD_HEADER+1, 0xFFFF)
+		}
+	}
+
+	if vpn.conf.Paranoid {
+		vpn.dropped = newDropCounters()
+		vpn.broadcast = broadcastOf(vpn.myNetwork)
+	}
+
+	if len(vpn.conf.LocalAddr6) > 0 {
+		ip6, _, err := net.ParseCIDR(vpn.conf.LocalAddr6)
+		if err != nil {
+			return nil, err
+		}
+		if ip6.To4() != nil {
+			return nil, fmt.Errorf("%s is not an ipv6 address", vpn.conf.LocalAddr6)
+		}
 	}
 
 	connectType := connection.CONNECTION_TYPE_WEBSOCKET
 
-	log.Debug("Create Virtual Network Adapter")
-	vpn.dev, err = tun.CreateTUN(TUN_NAME, vpn.conf.MTU)
+	err = vpn.applyTransport()
 	if err != nil {
-		return
+		return nil, err
+	}
+	if vpn.conf.Transport == TRANSPORT_UDP {
+		connectType = connection.CONNECTION_TYPE_UDP
+	}
+	if vpn.conf.Transport == TRANSPORT_MEMORY {
+		connectType = connection.CONNECTION_TYPE_MEMORY
+	}
+
+	if vpn.conf.AutoMTU && !vpn.conf.IsServer {
+		iface, err := network.EgressInterface(vpn.conf.ServerAddr)
+		if err != nil {
+			log.Error("detect MTU error:", err, ", use", vpn.conf.MTU)
+		} else {
+			vpn.conf.MTU = iface.MTU - TUNNEL_OVERHEAD
+			if vpn.conf.MTU > MAX_MTU {
+				vpn.conf.MTU = MAX_MTU
+			}
+			log.Info("MTU of", iface.Name, "is", iface.MTU, ", use", vpn.conf.MTU)
+		}
+	}
+	if vpn.conf.MTU < MIN_USER_MTU || vpn.conf.MTU > MAX_MTU {
+		return nil, fmt.Errorf("MTU must be between %d and %d", MIN_USER_MTU, MAX_MTU)
+	}
+
+	log.Debug("Create Virtual Network Adapter")
+	if vpn.conf.Device != nil {
+		vpn.dev = vpn.conf.Device
+	} else {
+		name := TUN_NAME
+		if YOUR_OS == "darwin" {
+			name = TUN_NAME_DARWIN
+		}
+		vpn.dev, err = tun.CreateTUN(name, vpn.conf.MTU)
+		if err != nil {
+			return
+		}
+	}
+	vpn.devName = TUN_NAME
+	if name, err := vpn.dev.Name(); err == nil && len(name) > 0 {
+		vpn.devName = name
+	}
+	if vpn.conf.Device == nil {
+		vpn.changes.record(deviceChange(vpn.devName), "", nil)
 	}
 	defer vpn.stop()
 
 	virtualChannel := connection.TUN{
-		Addr:              vpn.conf.ServerAddr,
-		HostHeader:        vpn.conf.HostHeader,
-		FuncWriteTunToDev: vpn.writeTunToDev,
-		FuncAuthenConn:    vpn.authenConn,
+		Addr:                 vpn.conf.ServerAddr,
+		HostHeader:           vpn.conf.HostHeader,
+		MaxQueueBytes:        vpn.conf.MaxQueueBytes,
+		MaxSessionQueueBytes: vpn.conf.MaxSessionQueueBytes,
+		FuncWriteTunToDev:    vpn.writeTunToDev,
+		FuncAuthenConn:       vpn.authenConn,
+		FuncHandshake:        vpn.handshake,
+		TLS:                  vpn.conf.TLS,
+		DSCP:                 vpn.conf.DSCP,
+		Path:                 vpn.conf.Path,
+		KeepAlive:            time.Duration(vpn.conf.KeepAlive) * time.Second,
+		DeadTimeout:          time.Duration(vpn.conf.DeadTimeout) * time.Second,
+		ClientIPHeader:       vpn.conf.ClientIPHeader,
+		Magic:                vpn.conf.ProtocolMagic,
+		Clock:                vpn.conf.Clock,
+	}
+	if vpn.conf.IsServer {
+		virtualChannel.AllowedSources, err = vpn.allowedSources()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if vpn.conf.IsServer && len(vpn.conf.Disguise) > 0 {
+		virtualChannel.Disguise, err = connection.DisguiseHandler(vpn.conf.Disguise)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if vpn.conf.IsServer && (len(vpn.conf.TLSCert) > 0 || vpn.conf.ACME) {
+		var challenge http.Handler
+		virtualChannel.TLSConfig, challenge, err = utils.ServerTLSConfig(vpn.conf.TLSCert, vpn.conf.TLSKey, vpn.conf.HostHeader, vpn.conf.ACMEDir, vpn.conf.ACMEEmail)
+		if err != nil {
+			return nil, err
+		}
+		if challenge != nil {
+			vpn.listen(func() { utils.ServeACMEChallenge(ctx, challenge) })
+		}
+	}
+	vpn.channel = &virtualChannel
+	switch vpn.conf.QueuePolicy {
+	case "", "drop":
+		virtualChannel.QueuePolicy = connection.QUEUE_POLICY_DROP
+	case "disconnect":
+		virtualChannel.QueuePolicy = connection.QUEUE_POLICY_DISCONNECT
+	default:
+		return nil, fmt.Errorf("unknown queue policy: %s", vpn.conf.QueuePolicy)
+	}
+
+	if len(vpn.conf.MOTD) > MOTD_MAX_LEN {
+		return nil, fmt.Errorf("MOTD is longer than %d bytes", MOTD_MAX_LEN)
+	}
+
+	if vpn.conf.DSCP < 0 || vpn.conf.DSCP > 63 {
+		return nil, fmt.Errorf("DSCP must be between 0 and 63")
+	}
+
+	if len(vpn.conf.KeyLog) > 0 {
+		vpn.keyLog, err = openKeyLog(vpn.conf.KeyLog)
+		if err != nil {
+			return nil, err
+		}
+		defer vpn.keyLog.close()
+	}
+
+	if vpn.conf.DNSOnly && !vpn.conf.IsServer {
+		if len(vpn.conf.DNS) < 1 {
+			return nil, fmt.Errorf("DNSOnly needs DNS, the resolver queried through the tunnel")
+		}
+		if len(vpn.conf.Cgroup) > 0 {
+			return nil, fmt.Errorf("DNSOnly cannot be used with Cgroup")
+		}
+	}
+
+	if len(vpn.conf.RunAsUser) > 0 && (len(vpn.conf.DNS) > 0 || len(vpn.conf.Cgroup) > 0) {
+		return nil, fmt.Errorf("RunAsUser cannot be used with DNS or Cgroup, they need root until the end")
+	}
+
+	switch vpn.conf.NotFoundPolicy {
+	case "":
+		vpn.conf.NotFoundPolicy = NOT_FOUND_DROP
+	case NOT_FOUND_DROP, NOT_FOUND_ICMP, NOT_FOUND_QUEUE:
+	default:
+		return nil, fmt.Errorf("unknown not found policy: %s", vpn.conf.NotFoundPolicy)
+	}
+	if vpn.conf.IsServer && vpn.conf.MaxConcurrentAuth > 0 {
+		vpn.authSem = make(chan struct{}, vpn.conf.MaxConcurrentAuth)
 	}
+
 	log.Debug("Make ARP Table")
 	vpn.arpTable = network.NewARP()
 
 	log.Debug("Setup Authentication")
-	vpn.setupAuthentication()
+	err = vpn.setupAuthentication()
+	if err != nil {
+		return nil, err
+	}
+
+	if vpn.conf.IsServer && len(vpn.conf.Groups) > 0 {
+		err = vpn.setupGroups()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if vpn.conf.IsServer {
+		err = vpn.setupNetworks()
+		if err != nil {
+			return nil, err
+		}
+		err = vpn.setupSubnets()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if vpn.conf.IsServer {
+		vpn.setupAllowedPorts()
+	}
+
+	if vpn.conf.IsServer {
+		err = vpn.setupNAT64()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if vpn.conf.IsServer {
+		err = vpn.setupQuotas()
+		if err != nil {
+			return nil, err
+		}
+		if vpn.quotas != nil {
+			go vpn.saveQuotas(ctx.Done())
+		}
+		err = vpn.setupRates()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if vpn.conf.IsServer && len(vpn.conf.Pool) > 0 {
+		err = vpn.setupPool()
+		if err != nil {
+			return nil, err
+		}
+		if vpn.conf.LeaseGrace > 0 {
+			go vpn.reapLeases(ctx.Done())
+		}
+	}
+
+	if vpn.conf.IsServer {
+		sessions := make(map[string]bool, 0)
+		for _, u := range vpn.userTable {
+			if len(u.IP) < 1 {
+				continue
+			}
+			sessions[u.IP] = true
+			if len(u.IP6) > 0 {
+				sessions[u.IP6] = true
+			}
+		}
+		vpn.traffic = newTrafficStats(vpn.conf.TopTalkers, sessions)
+		if len(vpn.conf.StatsAddr) > 0 {
+			vpn.userStats = newUserStats()
+		}
+	}
+
+	log.Debug("Self-test Encryption")
+	for name, u := range vpn.userTable {
+		err = crypto.SelfTest([]byte(u.Pass))
+		if err != nil {
+			return nil, fmt.Errorf("encryption self-test of user %s failed: %v", name, err)
+		}
+	}
 
 	var tokenUser = ""
 	if !vpn.conf.IsServer {
@@ -100,240 +703,1255 @@ func Create(conf Config) (vpn *VPN, err error) {
 			if err != nil {
 				return nil, err
 			}
-			tokenUser = k + ":" + base64.StdEncoding.EncodeToString(tokenByte)
+			tokenUser = vpn.compressToken(k + ":" + base64.StdEncoding.EncodeToString(tokenByte))
 			break
 		}
 		log.Debug("Your token:", tokenUser)
+		if len(vpn.conf.ReportPublicIP) > 0 {
+			virtualChannel.PublicIP, err = utils.PublicIP(vpn.conf.ReportPublicIP)
+			if err != nil {
+				log.Error("detect public ip error:", err)
+			}
+		}
 		vpn.getCurrentConnClient = vpn.arpTable.QueryOne
-		vpn.inMyNetwork = func(ip net.IP) bool {
+		vpn.inMyNetwork = func(header network.PacketHeader) bool {
 			return false
 		}
 	} else {
-		vpn.inMyNetwork = func(ip net.IP) bool {
-			return vpn.myNetwork.Contains(ip)
-		}
+		vpn.inMyNetwork = vpn.inMyNetworks
 		vpn.getCurrentConnClient = vpn.arpTable.Query
+		if vpn.subnets != nil {
+			vpn.getCurrentConnClient = func(ip string) network.ARPRecord {
+				r := vpn.arpTable.Query(ip)
+				if r.Conn == nil {
+					if owner, found := vpn.subnets.lookup(ip); found {
+						r = vpn.arpTable.Query(owner)
+					}
+				}
+				return r
+			}
+		}
 	}
 
+	vpn.events.emit(Event{Event: EVENT_CONNECTING, Server: virtualChannel.Addr})
 	err = virtualChannel.Connect(tokenUser, connectType)
 	if err != nil {
 		return
 	}
 
-	log.Debug("Route Network")
-	err = vpn.setupRoute()
-	if err != nil {
-		return
+	if !vpn.conf.IsServer {
+		vpn.checkClockSkew("the server", virtualChannel.ServerTime)
+		hs := vpn.readHandshake(virtualChannel.Handshake)
+		vpn.pushedRoutes = hs.Routes
+		if vpn.myNetwork == nil {
+			if len(hs.Address) < 1 {
+				return nil, fmt.Errorf("no Address configured and the server assigned none")
+			}
+			vpn.conf.LocalAddr = hs.Address
+			_, vpn.myNetwork, _ = net.ParseCIDR(hs.Address)
+			vpn.broadcast = broadcastOf(vpn.myNetwork)
+			log.Info("Address", hs.Address, "assigned by the server")
+		}
+		vpn.adoptMTU(hs.MTU)
+		vpn.adoptCompression(hs)
+		vpn.events.emit(Event{Event: EVENT_CONNECTED, Server: virtualChannel.Addr, Address: vpn.conf.LocalAddr})
 	}
 
-	vpn.OnFuncWriteDevToTun(virtualChannel.FuncWriteDevToTun)
+	if !vpn.conf.IsServer {
+		err = vpn.loadListFiles()
+		if err != nil {
+			return
+		}
+	}
 
-	go vpn.handler()
-	vpn.handlerCtrC()
+	if vpn.conf.Device == nil {
+		log.Debug("Route Network")
+		err = vpn.setupRoute()
+		if err != nil {
+			return
+		}
+	}
+	if vpn.subnets != nil {
+		vpn.addSubnetRoutes()
+	}
+	if vpn.conf.IsServer && vpn.conf.Device == nil {
+		vpn.addNetworkRoutes()
+	}
 
-	log.Info("VPN started successfully!")
-	log.Info("Version:", VERSION)
+	if len(vpn.conf.UpScript) > 0 {
+		vpn.runScript(vpn.conf.UpScript)
+		vpn.scriptUp = true
+	}
 
-	for {
-		if virtualChannel.TryNumber > MAX_TRY {
-			log.Error("Failed to connect to server")
-			break
-		}
-		err = virtualChannel.Run()
-		log.Info(fmt.Sprintf("Try again(%d) in ", virtualChannel.TryNumber), TIME_TO_TRY, "...")
-		time.Sleep(TIME_TO_TRY)
-		err = virtualChannel.Connect(tokenUser, connectType)
+	if len(vpn.conf.RunAsUser) > 0 {
+		err = dropPrivileges(vpn.conf.RunAsUser)
 		if err != nil {
-			log.Error("connect vpn", err)
+			return nil, fmt.Errorf("drop privileges error: %v", err)
 		}
+		vpn.unprivileged = true
+		log.Info("Running as", vpn.conf.RunAsUser)
 	}
 
-	return
-}
+	if len(vpn.conf.WhitelistFile) > 0 || len(vpn.conf.BlacklistFile) > 0 {
+		go vpn.watchListFiles(ctx.Done())
+	}
+	if vpn.conf.IsServer && vpn.conf.ReloadUsers != nil {
+		go vpn.watchUsers(ctx.Done())
+	}
+
+	vpn.OnFuncWriteDevToTun(virtualChannel.FuncWriteDevToTun)
+
+	readers := vpn.conf.TunReaders
+	if readers < 1 {
+		readers = 1
+	} else if readers > 1 && YOUR_OS != "linux" {
+		log.Info("Multiple tun readers are only supported on linux, use 1")
+		readers = 1
+	}
+
+	if vpn.conf.MTUDiagnostic {
+		vpn.mtuWatch = newMTUWatch(vpn.conf.MTU)
+		go vpn.watchMTU(ctx.Done())
+	}
+
+	// With several readers packets of the same flow can be forwarded out of
+	// order, TCP copes with it but it is not free.
+	for i := 0; i < readers; i++ {
+		go vpn.handler(vpn.dev)
+		for _, g := range vpn.groups {
+			go vpn.handler(g.dev)
+		}
+	}
 
-func (vpn *VPN) handlerCtrC() {
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-c
-		vpn.stop()
-		os.Exit(1)
+		<-ctx.Done()
+		virtualChannel.Shutdown()
 	}()
-}
 
-func (vpn *VPN) OnFuncWriteDevToTun(tunWrite func(c interface{}, data []byte) error) {
-	vpn.writeDevToTun = func(header network.PacketHeader, data []byte) error {
-		log.Debug("IPv6:", header.IsIPv6, "Src:", header.IPSrc.String(), "Dst:", header.IPDst.String(), string(data))
+	if !vpn.conf.IsServer {
+		err = network.WatchNetwork(ctx, vpn.devName, func() {
+			log.Info("Network changed, reconnecting ...")
+			atomic.StoreInt32(&vpn.networkChanged, 1)
+			virtualChannel.Disconnect()
+		})
+		if err != nil {
+			log.Error("watch network error:", err)
+		}
 
-		r := vpn.getCurrentConnClient(header.IPDst.String())
-		if r.Conn == nil {
-			log.Debug("connection not found", header.IPDst)
-			return nil
+		if len(vpn.conf.ServerHost) > 0 && vpn.conf.ResolveInterval > 0 {
+			vpn.serverAddr.Store(virtualChannel.Addr)
+			go vpn.watchServerAddr(ctx, &virtualChannel, time.Duration(vpn.conf.ResolveInterval)*time.Second)
 		}
 
-		dataEn, err := crypto.AESEncrypt(r.Key, data)
-		if err != nil {
-			log.Debug("encrypt data error", err)
-			return nil
+		if len(vpn.conf.ProbeTarget) > 0 && vpn.conf.ProbeInterval > 0 {
+			go vpn.probe(ctx, &virtualChannel)
 		}
+	}
+
+	if len(vpn.conf.StatsAddr) > 0 {
+		vpn.listen(func() { vpn.serveStats(ctx) })
+	}
+
+	if len(vpn.conf.OTLPEndpoint) > 0 {
+		go vpn.pushOTLP(ctx)
+	}
+
+	if vpn.events != nil {
+		go vpn.events.reportStats(ctx)
+	}
+
+	if len(vpn.conf.AdminAddr) > 0 {
+		vpn.listen(func() { vpn.serveAdmin(ctx) })
+	}
+
+	if !vpn.conf.IsServer {
+		go vpn.watchPauseSignal(ctx.Done())
+	}
+
+	if vpn.conf.IsServer || len(vpn.conf.DefaultGateway) < 1 {
+		log.Info("VPN started successfully!")
+	} else {
+		go vpn.checkDataPath()
+	}
+	log.Info("Version:", VERSION)
+
+	// with MaxReconnectDuration the client retries for that long since the
+	// last working connection instead of MaxReconnectTries times
+	budget := time.Duration(vpn.conf.MaxReconnectDuration) * time.Second
+	var failingSince time.Time
+	jitter := rand.New(rand.NewSource(time.Now().UnixNano()))
+	reconnecting = true
+	for {
+		if ctx.Err() != nil {
+			return vpn, nil
+		}
+		giveUp := vpn.conf.MaxReconnectTries > 0 && virtualChannel.TryNumber > vpn.conf.MaxReconnectTries
+		if budget > 0 {
+			giveUp = !failingSince.IsZero() && vpn.conf.Clock.Now().Sub(failingSince) > budget
+		}
+		if giveUp {
+			log.Error("Failed to connect to server")
+			vpn.events.emit(Event{Event: EVENT_ERROR, Server: virtualChannel.Addr, Error: "failed to connect to server"})
+			break
+		}
+		err = virtualChannel.Run()
+		if !connection.Retryable(err) {
+			log.Error("The server refused the session, not reconnecting:", err)
+			vpn.events.emit(Event{Event: EVENT_DISCONNECTED, Server: virtualChannel.Addr, Error: err.Error()})
+			break
+		}
+		if virtualChannel.TryNumber == 0 || failingSince.IsZero() {
+			failingSince = vpn.conf.Clock.Now()
+			vpn.logReconnectPolicy()
+		}
+		vpn.deletePushedRoutes()
+		disconnected := Event{Event: EVENT_DISCONNECTED, Server: virtualChannel.Addr}
+		if err != nil {
+			disconnected.Error = err.Error()
+		}
+		vpn.events.emit(disconnected)
+		if ctx.Err() != nil {
+			return vpn, nil
+		}
+		vpn.events.emit(Event{Event: EVENT_RECONNECTING, Server: virtualChannel.Addr, Try: virtualChannel.TryNumber})
+		atomic.AddInt64(&vpn.reconnects, 1)
+		if atomic.SwapInt32(&vpn.networkChanged, 0) == 0 {
+			delay := vpn.reconnectDelay(virtualChannel.TryNumber, jitter)
+			log.Info(fmt.Sprintf("Try again(%d) in ", virtualChannel.TryNumber), delay.Round(time.Millisecond), "...")
+			select {
+			case <-vpn.conf.Clock.After(delay):
+			case <-ctx.Done():
+				return vpn, nil
+			}
+		}
+		vpn.resolveServer(&virtualChannel)
+		vpn.events.emit(Event{Event: EVENT_CONNECTING, Server: virtualChannel.Addr, Try: virtualChannel.TryNumber + 1})
+		err = virtualChannel.Connect(tokenUser, connectType)
+		if err != nil {
+			log.Error("connect vpn", err)
+			vpn.events.emit(Event{Event: EVENT_ERROR, Server: virtualChannel.Addr, Error: err.Error()})
+			continue
+		}
+		vpn.events.emit(Event{Event: EVENT_CONNECTED, Server: virtualChannel.Addr, Address: vpn.conf.LocalAddr})
+		vpn.checkClockSkew("the server", virtualChannel.ServerTime)
+		hs := vpn.readHandshake(virtualChannel.Handshake)
+		if len(hs.Address) > 0 && hs.Address != vpn.conf.LocalAddr {
+			log.Error("Server assigned", hs.Address, "instead of", vpn.conf.LocalAddr, ", restart to use it")
+		}
+		if hs.MTU > 0 && hs.MTU != vpn.conf.MTU {
+			log.Error("Server assigned MTU", hs.MTU, "instead of", vpn.conf.MTU, ", restart to use it")
+		}
+		vpn.addPushedRoutes(hs.Routes)
+		vpn.adoptCompression(hs)
+	}
+
+	return
+}
+
+// listen runs serve, which returns once the context of CreateWithContext
+// is done, and has CreateWithContext wait for it.
+func (vpn *VPN) listen(serve func()) {
+	vpn.listeners.Add(1)
+	go func() {
+		defer vpn.listeners.Done()
+		serve()
+	}()
+}
+
+// reconnectDelay is the wait before the next try after tries failed ones
+// in a row, 0 when the connection worked. TryNumber is reset by the first
+// packet sent, so the delay starts over after a working reconnection.
+func (vpn *VPN) reconnectDelay(tries int, jitter *rand.Rand) time.Duration {
+	delay := time.Duration(vpn.conf.ReconnectDelay) * time.Second
+	if delay <= 0 {
+		delay = RECONNECT_DELAY
+	}
+	max := time.Duration(vpn.conf.ReconnectMaxDelay) * time.Second
+	if max <= 0 {
+		max = RECONNECT_MAX_DELAY
+	}
+	if max < delay {
+		max = delay
+	}
+
+	for i := 0; i < tries && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return time.Duration(float64(delay) * (1 - RECONNECT_JITTER + 2*RECONNECT_JITTER*jitter.Float64()))
+}
+
+// adoptMTU uses the MTU the server gives the user for the device, unless
+// AutoMTU found the path to the server needs a smaller one.
+func (vpn *VPN) adoptMTU(mtu int) {
+	if mtu <= 0 || mtu == vpn.conf.MTU {
+		return
+	}
+	if vpn.conf.AutoMTU && mtu > vpn.conf.MTU {
+		log.Info("Server assigned MTU", mtu, ", keep", vpn.conf.MTU, "of the path to it")
+		return
+	}
+	log.Info("MTU", mtu, "assigned by the server")
+	vpn.conf.MTU = mtu
+}
+
+// checkDataPath pings the server through the tunnel so a broken data path
+// shows up at startup instead of as a dead tunnel.
+func (vpn *VPN) checkDataPath() {
+	for try := 0; try < 3; try++ {
+		err := ping(vpn.conf.DefaultGateway)
+		if err == nil {
+			log.Info("VPN started successfully!")
+			return
+		}
+	}
+	log.Error("VPN started but the server", vpn.conf.DefaultGateway, "does not answer through the tunnel")
+}
+
+// resolveServer looks up the server name again before reconnecting in case
+// its address changed, e.g. after moving to another network.
+func (vpn *VPN) resolveServer(virtualChannel *connection.TUN) {
+	if len(vpn.conf.ServerHost) < 1 {
+		return
+	}
+
+	_, addr, err := utils.ValidServer(vpn.conf.ServerHost)
+	if err != nil {
+		log.Error("resolve server error:", err)
+		return
+	}
+
+	if addr != virtualChannel.Addr {
+		log.Info("Server address changed to", addr)
+		vpn.updateServerRoute(virtualChannel.Addr, addr)
+		virtualChannel.Addr = addr
+		vpn.serverAddr.Store(addr)
+	}
+}
+
+// watchServerAddr resolves the server name every interval and drops the
+// connection when its address changed, the reconnect then pins the route
+// to the new address.
+func (vpn *VPN) watchServerAddr(ctx context.Context, virtualChannel *connection.TUN, interval time.Duration) {
+	for {
+		select {
+		case <-vpn.conf.Clock.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		_, addr, err := utils.ValidServer(vpn.conf.ServerHost)
+		if err != nil {
+			log.Debug("resolve server error:", err)
+			continue
+		}
+
+		if addr != vpn.serverAddr.Load().(string) {
+			log.Info("Server", vpn.conf.ServerHost, "moved to", addr, ", reconnecting ...")
+			atomic.StoreInt32(&vpn.networkChanged, 1)
+			virtualChannel.Disconnect()
+		}
+	}
+}
+
+// updateServerRoute moves the host route that keeps the tunnel traffic off
+// the tunnel from the old server address to the new one.
+func (vpn *VPN) updateServerRoute(oldAddr, newAddr string) {
+	vpn.listsMu.Lock()
+	defer vpn.listsMu.Unlock()
+
+	oldRoute := serverRoute(oldAddr)
+	newRoute := serverRoute(newAddr)
+	for idx, ipW := range vpn.conf.Whitelist {
+		if ipW == oldRoute {
+			vpn.conf.Whitelist[idx] = newRoute
+		}
+	}
+
+	// without a gateway setupRoute routed nothing around the tunnel
+	if (YOUR_OS == "linux" && len(vpn.gatewayLinux.Interface) > 0) ||
+		(YOUR_OS == "windows" && len(vpn.gatewayWindows.Gateway) > 0) ||
+		(YOUR_OS == "darwin" && len(vpn.gatewayDarwin.Interface) > 0) {
+		vpn.runRouteCmd(vpn.bypassRouteCmd("delete", oldRoute))
+		vpn.runRouteCmd(vpn.bypassRouteCmd("add", newRoute))
+	}
+}
+
+// serverRoute is the host route of the server address addr, ip:port.
+func serverRoute(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return toCIDR(host)
+}
+
+func (vpn *VPN) OnFuncWriteDevToTun(tunWrite func(c interface{}, data []byte) error) {
+	send := func(r network.ARPRecord, data []byte) error {
+		if r.Compress {
+			data = network.Compress(data)
+		}
+		if len(vpn.conf.PadBuckets) > 0 {
+			data = crypto.Pad(data, vpn.conf.PadBuckets)
+		}
+
+		dataEn, err := r.Key.Encrypt(data)
+		if err != nil {
+			log.Debug("encrypt data error", err)
+			return nil
+		}
+
+		return tunWrite(r.Conn, dataEn)
+	}
+
+	var batches *batcher
+	if vpn.conf.BatchWindow > 0 {
+		batches = newBatcher(time.Duration(vpn.conf.BatchWindow)*time.Microsecond, send)
+	}
+
+	vpn.writeDevToTun = func(header network.PacketHeader, data []byte) error {
+		log.Debug("IPv6:", header.IsIPv6, "Src:", header.IPSrc.String(), "Dst:", header.IPDst.String(), string(data))
+
+		r := vpn.getCurrentConnClient(header.IPDst.String())
+		if r.Conn == nil {
+			vpn.connNotFound(header, data)
+			return nil
+		}
+
+		if vpn.rates != nil || vpn.quotas != nil {
+			// whatever the address, a subnet of the user too
+			if session := vpn.sessionOf(r.Key); session != nil && !vpn.withinLimits(session, len(data), false) {
+				return nil
+			}
+		}
+		if vpn.userStats != nil {
+			vpn.userStats.countTx(r.Conn, len(data))
+		}
+		if r.Compress && !vpn.conf.CompressEncrypted && network.LooksEncrypted(data) {
+			r.Compress = false
+		}
+		if batches != nil {
+			return batches.write(r, data)
+		}
+		return send(r, data)
+	}
+}
+
+// connNotFound handles a packet whose destination has no connection,
+// according to vpn.conf.NotFoundPolicy.
+func (vpn *VPN) connNotFound(header network.PacketHeader, data []byte) {
+	switch vpn.conf.NotFoundPolicy {
+	case NOT_FOUND_ICMP:
+		from := net.ParseIP(vpn.conf.DefaultGateway)
+		if vpn.conf.IsServer || from == nil {
+			from, _, _ = net.ParseCIDR(vpn.conf.LocalAddr)
+		}
+		if header.IsIPv6 {
+			from, _, _ = net.ParseCIDR(vpn.conf.LocalAddr6)
+		}
+
+		reply := network.ICMPUnreachable(data, from)
+		if reply == nil {
+			return
+		}
+		vpn.writeDev(vpn.dev, reply)
+	case NOT_FOUND_QUEUE:
+		if !vpn.pending.push(vpn.pendingKey(header.IPDst.String()), data) {
+			log.Debug("connection not found, queue full", header.IPDst)
+		}
+	default:
+		log.Debug("connection not found", header.IPDst)
+	}
+}
+
+// logReconnectPolicy tells what happens to the packets sent to the tunnel
+// while the client reconnects, nothing tells the apps otherwise.
+func (vpn *VPN) logReconnectPolicy() {
+	switch vpn.conf.NotFoundPolicy {
+	case NOT_FOUND_ICMP:
+		log.Info("Reconnecting, packets to the tunnel are answered with ICMP unreachable")
+	case NOT_FOUND_QUEUE:
+		log.Info("Reconnecting, up to", PENDING_MAX_PACKETS, "packets to the tunnel are queued for", PENDING_RECONNECT_TIMEOUT)
+	default:
+		log.Info("Reconnecting, packets to the tunnel are dropped (NotFoundPolicy = \"drop\")")
+	}
+}
+
+// pendingKey is the destination on the server, the client has only one
+// connection for every destination.
+func (vpn *VPN) pendingKey(ip string) string {
+	if vpn.conf.IsServer {
+		return ip
+	}
+	return ""
+}
+
+func (vpn *VPN) flushPending(ip string) {
+	for _, data := range vpn.pending.take(vpn.pendingKey(ip)) {
+		err := vpn.writeDevToTun(network.ParseHeaderPacket(data), data)
+		if err != nil {
+			log.Debug("write pending packet error", err)
+		}
+	}
+}
+
+func (vpn *VPN) writeTunToDev(key *crypto.Session, data []byte) {
+	rawData, err := key.Decrypt(data)
+	if err != nil {
+		atomic.AddInt64(&vpn.decryptErrors, 1)
+		log.Debug("decrypt data error", err)
+		return
+	}
+
+	rawData, err = crypto.Unpad(rawData)
+	if err != nil {
+		log.Debug("unpad data error", err)
+		return
+	}
+
+	rawData, err = network.Decompress(rawData, vpn.compressMax())
+	if err != nil {
+		log.Debug("decompress data error", err)
+		return
+	}
+
+	// on the server the key tells who sent the packets
+	var session *clientSession
+	if vpn.conf.IsServer {
+		session = vpn.sessionOf(key)
+		if session == nil {
+			return
+		}
+	}
+
+	if !network.IsBatch(rawData) {
+		if vpn.userStats != nil {
+			vpn.userStats.countRx(key, 1, len(rawData), vpn.conf.Clock.Now())
+		}
+		vpn.forward(session, rawData)
+		return
+	}
+	packets, err := network.Unbatch(rawData)
+	if err != nil {
+		log.Debug("unbatch data error", err)
+		return
+	}
+	if vpn.userStats != nil {
+		size := 0
+		for _, packet := range packets {
+			size += len(packet)
+		}
+		vpn.userStats.countRx(key, len(packets), size, vpn.conf.Clock.Now())
+	}
+	for _, packet := range packets {
+		vpn.forward(session, packet)
+	}
+}
+
+// forward sends a packet of the tunnel to its destination, a device or
+// another client. session is the client that sent it, nil on a client.
+func (vpn *VPN) forward(session *clientSession, rawData []byte) {
+	if vpn.isPaused() {
+		return
+	}
+	atomic.AddInt64(&vpn.rxPackets, 1)
+	atomic.AddInt64(&vpn.rxBytes, int64(len(rawData)))
+	if vpn.dropped != nil && vpn.paranoidDrop(rawData) {
+		return
+	}
+
+	header := network.ParseHeaderPacket(rawData)
+	if session != nil && vpn.spoofed(session, header.IPSrc) {
+		return
+	}
+
+	if session != nil && session.ports != nil && !vpn.portAllowed(session, rawData) {
+		return
+	}
+
+	if session != nil && !vpn.withinLimits(session, len(rawData), true) {
+		return
+	}
+	if vpn.traffic != nil {
+		vpn.traffic.countSession(header, rawData)
+	}
+	if vpn.events != nil {
+		vpn.events.countRx(rawData)
+	}
+	if vpn.nat64 != nil {
+		if translated, ok := vpn.nat64To4(header, rawData); ok {
+			if translated == nil {
+				log.Debug("nat64 cannot translate packet to", header.IPDst)
+				return
+			}
+			rawData = translated
+			header = network.ParseHeaderPacket(rawData)
+		}
+	}
+	// the packets of a group always go through its device so the
+	// firewall sees them
+	dev := vpn.dev
+	if session != nil && session.dev != nil {
+		dev = session.dev
+	}
+	if dev == vpn.dev && vpn.inMyNetwork(header) {
+		atomic.AddInt64(&vpn.meshPackets, 1)
+		atomic.AddInt64(&vpn.meshBytes, int64(len(rawData)))
+		err := vpn.writeDevToTun(header, rawData)
+		if err != nil {
+			log.Debug("write dev to tun error", err)
+		}
+		return
+	}
+
+	if vpn.conf.IsServer {
+		atomic.AddInt64(&vpn.gatewayPackets, 1)
+		atomic.AddInt64(&vpn.gatewayBytes, int64(len(rawData)))
+	}
+	vpn.writeDev(dev, rawData)
+}
+
+func (vpn *VPN) handler(dev tun.Device) {
+	buf := make([]byte, vpn.conf.MTU)
+	failures := 0
+	for {
+		n, err := dev.Read(buf, 0)
+		if errors.Is(err, os.ErrClosed) {
+			return
+		}
+		if err != nil {
+			failures++
+			if vpn.devReadFailed(err, failures) {
+				return
+			}
+			continue
+		}
+		failures = 0
+		if vpn.isPaused() {
+			continue
+		}
+		packet := buf[:n]
+		if vpn.dropped != nil && vpn.paranoidDrop(packet) {
+			continue
+		}
+
+		header := network.ParseHeaderPacket(packet)
+		if vpn.traffic != nil {
+			vpn.traffic.count(header, packet)
+		}
+		if vpn.mtuWatch != nil {
+			vpn.mtuWatch.count(header, packet)
+		}
+		if vpn.nat64 != nil {
+			if translated, ok := vpn.nat64To6(header, packet); ok {
+				if translated == nil {
+					continue
+				}
+				packet = translated
+				header = network.ParseHeaderPacket(packet)
+			}
+		}
+		if vpn.isBlocked(header.IPDst) {
+			log.Debug("Block ip", header.IPDst)
+			continue
+		}
+		if vpn.conf.DNSOnly && !vpn.dnsOnlyAllowed(header, packet) {
+			continue
+		}
+
+		err = vpn.writeDevToTun(header, packet)
+		if err != nil {
+			log.Debug("write dev to tun error", err)
+			continue
+		}
+		atomic.AddInt64(&vpn.txPackets, 1)
+		atomic.AddInt64(&vpn.txBytes, int64(len(packet)))
+		if vpn.events != nil {
+			vpn.events.countTx(packet)
+		}
+
+	}
+}
+
+// acquireAuth bounds the authentications decrypting at the same time, so a
+// flood of connections cannot burn all the CPU on AES.
+func (self *VPN) acquireAuth() bool {
+	if self.authSem == nil {
+		return true
+	}
+
+	select {
+	case self.authSem <- struct{}{}:
+		return true
+	case <-self.conf.Clock.After(AUTH_QUEUE_TIMEOUT):
+		log.Info("Too many authentications in flight, reject")
+		return false
+	}
+}
+
+func (self *VPN) releaseAuth() {
+	if self.authSem != nil {
+		<-self.authSem
+	}
+}
+
+// checkToken returns the user of a token and the session key it carries.
+func (self *VPN) checkToken(token string) (string, User, []byte, bool) {
+	arr := strings.Split(token, ":")
+	if len(arr) < 2 {
+		return "", User{}, nil, false
+	}
+	user := arr[0]
+	u, found := self.conf.Authenticator.Lookup(user)
+	if !found {
+		return "", User{}, nil, false
+	}
+	keyBase64 := arr[1]
+
+	tokenByte, err := base64.StdEncoding.DecodeString(keyBase64)
+	if err != nil {
+		return "", User{}, nil, false
+	}
+
+	keyByte, ok := decryptToken(u.Pass, tokenByte)
+	if !ok && len(u.OldPass) > 0 && self.conf.Clock.Now().Before(u.OldPassUntil) {
+		// the client has not got its new password yet
+		keyByte, ok = decryptToken(u.OldPass, tokenByte)
+		u.Pass = u.OldPass
+	}
+	if !ok {
+		return "", User{}, nil, false
+	}
+	return user, u, keyByte, true
+}
+
+func decryptToken(pass string, tokenByte []byte) ([]byte, bool) {
+	keyByte, err := crypto.AESDecrypt([]byte(pass), tokenByte)
+	if err != nil {
+		return nil, false
+	}
+
+	for _, c := range keyByte {
+		if c < 48 || (58 < c && c < 64) || (91 < c && c < 96) || c > 123 {
+			return nil, false
+		}
+	}
+	return keyByte, true
+}
+
+// handshakeData is what the server tells a client before the tunnel is up.
+type handshakeData struct {
+	Address string   `json:"address,omitempty"`
+	Routes  []string `json:"routes,omitempty"`
+	MTU     int      `json:"mtu,omitempty"`
+	MOTD    string   `json:"motd,omitempty"`
+	// Compress is COMPRESS_FLATE when the client asked for it and the
+	// server agrees
+	Compress string `json:"compress,omitempty"`
+}
+
+// handshake gives a client its pool address and the routes of its user,
+// encrypted with its password so only that user can read them. ok is false
+// when the token is refused. A busy server lets the client through,
+// authenConn then refuses it.
+func (self *VPN) handshake(token string) (string, bool) {
+	if !self.acquireAuth() {
+		return "", true
+	}
+	defer self.releaseAuth()
+
+	user, u, _, ok := self.checkToken(token)
+	if !ok {
+		return "", false
+	}
+
+	hs := handshakeData{Routes: u.Routes, MTU: u.MTU, MOTD: self.conf.MOTD}
+	if self.compresses(token) {
+		hs.Compress = COMPRESS_FLATE
+	}
+	if len(u.IP) < 1 && self.pool != nil {
+		ip, err := self.addressOf(user, u)
+		if err != nil {
+			log.Error("lease ip of user", user, "error:", err)
+			return "", true
+		}
+		hs.Address = self.prefixOf(ip)
+	}
+	if len(hs.Address) < 1 && len(hs.Routes) < 1 && hs.MTU == 0 && len(hs.MOTD) < 1 && len(hs.Compress) < 1 {
+		return "", true
+	}
+
+	raw, err := json.Marshal(hs)
+	if err != nil {
+		return "", true
+	}
+	data, err := crypto.AESEncrypt([]byte(u.Pass), raw)
+	if err != nil {
+		log.Debug("encrypt handshake error", err)
+		return "", true
+	}
+	return base64.StdEncoding.EncodeToString(data), true
+}
+
+// readHandshake decodes what the server sent, invalid routes are skipped.
+func (vpn *VPN) readHandshake(handshake string) handshakeData {
+	var hs handshakeData
+	if len(handshake) < 1 {
+		return hs
+	}
+
+	data, err := base64.StdEncoding.DecodeString(handshake)
+	if err != nil {
+		log.Error("decode handshake error:", err)
+		return hs
+	}
+
+	for _, u := range vpn.userTable {
+		raw, err := crypto.AESDecrypt([]byte(u.Pass), data)
+		if err == nil {
+			err = json.Unmarshal(raw, &hs)
+		}
+		if err != nil {
+			log.Error("decrypt handshake error:", err)
+			return handshakeData{}
+		}
+		break
+	}
+
+	var routes []string
+	for _, r := range hs.Routes {
+		_, _, err := net.ParseCIDR(r)
+		if err != nil {
+			log.Error("invalid route pushed by the server:", r)
+			continue
+		}
+		routes = append(routes, r)
+	}
+	hs.Routes = routes
+
+	if len(hs.MOTD) > 0 {
+		log.Info("Message from the server:", printable(hs.MOTD, MOTD_MAX_LEN))
+	}
+	return hs
+}
+
+// printable cuts s to max bytes and replaces what could drive the terminal
+// showing the log.
+func printable(s string, max int) string {
+	if len(s) > max {
+		s = s[:max]
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || unicode.IsPrint(r) {
+			return r
+		}
+		return '?'
+	}, strings.ToValidUTF8(s, "?"))
+}
+
+func (self *VPN) authenConn(token string, conn interface{}) (string, *crypto.Session, func(id string)) {
+	if !self.acquireAuth() {
+		rejectConn(conn, connection.CLOSE_TRY_AGAIN_LATER, "server busy")
+		return "", nil, nil
+	}
+	defer self.releaseAuth()
+
+	user, u, keyByte, ok := self.checkToken(token)
+	if !ok {
+		return "", nil, nil
+	}
+	key, err := crypto.NewSession(keyByte)
+	if err != nil {
+		log.Error("session key of user", user, "error:", err)
+		rejectConn(conn, connection.CLOSE_TRY_AGAIN_LATER, "bad session key")
+		return "", nil, nil
+	}
+
+	pooled := len(u.IP) < 1 && self.pool != nil
+	if pooled {
+		ip, err := self.addressOf(user, u)
+		if err != nil {
+			log.Error("lease ip of user", user, "error:", err)
+			rejectConn(conn, connection.CLOSE_TRY_AGAIN_LATER, "no address left")
+			return "", nil, nil
+		}
+		u.IP = ip
+	}
+
+	if !self.arpTable.Update(u.IP, conn, key) {
+		self.keyLog.write(user, u.IP, key)
+
+		peer, isPeer := conn.(connection.Peer)
+		if isPeer && len(peer.PublicIP()) > 0 {
+			self.arpTable.SetPublicIP(u.IP, publicIPOf(user, peer))
+		}
+		if isPeer && self.conf.IsServer {
+			self.checkClockSkew("user "+user, peer.ClientTime())
+		}
+
+		ended := make(chan struct{})
+		if isPeer && self.conf.IsServer && self.conf.MaxSessionLifetime > 0 {
+			expired := self.conf.Clock.After(time.Duration(self.conf.MaxSessionLifetime) * time.Second)
+			go func() {
+				select {
+				case <-expired:
+					log.Info("Session of user", user, "reached MaxSessionLifetime, close it to force a new authentication")
+					peer.Close(connection.CLOSE_SESSION_EXPIRED, "session lifetime reached")
+				case <-ended:
+				}
+			}()
+		}
+
+		if self.conf.NotFoundPolicy == NOT_FOUND_QUEUE {
+			go self.flushPending(u.IP)
+		}
+
+		ip6 := u.IP6
+		if len(ip6) > 0 && self.arpTable.Update(ip6, conn, key) {
+			ip6 = ""
+		}
+		if self.compresses(token) {
+			self.arpTable.SetCompress(u.IP, true)
+			if len(ip6) > 0 {
+				self.arpTable.SetCompress(ip6, true)
+			}
+		}
+
+		if self.subnets != nil {
+			self.subnets.bind(user, u.IP)
+		}
+		if self.userStats != nil {
+			self.userStats.bind(user, conn, key)
+		}
+		self.bindSession(key, self.newClientSession(user, u))
+		self.bindLiveUser(user, conn, u.IP, ip6)
+
+		return u.IP, key, func(id string) {
+			close(ended)
+			self.unbindLiveUser(user, conn)
+			self.unbindSession(key)
+			if self.subnets != nil {
+				self.subnets.unbind(user, id)
+			}
+			if self.userStats != nil {
+				self.userStats.unbind(conn, key)
+			}
+			self.arpTable.Delete(id)
+			if len(ip6) > 0 {
+				self.arpTable.Delete(ip6)
+			}
+			if pooled {
+				self.releaseAddress(user)
+			}
+		}
+	}
+	rejectConn(conn, connection.CLOSE_TRY_AGAIN_LATER, "already connected")
+	return "", nil, nil
+}
+
+// rejectConn closes a session refused for another reason than its token,
+// with a close code telling the client whether to try again.
+func rejectConn(conn interface{}, code int, reason string) {
+	if peer, ok := conn.(connection.Peer); ok {
+		peer.Close(code, reason)
+	}
+}
+
+// publicIPOf returns the public address claimed by the peer when it is
+// plausible: a global address matching the source of the connection, unless
+// the connection comes from a private network (proxy, LAN).
+func publicIPOf(user string, peer connection.Peer) string {
+	claimed := net.ParseIP(peer.PublicIP())
+	if claimed == nil || !claimed.IsGlobalUnicast() || claimed.IsPrivate() {
+		log.Info("User", user, "sent an invalid public ip", peer.PublicIP())
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(peer.RemoteAddr())
+	observed := net.ParseIP(host)
+	if err == nil && observed != nil && !observed.IsPrivate() && !observed.IsLoopback() && !observed.Equal(claimed) {
+		log.Info("User", user, "claims public ip", claimed, "but connects from", observed)
+		return observed.String()
+	}
+
+	log.Debug("User", user, "public ip", claimed)
+	return claimed.String()
+}
 
-		return tunWrite(r.Conn, dataEn)
+// USER_SALT_MIN is the shortest Salt of a user, hivpn -gen-client makes
+// one of crypto.SALT_LEN random bytes.
+const USER_SALT_MIN = 16
+
+// userKey turns a password into the AES key of the user, see
+// crypto.DeriveKey. The client and the server get the same one from the
+// same Pass and Salt.
+func userKey(name, password, salt string) (string, error) {
+	if len(salt) < USER_SALT_MIN {
+		return "", fmt.Errorf("user %s has no Salt of at least %d characters, hivpn -gen-client %s on the server makes one", name, USER_SALT_MIN, name)
+	}
+	key, err := crypto.DeriveKey(password, salt)
+	if err != nil {
+		return "", fmt.Errorf("key of user %s: %v", name, err)
 	}
+	return string(key), nil
 }
 
-func (vpn *VPN) writeTunToDev(key, data []byte) {
-	rawData, err := crypto.AESDecrypt(key, data)
+func (vpn *VPN) setupAuthentication() error {
+	var err error
+	vpn.userTable, err = vpn.buildUserTable(vpn.conf.Users)
 	if err != nil {
-		log.Debug("decrypt data error", err)
-		return
+		return err
 	}
 
-	header := network.ParseHeaderPacket(rawData)
-	if vpn.inMyNetwork(header.IPDst) {
-		err = vpn.writeDevToTun(header, rawData)
-		if err != nil {
-			log.Debug("write dev to tun error", err)
-		}
-		return
+	if vpn.conf.Authenticator == nil && len(vpn.conf.AuthWebhook) > 0 {
+		vpn.conf.Authenticator = vpn.newWebhookAuth()
 	}
-
-	_, err = vpn.dev.Write(rawData, 0)
-	if err != nil {
-		log.Error("write tun to dev err", err)
+	if vpn.conf.Authenticator == nil {
+		vpn.conf.Authenticator = staticUsers{vpn}
 	}
+	return nil
 }
 
-func (vpn *VPN) handler() {
-	buf := make([]byte, vpn.conf.MTU)
-	for {
-		n, err := vpn.dev.Read(buf, 0)
-		if err != nil {
-			log.Error("read data from vpn error", err)
-			continue
-		}
-		packet := buf[:n]
-
-		header := network.ParseHeaderPacket(packet)
-		if vpn.blackList[header.IPDst.String()] {
-			log.Debug("Block ip", header.IPDst)
-			continue
+// buildUserTable prepares the users by name.
+func (vpn *VPN) buildUserTable(users []User) (map[string]User, error) {
+	table := make(map[string]User, 0)
+	for _, u := range users {
+		if _, found := table[u.Name]; found {
+			return nil, fmt.Errorf("user %s is configured more than once", u.Name)
 		}
 
-		err = vpn.writeDevToTun(header, packet)
+		user, err := vpn.prepareUser(u)
 		if err != nil {
-			log.Debug("write dev to tun error", err)
-			continue
+			return nil, err
 		}
-
+		table[u.Name] = user
 	}
+	return table, nil
 }
 
-func (self *VPN) authenConn(token string, conn interface{}) (string, []byte, func(id string)) {
-	arr := strings.Split(token, ":")
-	if len(arr) < 2 {
-		return "", nil, nil
-	}
-	user := arr[0]
-	u, found := self.userTable[user]
-	if !found {
-		return "", nil, nil
-	}
-	keyBase64 := arr[1]
-
-	tokenByte, err := base64.StdEncoding.DecodeString(keyBase64)
-	if err != nil {
-		return "", nil, nil
-	}
-
-	keyByte, err := crypto.AESDecrypt([]byte(u.Pass), tokenByte)
+// prepareUser turns a configured user into its entry of the user table:
+// the key of its password and its bare addresses.
+func (vpn *VPN) prepareUser(u User) (User, error) {
+	pass, err := userKey(u.Name, u.Pass, u.Salt)
 	if err != nil {
-		return "", nil, nil
+		return User{}, err
 	}
 
-	for _, c := range keyByte {
-		if c < 48 || (58 < c && c < 64) || (91 < c && c < 96) || c > 123 {
-			return "", nil, nil
+	ip6 := ""
+	if len(u.IP6) > 0 {
+		addr, _, err := net.ParseCIDR(u.IP6)
+		if err == nil {
+			ip6 = addr.String()
+		} else {
+			log.Error("invalid ipv6 address of user", u.Name, err)
 		}
 	}
 
-	if !self.arpTable.Update(u.IP, conn, keyByte) {
-		return u.IP, keyByte, self.arpTable.Delete
+	ip := ""
+	if len(u.IP) > 0 {
+		ip = network.GetIp(u.IP)
 	}
-	return "", nil, nil
-}
-
-func (vpn *VPN) setupAuthentication() {
-	KEY_LEN := 32
-	vpn.userTable = make(map[string]User, 0)
 
-	for _, u := range vpn.conf.Users {
-		pass := ""
-		if len(u.Pass) < KEY_LEN {
-			pass = fmt.Sprintf("%s%s", u.Pass, strings.Repeat("t", KEY_LEN-len(u.Pass)))
+	if vpn.conf.IsServer && u.MTU != 0 {
+		min := MIN_USER_MTU
+		if len(ip6) > 0 {
+			min = MIN_USER_MTU6
 		}
-
-		vpn.userTable[u.Name] = User{
-			Pass: pass,
-			IP:   network.GetIp(u.IP),
+		if u.MTU < min || u.MTU > vpn.conf.MTU {
+			return User{}, fmt.Errorf("MTU of user %s must be between %d and the MTU of the server (%d)", u.Name, min, vpn.conf.MTU)
 		}
 	}
+
+	return User{
+		Pass:   pass,
+		Salt:   u.Salt,
+		IP:     ip,
+		IP6:    ip6,
+		Routes: u.Routes,
+		Group:  u.Group,
+		NAT64:  u.NAT64,
+		Quota:  u.Quota,
+		MTU:    u.MTU,
+		Rate:   u.Rate,
+
+		AllowedPorts: u.AllowedPorts,
+		Subnets:      u.Subnets,
+	}, nil
 }
 
+// setupRoute configures the tun device and the routes through it. The
+// order matters to avoid leaking or blackholing traffic:
+//
+//  1. address and MTU of the device (linux: device brought up afterwards)
+//  2. routes that must bypass the tunnel (whitelist and the server itself)
+//  3. the default routes through the tunnel
+//  4. the blacklist routes
+//
+// stop undoes them in the reverse order.
 func (vpn *VPN) setupRoute() error {
 	if YOUR_OS == "linux" {
 		tunCmd := [][]string{
 			{"link", "set", "dev", TUN_NAME, "mtu", fmt.Sprintf("%d", vpn.conf.MTU)},
 			{"addr", "add", vpn.conf.LocalAddr, "dev", TUN_NAME},
-			{"link", "set", "dev", TUN_NAME, "up"},
 		}
 
+		if len(vpn.conf.LocalAddr6) > 0 {
+			tunCmd = append(tunCmd, []string{"-6", "addr", "add", vpn.conf.LocalAddr6, "dev", TUN_NAME})
+		}
+
+		tunCmd = append(tunCmd, []string{"link", "set", "dev", TUN_NAME, "up"})
+
 		if !vpn.conf.IsServer {
-			tunCmd = append(tunCmd, [][]string{
-				{"route", "add", "0.0.0.0/1", "dev", TUN_NAME},
-				{"route", "add", "128.0.0.0/1", "dev", TUN_NAME},
-			}...)
+			currentDefaultGateway, err := network.GetDefaultGatewayLinux()
+			if err != nil {
+				return err
+			}
+			vpn.gatewayLinux = currentDefaultGateway
+
+			vpn.conf.Whitelist = append(vpn.conf.Whitelist, serverRoute(vpn.conf.ServerAddr))
+			for _, ipW := range vpn.conf.Whitelist {
+				tunCmd = append(tunCmd, linuxBypassRoute("add", ipW, currentDefaultGateway))
+			}
+
+			if len(vpn.conf.Cgroup) < 1 && !vpn.conf.DNSOnly {
+				tunCmd = append(tunCmd, [][]string{
+					{"route", "add", "0.0.0.0/1", "dev", TUN_NAME},
+					{"route", "add", "128.0.0.0/1", "dev", TUN_NAME},
+				}...)
+			}
 		}
 
+		// what went through before a failure is torn down too
+		vpn.routesUp = !vpn.conf.IsServer
 		for _, cmdAgrs := range tunCmd {
-			err := runCmd("/sbin/ip", cmdAgrs...)
+			err := vpn.runCmd("/sbin/ip", cmdAgrs...)
 			if err != nil {
 				return err
 			}
 		}
+
+		if !vpn.conf.IsServer && len(vpn.conf.Cgroup) > 0 {
+			err := vpn.setupCgroup()
+			if err != nil {
+				return err
+			}
+			vpn.cgroupUp = true
+		}
+
+		if !vpn.conf.IsServer && vpn.conf.DNSOnly {
+			err := vpn.setupDNSOnly()
+			if err != nil {
+				return err
+			}
+			vpn.dnsOnlyUp = true
+		}
 	} else if YOUR_OS == "windows" && !vpn.conf.IsServer {
 		currentDefaultGateway, err := network.GetDefaultGatewayWindows()
 		if err != nil {
 			return err
 		}
+		vpn.gatewayWindows = currentDefaultGateway
 
 		iface, err := net.InterfaceByName(TUN_NAME)
 		if err != nil {
 			return err
 		}
 
-		vpn.conf.Whitelist = append(vpn.conf.Whitelist, network.GetIp(vpn.conf.ServerAddr)+"/32")
+		vpn.conf.Whitelist = append(vpn.conf.Whitelist, serverRoute(vpn.conf.ServerAddr))
 
 		tunCmd := [][]string{
 			{"netsh", "interface", "ip", "set", "address", fmt.Sprintf("name=%d", iface.Index), "source=static", "addr=" + network.GetIp(vpn.conf.LocalAddr), "mask=" + network.CIDRToMask(vpn.conf.LocalAddr), "gateway=none"},
-			{"route", "add", "0.0.0.0", "mask", "0.0.0.0", vpn.conf.DefaultGateway, "if", fmt.Sprintf("%d", iface.Index), "metric", "5"},
-			// {"route", "add", network.GetIp(vpn.conf.ServerAddr), "mask", "255.255.255.255", currentDefaultGateway.Gateway},
+			{"netsh", "interface", "ipv4", "set", "subinterface", fmt.Sprintf("%d", iface.Index), fmt.Sprintf("mtu=%d", vpn.conf.MTU), "store=active"},
+		}
+
+		if len(vpn.conf.LocalAddr6) > 0 {
+			tunCmd = append(tunCmd, []string{
+				"netsh", "interface", "ipv6", "add", "address", fmt.Sprintf("interface=%d", iface.Index), "address=" + vpn.conf.LocalAddr6,
+			})
 		}
 
 		for _, ipW := range vpn.conf.Whitelist {
+			if network.IsIPv6(ipW) {
+				if len(vpn.gateway6Win.Interface) < 1 {
+					vpn.gateway6Win, err = network.GetDefaultGateway6Windows()
+					if err != nil {
+						return err
+					}
+				}
+				tunCmd = append(tunCmd, windowsRoute6("add", ipW, vpn.gateway6Win.Interface, vpn.gateway6Win.Gateway))
+				continue
+			}
 			tunCmd = append(tunCmd, []string{
 				"route", "add", network.GetIp(ipW), "mask", network.CIDRToMask(ipW), currentDefaultGateway.Gateway,
 			})
 		}
 
-		for _, ipB := range vpn.conf.Blacklist {
+		if vpn.conf.DNSOnly {
+			// no marks on windows, only the resolver goes through the tunnel
+			tunCmd = append(tunCmd, []string{
+				"route", "add", vpn.dnsHost(), "mask", "255.255.255.255", vpn.conf.DefaultGateway, "if", fmt.Sprintf("%d", iface.Index), "metric", "5",
+			})
+		} else {
 			tunCmd = append(tunCmd, []string{
-				"route", "add", ipB, "mask", "255.255.255.255", vpn.conf.DefaultGateway, "if", fmt.Sprintf("%d", iface.Index), "metric", "5",
+				"route", "add", "0.0.0.0", "mask", "0.0.0.0", vpn.conf.DefaultGateway, "if", fmt.Sprintf("%d", iface.Index), "metric", "5",
 			})
-			vpn.blackList[ipB] = true
+		}
+
+		for _, ipB := range vpn.conf.Blacklist {
+			tunCmd = append(tunCmd, vpn.blacklistRouteCmd("add", ipB))
+		}
+
+		for _, cmdAgrs := range tunCmd {
+			err := vpn.runCmd(cmdAgrs[0], cmdAgrs[1:]...)
+			if err != nil {
+				return err
+			}
+		}
+	} else if YOUR_OS == "darwin" {
+		// utun is point to point, the network gets a route of its own
+		ip, ipNet, err := net.ParseCIDR(vpn.conf.LocalAddr)
+		if err != nil {
+			return err
+		}
+		tunCmd := [][]string{
+			{"/sbin/ifconfig", vpn.devName, "inet", ip.String(), ip.String(), "netmask", network.CIDRToMask(vpn.conf.LocalAddr),
+				"mtu", fmt.Sprintf("%d", vpn.conf.MTU), "up"},
+			{"/sbin/route", "-n", "add", "-net", ipNet.String(), "-interface", vpn.devName},
+		}
+
+		if len(vpn.conf.LocalAddr6) > 0 {
+			ip6, ipNet6, err := net.ParseCIDR(vpn.conf.LocalAddr6)
+			if err != nil {
+				return err
+			}
+			ones, _ := ipNet6.Mask.Size()
+			tunCmd = append(tunCmd, []string{"/sbin/ifconfig", vpn.devName, "inet6", ip6.String(), "prefixlen", fmt.Sprintf("%d", ones), "alias"})
+		}
+
+		if !vpn.conf.IsServer {
+			currentDefaultGateway, err := network.GetDefaultGatewayDarwin()
+			if err != nil {
+				return err
+			}
+			vpn.gatewayDarwin = currentDefaultGateway
+
+			vpn.conf.Whitelist = append(vpn.conf.Whitelist, serverRoute(vpn.conf.ServerAddr))
+			for _, ipW := range vpn.conf.Whitelist {
+				tunCmd = append(tunCmd, darwinBypassRoute("add", ipW, currentDefaultGateway))
+			}
+
+			// no marks on darwin either, like windows
+			if vpn.conf.DNSOnly {
+				tunCmd = append(tunCmd, []string{"/sbin/route", "-n", "add", "-host", vpn.dnsHost(), "-interface", vpn.devName})
+			} else {
+				tunCmd = append(tunCmd, vpn.darwinDefaultRoutes("add")...)
+			}
 		}
 
 		for _, cmdAgrs := range tunCmd {
-			err := runCmd(cmdAgrs[0], cmdAgrs[1:]...)
+			err := vpn.runCmd(cmdAgrs[0], cmdAgrs[1:]...)
 			if err != nil {
 				return err
 			}
@@ -342,37 +1960,385 @@ func (vpn *VPN) setupRoute() error {
 		return fmt.Errorf("not support os: %v", YOUR_OS)
 	}
 
+	if !vpn.conf.IsServer {
+		vpn.blocked.Store(newBlockList(vpn.conf.Blacklist))
+	}
+
+	if !vpn.conf.IsServer {
+		routes := vpn.pushedRoutes
+		vpn.pushedRoutes = nil
+		vpn.addPushedRoutes(routes)
+	}
+
+	if !vpn.conf.IsServer && len(vpn.conf.DNS) > 0 {
+		return vpn.setupDNS()
+	}
+
+	return nil
+}
+
+// setupDNS runs a forwarder on the loopback and makes it the system
+// resolver, so queries reach vpn.conf.DNS through the tunnel even when the
+// OS would pick another resolver.
+func (vpn *VPN) setupDNS() error {
+	forwarder, err := network.NewDNSForwarder(vpn.conf.DNS)
+	if err != nil {
+		return fmt.Errorf("start dns forwarder error: %v", err)
+	}
+	vpn.dnsForwarder = forwarder
+
+	if YOUR_OS == "windows" {
+		iface, err := net.InterfaceByName(TUN_NAME)
+		if err != nil {
+			return err
+		}
+		return vpn.runCmd("netsh", "interface", "ip", "set", "dns", fmt.Sprintf("name=%d", iface.Index), "source=static", "addr=127.0.0.1")
+	}
+
+	// darwin does not read resolv.conf, its resolver takes the servers of
+	// the network service
+	var undo string
+	if YOUR_OS == "darwin" {
+		service, old, err := network.SetDarwinDNS(vpn.gatewayDarwin.Interface)
+		if err != nil {
+			return err
+		}
+		vpn.dnsChange, undo = "set the dns of "+service, "restore the dns of "+service
+		vpn.restoreDNS = func() error { return network.RestoreDarwinDNS(service, old) }
+	} else {
+		old, err := network.SetResolvConf()
+		if err != nil {
+			return err
+		}
+		vpn.dnsChange, undo = "write "+network.RESOLV_CONF, "restore "+network.RESOLV_CONF
+		vpn.restoreDNS = func() error { return network.RestoreResolvConf(old) }
+	}
+	vpn.changes.record(vpn.dnsChange, undo, vpn.restoreDNS)
 	return nil
 }
 
+func (vpn *VPN) stopDNS() {
+	if vpn.dnsForwarder == nil {
+		return
+	}
+
+	if vpn.restoreDNS != nil {
+		err := vpn.restoreDNS()
+		if err != nil {
+			log.Error("restore dns error:", err)
+		} else {
+			vpn.changes.reverted(vpn.dnsChange)
+		}
+		vpn.restoreDNS = nil
+	}
+
+	vpn.dnsForwarder.Close()
+	vpn.dnsForwarder = nil
+}
+
+// addPushedRoutes routes the networks the server pushed for this user
+// through the tunnel, deletePushedRoutes removes them on disconnect.
+func (vpn *VPN) addPushedRoutes(routes []string) {
+	if vpn.conf.Device != nil {
+		return
+	}
+	for _, r := range routes {
+		c, args := vpn.pushedRouteCmd("add", r)
+		err := vpn.runCmd(c, args...)
+		if err != nil {
+			log.Error("add pushed route", r, "error:", err)
+			continue
+		}
+		log.Info("Route", r, "pushed by the server")
+		vpn.pushedRoutes = append(vpn.pushedRoutes, r)
+	}
+}
+
+func (vpn *VPN) deletePushedRoutes() {
+	for _, r := range vpn.pushedRoutes {
+		c, args := vpn.pushedRouteCmd("delete", r)
+		err := vpn.runCmd(c, args...)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	vpn.pushedRoutes = nil
+}
+
+func (vpn *VPN) pushedRouteCmd(action, cidr string) (string, []string) {
+	if YOUR_OS == "windows" {
+		iface, err := net.InterfaceByName(TUN_NAME)
+		if err != nil || action == "delete" {
+			return "route", []string{action, network.GetIp(cidr), "mask", network.CIDRToMask(cidr)}
+		}
+		return "route", []string{action, network.GetIp(cidr), "mask", network.CIDRToMask(cidr), vpn.conf.DefaultGateway, "if", fmt.Sprintf("%d", iface.Index), "metric", "5"}
+	}
+	if YOUR_OS == "darwin" {
+		if network.IsIPv6(cidr) {
+			return "/sbin/route", []string{"-n", action, "-inet6", "-net", cidr, "-interface", vpn.devName}
+		}
+		return "/sbin/route", []string{"-n", action, "-net", cidr, "-interface", vpn.devName}
+	}
+	return "/sbin/ip", []string{"route", action, cidr, "dev", TUN_NAME}
+}
+
+func windowsRoute6(action, prefix, iface, nexthop string) []string {
+	cmdAgrs := []string{"netsh", "interface", "ipv6", action, "route", "prefix=" + prefix, "interface=" + iface}
+	if len(nexthop) > 0 {
+		cmdAgrs = append(cmdAgrs, "nexthop="+nexthop)
+	}
+	return cmdAgrs
+}
+
+func linuxBypassRoute(action, cidr string, gw network.LinuxRouter) []string {
+	cmdAgrs := []string{"route", action, cidr}
+	if len(gw.Gateway) > 0 {
+		cmdAgrs = append(cmdAgrs, "via", gw.Gateway)
+	}
+	return append(cmdAgrs, "dev", gw.Interface)
+}
+
+// darwinBypassRoute sends cidr through the original gateway, or straight to
+// its interface when the default route has no gateway.
+func darwinBypassRoute(action, cidr string, gw network.DarwinRouter) []string {
+	cmdAgrs := []string{"/sbin/route", "-n", action}
+	if network.IsIPv6(cidr) {
+		cmdAgrs = append(cmdAgrs, "-inet6")
+	}
+	cmdAgrs = append(cmdAgrs, "-net", cidr)
+	if len(gw.Gateway) > 0 && !network.IsIPv6(cidr) {
+		return append(cmdAgrs, gw.Gateway)
+	}
+	return append(cmdAgrs, "-interface", gw.Interface)
+}
+
+// darwinDefaultRoutes are the two halves of the address space through the
+// device, they win over the default route without replacing it.
+func (vpn *VPN) darwinDefaultRoutes(action string) [][]string {
+	return [][]string{
+		{"/sbin/route", "-n", action, "-net", "0.0.0.0/1", "-interface", vpn.devName},
+		{"/sbin/route", "-n", action, "-net", "128.0.0.0/1", "-interface", vpn.devName},
+	}
+}
+
+// stopRouteLinux deletes what setupRoute added on a linux client in the
+// reverse order, and puts back the default route it found if something
+// took it away meanwhile. Only what is still there is deleted, so the
+// routes that went with the device or were removed by hand give no error.
+func (vpn *VPN) stopRouteLinux() {
+	var tunCmd [][]string
+	if len(vpn.conf.Cgroup) < 1 && !vpn.conf.DNSOnly && !vpn.pausedRoutes {
+		tunCmd = append(tunCmd, [][]string{
+			{"route", "del", "0.0.0.0/1", "dev", TUN_NAME},
+			{"route", "del", "128.0.0.0/1", "dev", TUN_NAME},
+		}...)
+	}
+
+	if len(vpn.gatewayLinux.Interface) > 0 {
+		for _, ipW := range vpn.conf.Whitelist {
+			tunCmd = append(tunCmd, linuxBypassRoute("delete", ipW, vpn.gatewayLinux))
+		}
+	}
+
+	if len(vpn.conf.LocalAddr6) > 0 {
+		tunCmd = append(tunCmd, []string{"-6", "addr", "del", vpn.conf.LocalAddr6, "dev", TUN_NAME})
+	}
+	if len(vpn.conf.LocalAddr) > 0 {
+		tunCmd = append(tunCmd, []string{"addr", "del", vpn.conf.LocalAddr, "dev", TUN_NAME})
+	}
+
+	for _, cmdAgrs := range tunCmd {
+		if !linuxHasEntry(cmdAgrs) {
+			continue
+		}
+		err := vpn.runCmd("/sbin/ip", cmdAgrs...)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	gw := vpn.gatewayLinux
+	if len(gw.Interface) < 1 {
+		return
+	}
+	if current, err := network.GetDefaultGatewayLinux(); err == nil && len(current.Interface) > 0 {
+		return
+	}
+	log.Info("Default route is gone, restore it through", gw.Interface)
+	err := vpn.runCmd("/sbin/ip", linuxBypassRoute("add", "default", gw)...)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// linuxHasEntry tells whether the route or the address an ip command
+// deletes is there, ip shows it with the same selectors.
+func linuxHasEntry(cmdAgrs []string) bool {
+	del := -1
+	for i, a := range cmdAgrs {
+		if a == "del" || a == "delete" {
+			del = i
+			break
+		}
+	}
+	if del < 1 || del+1 >= len(cmdAgrs) {
+		return true
+	}
+
+	if cmdAgrs[del-1] != "addr" {
+		show := append(append([]string{}, cmdAgrs[:del]...), "show")
+		output, err := exec.Command("/sbin/ip", append(show, cmdAgrs[del+1:]...)...).Output()
+		return err == nil && len(strings.TrimSpace(string(output))) > 0
+	}
+
+	// ip addr show lists all the addresses of the device
+	want, _, err := net.ParseCIDR(cmdAgrs[del+1])
+	if err != nil {
+		return true
+	}
+	show := append(append([]string{}, cmdAgrs[:del]...), "show")
+	output, err := exec.Command("/sbin/ip", append(show, cmdAgrs[del+2:]...)...).Output()
+	if err != nil {
+		return false
+	}
+	for _, field := range strings.Fields(string(output)) {
+		if ip, _, err := net.ParseCIDR(field); err == nil && ip.Equal(want) {
+			return true
+		}
+	}
+	return false
+}
+
 func (vpn *VPN) stop() {
 	log.Info("Stop vpn ...")
-	if vpn.conf.IsServer {
+	if vpn.scriptUp && len(vpn.conf.DownScript) > 0 {
+		vpn.runScript(vpn.conf.DownScript)
+		vpn.scriptUp = false
+	}
+	vpn.stopDNS()
+	vpn.deletePushedRoutes()
+	vpn.quotas.save()
+
+	if vpn.unprivileged && !vpn.conf.IsServer {
+		// the routes through the device go away with it, the bypass
+		// routes cannot be deleted without root
+		log.Info("Running as", vpn.conf.RunAsUser, ", the whitelist routes are left in place")
+	} else if vpn.conf.IsServer || vpn.conf.Device != nil {
 	} else {
+		vpn.listsMu.Lock()
+		defer vpn.listsMu.Unlock()
+
 		if YOUR_OS == "linux" {
+			if vpn.cgroupUp {
+				vpn.stopCgroup()
+				vpn.cgroupUp = false
+			}
+
+			if vpn.dnsOnlyUp {
+				vpn.stopDNSOnly()
+				vpn.dnsOnlyUp = false
+			}
 
+			if vpn.routesUp {
+				vpn.stopRouteLinux()
+				vpn.routesUp = false
+			}
 		} else if YOUR_OS == "windows" {
+			for _, ipB := range vpn.conf.Blacklist {
+				vpn.runRouteCmd(vpn.blacklistRouteCmd("delete", ipB))
+			}
+
+			cmdAgrs := []string{"route", "delete", "0.0.0.0", "mask", "0.0.0.0", vpn.conf.DefaultGateway}
+			if vpn.conf.DNSOnly {
+				cmdAgrs = []string{"route", "delete", vpn.dnsHost(), "mask", "255.255.255.255", vpn.conf.DefaultGateway}
+			}
+			err := vpn.runCmd(cmdAgrs[0], cmdAgrs[1:]...)
+			if err != nil {
+				log.Error(err)
+			}
+
 			for _, ipW := range vpn.conf.Whitelist {
-				err := runCmd("route", "delete", network.GetIp(ipW), "mask", network.CIDRToMask(ipW))
+				cmdAgrs := []string{"route", "delete", network.GetIp(ipW), "mask", network.CIDRToMask(ipW)}
+				if network.IsIPv6(ipW) {
+					if len(vpn.gateway6Win.Interface) < 1 {
+						continue
+					}
+					cmdAgrs = windowsRoute6("delete", ipW, vpn.gateway6Win.Interface, "")
+				}
+				err := vpn.runCmd(cmdAgrs[0], cmdAgrs[1:]...)
 				if err != nil {
 					log.Error(err)
 				}
 			}
-
-			for _, ipB := range vpn.conf.Blacklist {
-				err := runCmd("route", "delete", ipB)
+		} else if YOUR_OS == "darwin" {
+			var cmds [][]string
+			if vpn.conf.DNSOnly {
+				cmds = [][]string{{"/sbin/route", "-n", "delete", "-host", vpn.dnsHost(), "-interface", vpn.devName}}
+			} else if !vpn.pausedRoutes {
+				cmds = vpn.darwinDefaultRoutes("delete")
+			}
+			if len(vpn.gatewayDarwin.Interface) > 0 {
+				for _, ipW := range vpn.conf.Whitelist {
+					cmds = append(cmds, darwinBypassRoute("delete", ipW, vpn.gatewayDarwin))
+				}
+			}
+			for _, cmdAgrs := range cmds {
+				err := vpn.runCmd(cmdAgrs[0], cmdAgrs[1:]...)
 				if err != nil {
 					log.Error(err)
 				}
 			}
 		}
 	}
+
+	vpn.stopGroups()
+	if vpn.dev != nil {
+		vpn.dev.Close()
+		if vpn.conf.Device == nil {
+			vpn.changes.deviceGone(vpn.devName)
+		}
+	}
+	// whatever the teardown missed, without root it stays
+	if !vpn.unprivileged {
+		vpn.changes.revertAll()
+	}
 	log.Info("Done!(GoodBye)")
 	// fmt.Println("Press the Enter Key to exit!")
 	// fmt.Scanln()
 }
 
-func runCmd(c string, args ...string) error {
+// runScript runs a user hook through the shell with the tunnel settings
+// in its environment and logs whatever it prints.
+func (vpn *VPN) runScript(script string) {
+	log.Debug("Run script", script)
+	var cmd *exec.Cmd
+	if YOUR_OS == "windows" {
+		cmd = exec.Command("cmd", "/C", script)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", script)
+	}
+
+	cmd.Env = append(os.Environ(),
+		"HIVPN_DEV="+vpn.devName,
+		"HIVPN_ADDRESS="+vpn.conf.LocalAddr,
+		"HIVPN_ADDRESS6="+vpn.conf.LocalAddr6,
+		fmt.Sprintf("HIVPN_MTU=%d", vpn.conf.MTU),
+	)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		log.Info(script+":", strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		log.Error("run script error:", err)
+	}
+}
+
+// runCmd runs a command changing the system, recorded in the changelog.
+func (vpn *VPN) runCmd(c string, args ...string) error {
+	return vpn.changes.run(c, args...)
+}
+
+func execCmd(c string, args ...string) error {
 	log.Debug(c, strings.Join(args, " "))
 	cmd := exec.Command(c, args...)
 	cmd.Stdout = os.Stdout
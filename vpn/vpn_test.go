@@ -0,0 +1,134 @@
+package vpn
+
+import (
+	"encoding/base64"
+	"hivpn/crypto"
+	"hivpn/utils"
+	"math/bits"
+	"strings"
+	"testing"
+)
+
+// testServer is a server VPN with users, enough for authentication.
+func testServer(t *testing.T, users ...User) *VPN {
+	v := &VPN{conf: Config{IsServer: true, MTU: 1500, Clock: utils.RealClock}}
+	var err error
+	v.userTable, err = v.buildUserTable(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.conf.Authenticator = staticUsers{v}
+	return v
+}
+
+// testToken is the token a client with pass sends for user, as Create
+// makes it.
+func testToken(t *testing.T, user User, pass string) string {
+	client := &VPN{conf: Config{MTU: 1500, Clock: utils.RealClock}}
+	user.Pass = pass
+	u, err := client.prepareUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenByte, err := crypto.AESEncrypt([]byte(u.Pass), []byte(utils.GenUUID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.Name + ":" + base64.StdEncoding.EncodeToString(tokenByte)
+}
+
+func TestLongPasswordAuthenticates(t *testing.T) {
+	for _, size := range []int{31, 32, 33, 40, 64} {
+		pass := strings.Repeat("p", size-1) + "!"
+		user := User{Name: "long", Pass: pass, Salt: TEST_SALT, IP: "172.16.0.2/24"}
+		server := testServer(t, user)
+
+		if len(server.userTable["long"].Pass) != crypto.KEY_LEN {
+			t.Fatalf("key of a %d bytes password is %d bytes", size, len(server.userTable["long"].Pass))
+		}
+		if _, _, _, ok := server.checkToken(testToken(t, user, pass)); !ok {
+			t.Errorf("password of %d bytes refused", size)
+		}
+		// a 40 bytes password differing past the 32nd byte is another one
+		if _, _, _, ok := server.checkToken(testToken(t, user, pass[:size-1]+"?")); ok {
+			t.Errorf("password of %d bytes accepted with its last byte changed", size)
+		}
+	}
+}
+
+func TestShortPasswordKey(t *testing.T) {
+	keys := make(map[string]string, 0)
+	for _, pass := range []string{"a", "b", "pw"} {
+		key, err := userKey("user", pass, TEST_SALT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(key) != crypto.KEY_LEN || strings.HasPrefix(key, pass) {
+			t.Fatalf("key of %q is %q", pass, key)
+		}
+		// a padded password would be mostly one byte
+		distinct := make(map[byte]bool, 0)
+		for i := 0; i < len(key); i++ {
+			distinct[key[i]] = true
+		}
+		if len(distinct) < 20 {
+			t.Errorf("key of %q has %d distinct bytes out of %d", pass, len(distinct), len(key))
+		}
+		keys[pass] = key
+	}
+
+	differ := 0
+	for i := 0; i < crypto.KEY_LEN; i++ {
+		differ += bits.OnesCount8(keys["a"][i] ^ keys["b"][i])
+	}
+	if differ < 64 {
+		t.Errorf("keys of two one-letter passwords differ in %d bits", differ)
+	}
+}
+
+func TestWrongPasswordRefused(t *testing.T) {
+	user := User{Name: "user", Pass: "password", Salt: TEST_SALT, IP: "172.16.0.2/24"}
+	server := testServer(t, user)
+
+	if _, _, _, ok := server.checkToken(testToken(t, user, "password")); !ok {
+		t.Fatal("right password refused")
+	}
+	for _, pass := range []string{"", "p", "Password", "password ", "passwore"} {
+		if _, _, _, ok := server.checkToken(testToken(t, user, pass)); ok {
+			t.Errorf("password %q accepted", pass)
+		}
+	}
+	other := user
+	other.Salt = strings.ToUpper(TEST_SALT)
+	if _, _, _, ok := server.checkToken(testToken(t, other, "password")); ok {
+		t.Error("right password with another salt accepted")
+	}
+}
+
+func TestUserSaltRequired(t *testing.T) {
+	v := &VPN{conf: Config{IsServer: true, MTU: 1500, Clock: utils.RealClock}}
+	for _, salt := range []string{"", "short"} {
+		user := User{Name: "user", Pass: "password", Salt: salt, IP: "172.16.0.2/24"}
+		if _, err := v.buildUserTable([]User{user}); err == nil {
+			t.Errorf("user with Salt %q accepted", salt)
+		}
+	}
+
+	// the same password gives another key with another salt
+	a, _ := userKey("user", "password", TEST_SALT)
+	b, _ := userKey("user", "password", strings.ToUpper(TEST_SALT))
+	if a == b {
+		t.Error("same key for two salts")
+	}
+}
+
+func TestServerRoute(t *testing.T) {
+	for addr, want := range map[string]string{
+		"192.0.2.1:443":     "192.0.2.1/32",
+		"[2001:db8::1]:443": "2001:db8::1/128",
+	} {
+		if got := serverRoute(addr); got != want {
+			t.Errorf("route of server %s is %s, want %s", addr, got, want)
+		}
+	}
+}